@@ -0,0 +1,61 @@
+package grpcserver
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// Client calls UserService through the given connection, e.g. one created by grpc.NewClient
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewClient creates client of UserService
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+// Get returns user with the given ID, missing users are reported with codes.NotFound status
+func (t *Client) Get(ctx context.Context, id string) (*UserProfile, error) {
+	var result UserProfile
+	if err := t.conn.Invoke(ctx, "/"+serviceName+"/Get", &GetUserRequest{ID: id}, &result, grpc.ForceCodec(codec{})); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Query returns a page of users
+func (t *Client) Query(ctx context.Context, req *QueryUsersRequest) (*QueryUsersResponse, error) {
+	var result QueryUsersResponse
+	if err := t.conn.Invoke(ctx, "/"+serviceName+"/Query", req, &result, grpc.ForceCodec(codec{})); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Add streams the given users to the server and returns number of the added ones
+func (t *Client) Add(ctx context.Context, users []*UserProfile) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := t.conn.NewStream(ctx, &userServiceDesc.Streams[0], "/"+serviceName+"/Add", grpc.ForceCodec(codec{}))
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		if err := stream.SendMsg(u); err != nil {
+			// server closed the stream, its status is returned by RecvMsg
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return 0, err
+	}
+
+	var result AddUsersResponse
+	if err := stream.RecvMsg(&result); err != nil {
+		return 0, err
+	}
+	return int(result.Added), nil
+}
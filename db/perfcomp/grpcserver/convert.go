@@ -0,0 +1,73 @@
+package grpcserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+)
+
+// ToProto converts user to the protobufdemo model; creation time and oauth accounts have no counterparts there,
+// so they are dropped, while age is unknown and stored users are always active
+func ToProto(p *logic.UserProfile) *UserProfile {
+	result := &UserProfile{
+		ID:    strconv.Itoa(p.ID),
+		Name:  splitName(p.Name),
+		State: ProfileStateActive,
+	}
+	for _, r := range p.Roles {
+		result.Roles = append(result.Roles, &Role{Name: r})
+	}
+	return result
+}
+
+// FromProto converts user of the protobufdemo model, that is created at the given time; age and state are not
+// kept by the store, so they are dropped
+func FromProto(p *UserProfile, created time.Time) (*logic.UserProfile, error) {
+	id, err := strconv.Atoi(p.ID)
+	if err != nil {
+		return nil, fmt.Errorf("malformed user id=%q", p.ID)
+	}
+
+	result := &logic.UserProfile{ID: id, Name: joinName(p.Name), Created: created}
+	for _, r := range p.Roles {
+		result.Roles = append(result.Roles, r.Name)
+	}
+	return result, nil
+}
+
+//
+// Private
+//
+
+// splitName takes the first and the last words of the name, any words between them make a middle name
+func splitName(name string) *FullName {
+	words := strings.Fields(name)
+	switch len(words) {
+	case 0:
+		return &FullName{}
+	case 1:
+		return &FullName{First: words[0]}
+	default:
+		return &FullName{
+			First:  words[0],
+			Last:   words[len(words)-1],
+			Middle: strings.Join(words[1:len(words)-1], " "),
+		}
+	}
+}
+
+func joinName(name *FullName) string {
+	if name == nil {
+		return ""
+	}
+	words := []string{}
+	for _, w := range []string{name.First, name.Middle, name.Last} {
+		if len(w) > 0 {
+			words = append(words, w)
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,311 @@
+package grpcserver
+
+import (
+	"fmt"
+
+	"github.com/avshabanov/go-code/db/perfcomp/pbwire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProfileState mirrors protobufdemo.ProfileState
+type ProfileState int32
+
+// Profile states
+const (
+	ProfileStateInactive ProfileState = 0
+	ProfileStateActive   ProfileState = 1
+)
+
+// UserProfile mirrors protobufdemo.UserProfile
+type UserProfile struct {
+	ID    string
+	Name  *FullName
+	Age   int32
+	Roles []*Role
+	State ProfileState
+}
+
+// FullName mirrors protobufdemo.FullName
+type FullName struct {
+	First  string
+	Last   string
+	Middle string
+}
+
+// Role mirrors protobufdemo.Role
+type Role struct {
+	Name string
+}
+
+// GetUserRequest mirrors perfcomp.GetUserRequest
+type GetUserRequest struct {
+	ID string
+}
+
+// QueryUsersRequest mirrors perfcomp.QueryUsersRequest
+type QueryUsersRequest struct {
+	PageToken  string
+	PageSize   int32
+	Role       string
+	Provider   string
+	NamePrefix string
+}
+
+// QueryUsersResponse mirrors perfcomp.QueryUsersResponse
+type QueryUsersResponse struct {
+	Users         []*UserProfile
+	NextPageToken string
+}
+
+// AddUsersResponse mirrors perfcomp.AddUsersResponse
+type AddUsersResponse struct {
+	Added int32
+}
+
+//
+// Private
+//
+
+// message is implemented by all the messages above, they write protocol buffers wire format of the messages
+// defined in proto/user_service.proto and serialization/protobufdemo/proto/hello.proto by hand with pbwire
+type message interface {
+	appendTo(b []byte) []byte
+	consume(data []byte) error
+}
+
+// codec encodes gRPC messages, it is named after the default codec, so that the server is compatible with the
+// clients generated from the proto files
+type codec struct{}
+
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("unable to marshal unknown message type=%T", v)
+	}
+	return m.appendTo(nil), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("unable to unmarshal unknown message type=%T", v)
+	}
+	return m.consume(data)
+}
+
+// protobuf field numbers, see proto/user_service.proto and hello.proto of protobufdemo
+const (
+	pbProfileID    protowire.Number = 1
+	pbProfileName  protowire.Number = 2
+	pbProfileAge   protowire.Number = 3
+	pbProfileRoles protowire.Number = 4
+	pbProfileState protowire.Number = 5
+
+	pbNameFirst  protowire.Number = 1
+	pbNameLast   protowire.Number = 2
+	pbNameMiddle protowire.Number = 3
+
+	pbRoleName protowire.Number = 1
+
+	pbGetID protowire.Number = 1
+
+	pbQueryPageToken  protowire.Number = 1
+	pbQueryPageSize   protowire.Number = 2
+	pbQueryRole       protowire.Number = 3
+	pbQueryProvider   protowire.Number = 4
+	pbQueryNamePrefix protowire.Number = 5
+
+	pbQueryUsers         protowire.Number = 1
+	pbQueryNextPageToken protowire.Number = 2
+
+	pbAddAdded protowire.Number = 1
+)
+
+func (m *UserProfile) appendTo(b []byte) []byte {
+	b = appendPbString(b, pbProfileID, m.ID)
+	if m.Name != nil {
+		b = appendPbMessage(b, pbProfileName, m.Name)
+	}
+	b = appendPbInt32(b, pbProfileAge, m.Age)
+	for _, r := range m.Roles {
+		b = appendPbMessage(b, pbProfileRoles, r)
+	}
+	return appendPbInt32(b, pbProfileState, int32(m.State))
+}
+
+func (m *UserProfile) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == pbProfileID && typ == protowire.BytesType:
+			return consumePbString(v, &m.ID)
+		case num == pbProfileName && typ == protowire.BytesType:
+			m.Name = &FullName{}
+			return consumePbMessageField(v, m.Name)
+		case num == pbProfileAge && typ == protowire.VarintType:
+			return consumePbInt32(v, &m.Age)
+		case num == pbProfileRoles && typ == protowire.BytesType:
+			r := &Role{}
+			m.Roles = append(m.Roles, r)
+			return consumePbMessageField(v, r)
+		case num == pbProfileState && typ == protowire.VarintType:
+			return consumePbInt32(v, (*int32)(&m.State))
+		default:
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+	})
+}
+
+func (m *FullName) appendTo(b []byte) []byte {
+	b = appendPbString(b, pbNameFirst, m.First)
+	b = appendPbString(b, pbNameLast, m.Last)
+	return appendPbString(b, pbNameMiddle, m.Middle)
+}
+
+func (m *FullName) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == pbNameFirst && typ == protowire.BytesType:
+			return consumePbString(v, &m.First)
+		case num == pbNameLast && typ == protowire.BytesType:
+			return consumePbString(v, &m.Last)
+		case num == pbNameMiddle && typ == protowire.BytesType:
+			return consumePbString(v, &m.Middle)
+		default:
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+	})
+}
+
+func (m *Role) appendTo(b []byte) []byte {
+	return appendPbString(b, pbRoleName, m.Name)
+}
+
+func (m *Role) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		if num == pbRoleName && typ == protowire.BytesType {
+			return consumePbString(v, &m.Name)
+		}
+		return protowire.ConsumeFieldValue(num, typ, v), nil
+	})
+}
+
+func (m *GetUserRequest) appendTo(b []byte) []byte {
+	return appendPbString(b, pbGetID, m.ID)
+}
+
+func (m *GetUserRequest) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		if num == pbGetID && typ == protowire.BytesType {
+			return consumePbString(v, &m.ID)
+		}
+		return protowire.ConsumeFieldValue(num, typ, v), nil
+	})
+}
+
+func (m *QueryUsersRequest) appendTo(b []byte) []byte {
+	b = appendPbString(b, pbQueryPageToken, m.PageToken)
+	b = appendPbInt32(b, pbQueryPageSize, m.PageSize)
+	b = appendPbString(b, pbQueryRole, m.Role)
+	b = appendPbString(b, pbQueryProvider, m.Provider)
+	return appendPbString(b, pbQueryNamePrefix, m.NamePrefix)
+}
+
+func (m *QueryUsersRequest) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == pbQueryPageToken && typ == protowire.BytesType:
+			return consumePbString(v, &m.PageToken)
+		case num == pbQueryPageSize && typ == protowire.VarintType:
+			return consumePbInt32(v, &m.PageSize)
+		case num == pbQueryRole && typ == protowire.BytesType:
+			return consumePbString(v, &m.Role)
+		case num == pbQueryProvider && typ == protowire.BytesType:
+			return consumePbString(v, &m.Provider)
+		case num == pbQueryNamePrefix && typ == protowire.BytesType:
+			return consumePbString(v, &m.NamePrefix)
+		default:
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+	})
+}
+
+func (m *QueryUsersResponse) appendTo(b []byte) []byte {
+	for _, u := range m.Users {
+		b = appendPbMessage(b, pbQueryUsers, u)
+	}
+	return appendPbString(b, pbQueryNextPageToken, m.NextPageToken)
+}
+
+func (m *QueryUsersResponse) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == pbQueryUsers && typ == protowire.BytesType:
+			u := &UserProfile{}
+			m.Users = append(m.Users, u)
+			return consumePbMessageField(v, u)
+		case num == pbQueryNextPageToken && typ == protowire.BytesType:
+			return consumePbString(v, &m.NextPageToken)
+		default:
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+	})
+}
+
+func (m *AddUsersResponse) appendTo(b []byte) []byte {
+	return appendPbInt32(b, pbAddAdded, m.Added)
+}
+
+func (m *AddUsersResponse) consume(data []byte) error {
+	return pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		if num == pbAddAdded && typ == protowire.VarintType {
+			return consumePbInt32(v, &m.Added)
+		}
+		return protowire.ConsumeFieldValue(num, typ, v), nil
+	})
+}
+
+// proto3 scalar fields are omitted when they have default values
+
+func appendPbString(b []byte, num protowire.Number, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendPbInt32 writes int32 field, negative values are sign-extended to 64 bits as required by the wire format
+func appendPbInt32(b []byte, num protowire.Number, v int32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(v)))
+}
+
+func appendPbMessage(b []byte, num protowire.Number, m message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.appendTo(nil))
+}
+
+func consumePbString(v []byte, target *string) (int, error) {
+	s, n := protowire.ConsumeString(v)
+	*target = s
+	return n, nil
+}
+
+func consumePbInt32(v []byte, target *int32) (int, error) {
+	x, n := protowire.ConsumeVarint(v)
+	*target = int32(x)
+	return n, nil
+}
+
+func consumePbMessageField(v []byte, m message) (int, error) {
+	data, n := protowire.ConsumeBytes(v)
+	if n < 0 {
+		return n, nil
+	}
+	return n, m.consume(data)
+}
@@ -0,0 +1,202 @@
+// Package grpcserver exposes logic.Dao as UserService gRPC API defined in proto/user_service.proto, users are
+// described by the model of serialization/protobufdemo, and provides client of that API
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits of the page size of user queries
+const (
+	DefaultPageSize = 10
+	MaxPageSize     = 1000
+)
+
+// AddBatchSize is a number of streamed users, that are added to DAO at once
+const AddBatchSize = 100
+
+// NewServer creates gRPC server of UserService backed by the given DAO, the messages are always encoded by the
+// server's own codec, so the options should not force the other one
+func NewServer(dao logic.Dao, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append(opts, grpc.ForceServerCodec(codec{}))...)
+	s.RegisterService(&userServiceDesc, &service{dao: dao})
+	return s
+}
+
+//
+// Private
+//
+
+const serviceName = "perfcomp.UserService"
+
+// userServiceServer is implemented by handlers of userServiceDesc
+type userServiceServer interface {
+	get(ctx context.Context, req *GetUserRequest) (*UserProfile, error)
+	query(ctx context.Context, req *QueryUsersRequest) (*QueryUsersResponse, error)
+	add(stream grpc.ServerStream) error
+}
+
+var userServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*userServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler: unaryHandler("Get", func() message { return &GetUserRequest{} },
+				func(srv userServiceServer, ctx context.Context, req message) (interface{}, error) {
+					return srv.get(ctx, req.(*GetUserRequest))
+				}),
+		},
+		{
+			MethodName: "Query",
+			Handler: unaryHandler("Query", func() message { return &QueryUsersRequest{} },
+				func(srv userServiceServer, ctx context.Context, req message) (interface{}, error) {
+					return srv.query(ctx, req.(*QueryUsersRequest))
+				}),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Add",
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(userServiceServer).add(stream)
+			},
+		},
+	},
+	Metadata: "db/perfcomp/grpcserver/proto/user_service.proto",
+}
+
+// unaryHandler decodes request of the given method and passes it to the handler through interceptor, if any
+func unaryHandler(
+	method string,
+	newRequest func() message,
+	handle func(srv userServiceServer, ctx context.Context, req message) (interface{}, error),
+) grpc.MethodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return handle(srv.(userServiceServer), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return handle(srv.(userServiceServer), ctx, req.(message))
+		})
+	}
+}
+
+type service struct {
+	dao logic.Dao
+}
+
+func (t *service) get(ctx context.Context, req *GetUserRequest) (*UserProfile, error) {
+	id, err := strconv.Atoi(req.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed user id=%q", req.ID)
+	}
+
+	p, err := t.dao.Get(ctx, id)
+	if err != nil {
+		return nil, daoError(err)
+	}
+	return ToProto(p), nil
+}
+
+func (t *service) query(ctx context.Context, req *QueryUsersRequest) (*QueryUsersResponse, error) {
+	limit := int(req.PageSize)
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page size should be within [1, %d], actual: %d", MaxPageSize, req.PageSize)
+	}
+
+	var query *logic.UserQuery
+	if len(req.Role) > 0 || len(req.Provider) > 0 || len(req.NamePrefix) > 0 {
+		query = &logic.UserQuery{Role: req.Role, Provider: req.Provider, NamePrefix: req.NamePrefix}
+	}
+
+	page, err := t.dao.QueryUsers(ctx, query, req.PageToken, limit)
+	if err != nil {
+		return nil, daoError(err)
+	}
+
+	result := &QueryUsersResponse{NextPageToken: page.OffsetToken}
+	for _, p := range page.Profiles {
+		result.Users = append(result.Users, ToProto(p))
+	}
+	return result, nil
+}
+
+func (t *service) add(stream grpc.ServerStream) error {
+	// the store requires creation time, which is not a part of the protobufdemo model
+	created := time.Now().UTC()
+	added := 0
+	batch := make([]*logic.UserProfile, 0, AddBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// DAOs reject users with taken IDs, so that the stored users never lose their creation time and accounts
+		if err := t.dao.Add(stream.Context(), batch); err != nil {
+			return status.Errorf(status.Code(daoError(err)), "unable to add users after %d added ones: %v", added, err)
+		}
+		added += len(batch)
+		// DAOs might keep the slice, so it is not reused
+		batch = make([]*logic.UserProfile, 0, AddBatchSize)
+		return nil
+	}
+
+	for {
+		var m UserProfile
+		err := stream.RecvMsg(&m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		p, err := FromProto(&m, created)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v, %d users are added", err, added)
+		}
+
+		batch = append(batch, p)
+		if len(batch) == AddBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	return stream.SendMsg(&AddUsersResponse{Added: int32(added)})
+}
+
+func daoError(err error) error {
+	if errors.Is(err, logic.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if errors.Is(err, logic.ErrInvalidOffsetToken) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if errors.Is(err, logic.ErrAlreadyExists) {
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,284 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"github.com/avshabanov/go-code/db/perfcomp/logic/daotest"
+	"github.com/avshabanov/go-code/db/perfcomp/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	serve := func(t *testing.T, dao logic.Dao) *Client {
+		listener := bufconn.Listen(1 << 20)
+		s := NewServer(dao)
+		go s.Serve(listener)
+		t.Cleanup(s.Stop)
+
+		conn, err := grpc.NewClient("passthrough:///bufconn",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return NewClient(conn)
+	}
+	newClient := func(t *testing.T) (*Client, logic.Dao) {
+		dao := logic.NewMemoryDao()
+		return serve(t, dao), dao
+	}
+	newUsers := func(ids ...int) []*UserProfile {
+		result := []*UserProfile{}
+		for _, id := range ids {
+			result = append(result, &UserProfile{
+				ID:    strconv.Itoa(id),
+				Name:  &FullName{First: "User", Last: strconv.Itoa(id)},
+				Roles: []*Role{{Name: "READER"}},
+			})
+		}
+		return result
+	}
+
+	t.Run("users round trip", func(t *testing.T) {
+		client, dao := newClient(t)
+		ids := []int{}
+		for id := 1; id <= AddBatchSize+5; id++ {
+			ids = append(ids, id)
+		}
+		added, err := client.Add(ctx, newUsers(ids...))
+		require.Nil(t, err)
+		assert.Equal(t, len(ids), added)
+
+		stored, err := dao.Get(ctx, 2)
+		require.Nil(t, err)
+		assert.Equal(t, "User 2", stored.Name)
+		assert.Equal(t, []string{"READER"}, stored.Roles)
+		assert.False(t, stored.Created.IsZero())
+
+		u, err := client.Get(ctx, "2")
+		require.Nil(t, err)
+		assert.Equal(t, &UserProfile{
+			ID:    "2",
+			Name:  &FullName{First: "User", Last: "2"},
+			Roles: []*Role{{Name: "READER"}},
+			State: ProfileStateActive,
+		}, u)
+
+		page, err := client.Query(ctx, &QueryUsersRequest{PageSize: 100})
+		require.Nil(t, err)
+		require.Len(t, page.Users, 100)
+		assert.Equal(t, "1", page.Users[0].ID)
+
+		page, err = client.Query(ctx, &QueryUsersRequest{PageToken: page.NextPageToken})
+		require.Nil(t, err)
+		require.Len(t, page.Users, 5)
+		assert.Equal(t, "101", page.Users[0].ID)
+		assert.Empty(t, page.NextPageToken)
+	})
+
+	t.Run("filtered query", func(t *testing.T) {
+		client, dao := newClient(t)
+		require.Nil(t, dao.Add(ctx, daotest.NewProfiles(1, 2, 3)))
+
+		page, err := client.Query(ctx, &QueryUsersRequest{Provider: "Google", Role: "READER"})
+		require.Nil(t, err)
+		require.Len(t, page.Users, 1)
+		assert.Equal(t, "3", page.Users[0].ID)
+	})
+
+	t.Run("existing users are not overwritten", func(t *testing.T) {
+		client, dao := newClient(t)
+		stored := daotest.NewProfiles(1)[0]
+		require.Nil(t, dao.Add(ctx, []*logic.UserProfile{stored}))
+
+		_, err := client.Add(ctx, newUsers(2, 1))
+		assert.Equal(t, codes.AlreadyExists, status.Code(err), "unexpected error: %v", err)
+		_, err = client.Add(ctx, newUsers(3, 3))
+		assert.Equal(t, codes.AlreadyExists, status.Code(err), "unexpected error: %v", err)
+
+		p, err := dao.Get(ctx, 1)
+		require.Nil(t, err)
+		daotest.AssertProfilesEqual(t, stored, p)
+		for _, id := range []int{2, 3} {
+			_, err = dao.Get(ctx, id)
+			assert.True(t, errors.Is(err, logic.ErrNotFound), "user id=%d should not be added, err=%v", id, err)
+		}
+	})
+
+	// run with -race to catch unguarded access to the recorder
+	t.Run("parallel requests are recorded", func(t *testing.T) {
+		const callers, calls = 8, 20
+
+		dao := logic.NewMemoryDao()
+		require.Nil(t, dao.Add(ctx, daotest.NewProfiles(1)))
+		recorder := stats.NewRecorder()
+		client := serve(t, stats.NewSyncTimedDao(dao, recorder))
+
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < calls; j++ {
+					_, err := client.Get(ctx, "1")
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		summaries := recorder.Summarize(time.Second)
+		require.Len(t, summaries, 1)
+		assert.Equal(t, int64(callers*calls), summaries[0].Count)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		client, _ := newClient(t)
+
+		_, err := client.Get(ctx, "1")
+		assert.Equal(t, codes.NotFound, status.Code(err), "unexpected error: %v", err)
+		_, err = client.Get(ctx, "abc")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "unexpected error: %v", err)
+		_, err = client.Query(ctx, &QueryUsersRequest{PageSize: MaxPageSize + 1})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "unexpected error: %v", err)
+		_, err = client.Query(ctx, &QueryUsersRequest{PageToken: "abc"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "unexpected error: %v", err)
+
+		users := newUsers(1, 2)
+		users[1].ID = "second"
+		_, err = client.Add(ctx, users)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "unexpected error: %v", err)
+	})
+}
+
+func TestConvert(t *testing.T) {
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, name := range []string{"", "Alice", "Alice Smith", "Alice Jane Mary Smith"} {
+		t.Run("name "+name, func(t *testing.T) {
+			p := &logic.UserProfile{ID: 7, Name: name, Created: created, Roles: []string{"ADMIN", "READER"}}
+			converted, err := FromProto(ToProto(p), created)
+			require.Nil(t, err)
+			assert.Equal(t, p, converted)
+		})
+	}
+
+	t.Run("middle name", func(t *testing.T) {
+		assert.Equal(t, &FullName{First: "Alice", Middle: "Jane Mary", Last: "Smith"}, ToProto(&logic.UserProfile{Name: "Alice Jane Mary Smith"}).Name)
+	})
+
+	t.Run("accounts are dropped", func(t *testing.T) {
+		p := daotest.NewProfiles(1)[0]
+		require.NotEmpty(t, p.Accounts)
+		converted, err := FromProto(ToProto(p), p.Created)
+		require.Nil(t, err)
+		assert.Empty(t, converted.Accounts)
+	})
+
+	t.Run("malformed id", func(t *testing.T) {
+		_, err := FromProto(&UserProfile{ID: "x"}, created)
+		assert.EqualError(t, err, `malformed user id="x"`)
+	})
+}
+
+// TestWireFormat checks that hand encoded messages are understood by the protobuf library, which is given
+// descriptor of hello.proto
+func TestWireFormat(t *testing.T) {
+	descriptor := newHelloDescriptor(t).Messages().ByName("UserProfile")
+	u := &UserProfile{
+		ID:    "42",
+		Name:  &FullName{First: "Alice", Last: "Smith", Middle: "Jane"},
+		Age:   -1,
+		Roles: []*Role{{Name: "ADMIN"}, {Name: "EDITOR"}},
+		State: ProfileStateActive,
+	}
+
+	m := dynamicpb.NewMessage(descriptor)
+	require.Nil(t, proto.Unmarshal(u.appendTo(nil), m))
+	fields := descriptor.Fields()
+	assert.Equal(t, "42", m.Get(fields.ByName("id")).String())
+	assert.Equal(t, int64(-1), m.Get(fields.ByName("age")).Int())
+	assert.Equal(t, protoreflect.EnumNumber(1), m.Get(fields.ByName("state")).Enum())
+	name := m.Get(fields.ByName("name")).Message()
+	assert.Equal(t, "Jane", name.Get(name.Descriptor().Fields().ByName("middle")).String())
+	roles := m.Get(fields.ByName("roles")).List()
+	require.Equal(t, 2, roles.Len())
+	role := roles.Get(1).Message()
+	assert.Equal(t, "EDITOR", role.Get(role.Descriptor().Fields().ByName("name")).String())
+
+	data, err := proto.Marshal(m)
+	require.Nil(t, err)
+	var decoded UserProfile
+	require.Nil(t, decoded.consume(data))
+	assert.Equal(t, u, &decoded)
+}
+
+// newHelloDescriptor describes serialization/protobufdemo/proto/hello.proto
+func newHelloDescriptor(t *testing.T) protoreflect.FileDescriptor {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   typ.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if len(typeName) > 0 {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	roles := field("roles", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".protobufdemo.Role")
+	roles.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("serialization/protobufdemo/proto/hello.proto"),
+		Package: proto.String("protobufdemo"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("ProfileState"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("INACTIVE"), Number: proto.Int32(0)},
+				{Name: proto.String("ACTIVE"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("UserProfile"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".protobufdemo.FullName"),
+				field("age", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+				roles,
+				field("state", 5, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".protobufdemo.ProfileState"),
+			}},
+			{Name: proto.String("FullName"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("first", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("last", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("middle", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+			}},
+			{Name: proto.String("Role"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+			}},
+		},
+	}, nil)
+	require.Nil(t, err)
+	return file
+}
@@ -0,0 +1,196 @@
+// Package keydist generates keys requested by benchmark workloads according to distributions resembling real
+// traffic, where some keys are far more popular than others
+package keydist
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Distribution kinds
+const (
+	Uniform    = "uniform"
+	Zipfian    = "zipfian"
+	Hotspot    = "hotspot"
+	Sequential = "sequential"
+	Latest     = "latest"
+)
+
+// Defaults of the distribution parameters omitted in the spec
+const (
+	DefaultSkew           = 1.1
+	DefaultHotSetFraction = 0.2
+	DefaultHotOpFraction  = 0.8
+)
+
+// Distribution describes how requested keys are spread over the key space of n keys numbered from 0
+type Distribution struct {
+	Kind string
+
+	// Skew is the exponent of Zipfian and latest distributions, greater values concentrate requests on fewer keys;
+	// it should be greater than 1
+	Skew float64
+
+	// HotSetFraction is the share of keys of hotspot distribution that get HotOpFraction of requests, while the
+	// remaining requests are spread uniformly over the other keys
+	HotSetFraction float64
+	HotOpFraction  float64
+}
+
+// Generator produces keys in [0, n), generators are not safe for concurrent use, so that each job needs its own one
+type Generator interface {
+	Next() int
+}
+
+// Parse parses distribution spec, which is the distribution kind optionally followed by colon-separated parameters:
+// uniform, zipfian[:skew], hotspot[:hotSetFraction[:hotOpFraction]], sequential or latest[:skew],
+// e.g. zipfian:1.2 or hotspot:0.1:0.9
+func Parse(spec string) (*Distribution, error) {
+	parts := strings.Split(spec, ":")
+	params := []float64{}
+	for _, p := range parts[1:] {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed parameter %q of key distribution %q", p, spec)
+		}
+		params = append(params, v)
+	}
+
+	result := &Distribution{Kind: parts[0]}
+	maxParams := 0
+	switch result.Kind {
+	case Uniform, Sequential:
+	case Zipfian, Latest:
+		maxParams = 1
+		result.Skew = getParam(params, 0, DefaultSkew)
+		if result.Skew <= 1 {
+			return nil, fmt.Errorf("skew of key distribution %q should be greater than 1", spec)
+		}
+	case Hotspot:
+		maxParams = 2
+		result.HotSetFraction = getParam(params, 0, DefaultHotSetFraction)
+		result.HotOpFraction = getParam(params, 1, DefaultHotOpFraction)
+		if result.HotSetFraction <= 0 || result.HotSetFraction > 1 || result.HotOpFraction < 0 || result.HotOpFraction > 1 {
+			return nil, fmt.Errorf("fractions of key distribution %q should be within (0, 1] and [0, 1]", spec)
+		}
+	default:
+		return nil, fmt.Errorf("unknown key distribution %q", spec)
+	}
+
+	if len(params) > maxParams {
+		return nil, fmt.Errorf("key distribution %q takes at most %d parameters", spec, maxParams)
+	}
+	return result, nil
+}
+
+// String returns spec of the distribution with all parameters, so that it can be parsed back
+func (d *Distribution) String() string {
+	switch d.Kind {
+	case Zipfian, Latest:
+		return fmt.Sprintf("%s:%g", d.Kind, d.Skew)
+	case Hotspot:
+		return fmt.Sprintf("%s:%g:%g", d.Kind, d.HotSetFraction, d.HotOpFraction)
+	default:
+		return d.Kind
+	}
+}
+
+// NewGenerator creates generator of n keys that takes random numbers from r; the popular keys of Zipfian and hotspot
+// distributions are scattered over the key space, so that they are not clustered at its start, while the popular
+// keys of latest distribution are the last ones; there should be at least one key
+func (d *Distribution) NewGenerator(r *rand.Rand, n int) (Generator, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("key distribution %s needs at least one key, actual number of keys: %d", d, n)
+	}
+
+	switch d.Kind {
+	case Zipfian:
+		return &zipfianGenerator{zipf: rand.NewZipf(r, d.Skew, 1, uint64(n-1)), n: uint64(n)}, nil
+	case Latest:
+		return &latestGenerator{zipf: rand.NewZipf(r, d.Skew, 1, uint64(n-1)), n: n}, nil
+	case Hotspot:
+		hot := int(d.HotSetFraction * float64(n))
+		if hot < 1 {
+			hot = 1
+		}
+		return &hotspotGenerator{r: r, n: n, hot: hot, hotOpFraction: d.HotOpFraction}, nil
+	case Sequential:
+		// jobs start at different keys, so that they do not request the same keys in lockstep
+		return &sequentialGenerator{n: n, next: r.Intn(n)}, nil
+	default:
+		return &uniformGenerator{r: r, n: n}, nil
+	}
+}
+
+//
+// Private
+//
+
+type uniformGenerator struct {
+	r *rand.Rand
+	n int
+}
+
+func (g *uniformGenerator) Next() int {
+	return g.r.Intn(g.n)
+}
+
+type zipfianGenerator struct {
+	zipf *rand.Zipf
+	n    uint64
+}
+
+func (g *zipfianGenerator) Next() int {
+	return scatter(g.zipf.Uint64(), g.n)
+}
+
+type latestGenerator struct {
+	zipf *rand.Zipf
+	n    int
+}
+
+func (g *latestGenerator) Next() int {
+	return g.n - 1 - int(g.zipf.Uint64())
+}
+
+type hotspotGenerator struct {
+	r             *rand.Rand
+	n             int
+	hot           int // number of hot keys
+	hotOpFraction float64
+}
+
+func (g *hotspotGenerator) Next() int {
+	if g.hot == g.n || g.r.Float64() < g.hotOpFraction {
+		return scatter(uint64(g.r.Intn(g.hot)), uint64(g.n))
+	}
+	return scatter(uint64(g.hot+g.r.Intn(g.n-g.hot)), uint64(g.n))
+}
+
+type sequentialGenerator struct {
+	n    int
+	next int
+}
+
+func (g *sequentialGenerator) Next() int {
+	result := g.next
+	g.next = (g.next + 1) % g.n
+	return result
+}
+
+// scatterPrime permutes ranks of keys, unless the number of keys is its multiple
+const scatterPrime = 2654435761
+
+// scatter maps rank of the key to the key itself
+func scatter(rank uint64, n uint64) int {
+	return int((rank * scatterPrime) % n)
+}
+
+func getParam(params []float64, i int, defaultValue float64) float64 {
+	if i < len(params) {
+		return params[i]
+	}
+	return defaultValue
+}
@@ -0,0 +1,140 @@
+package keydist
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for spec, expected := range map[string]*Distribution{
+		"uniform":          {Kind: Uniform},
+		"sequential":       {Kind: Sequential},
+		"zipfian":          {Kind: Zipfian, Skew: DefaultSkew},
+		"zipfian:1.5":      {Kind: Zipfian, Skew: 1.5},
+		"latest:2":         {Kind: Latest, Skew: 2},
+		"hotspot":          {Kind: Hotspot, HotSetFraction: DefaultHotSetFraction, HotOpFraction: DefaultHotOpFraction},
+		"hotspot:0.1":      {Kind: Hotspot, HotSetFraction: 0.1, HotOpFraction: DefaultHotOpFraction},
+		"hotspot:0.01:0.9": {Kind: Hotspot, HotSetFraction: 0.01, HotOpFraction: 0.9},
+	} {
+		t.Run(spec, func(t *testing.T) {
+			d, err := Parse(spec)
+			require.Nil(t, err)
+			assert.Equal(t, expected, d)
+
+			reparsed, err := Parse(d.String())
+			require.Nil(t, err)
+			assert.Equal(t, d, reparsed)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		for spec, message := range map[string]string{
+			"gaussian":        `unknown key distribution "gaussian"`,
+			"zipfian:x":       `malformed parameter "x" of key distribution "zipfian:x"`,
+			"zipfian:0.99":    `skew of key distribution "zipfian:0.99" should be greater than 1`,
+			"latest:1.1:2":    `key distribution "latest:1.1:2" takes at most 1 parameters`,
+			"uniform:1":       `key distribution "uniform:1" takes at most 0 parameters`,
+			"hotspot:0":       `fractions of key distribution "hotspot:0" should be within (0, 1] and [0, 1]`,
+			"hotspot:0.2:1.5": `fractions of key distribution "hotspot:0.2:1.5" should be within (0, 1] and [0, 1]`,
+		} {
+			_, err := Parse(spec)
+			assert.EqualError(t, err, message)
+		}
+	})
+}
+
+func TestGenerator(t *testing.T) {
+	const n = 1000
+	const count = 100000
+	// countKeys returns number of requests of every key
+	countKeys := func(t *testing.T, spec string) []int {
+		d, err := Parse(spec)
+		require.Nil(t, err)
+		g, err := d.NewGenerator(rand.New(rand.NewSource(1)), n)
+		require.Nil(t, err)
+
+		result := make([]int, n)
+		for i := 0; i < count; i++ {
+			k := g.Next()
+			require.True(t, k >= 0 && k < n, "key %d is out of range", k)
+			result[k]++
+		}
+		return result
+	}
+	// countTop returns number of requests of the given number of the most popular keys
+	countTop := func(counts []int, top int) int {
+		sorted := append([]int{}, counts...)
+		sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+		result := 0
+		for _, c := range sorted[:top] {
+			result += c
+		}
+		return result
+	}
+
+	t.Run("uniform", func(t *testing.T) {
+		counts := countKeys(t, "uniform")
+		assert.InEpsilon(t, 0.01, float64(countTop(counts, 10))/count, 0.5)
+	})
+
+	t.Run("zipfian", func(t *testing.T) {
+		counts := countKeys(t, "zipfian:1.5")
+		assert.Greater(t, float64(countTop(counts, 10))/count, 0.6)
+		// the second most popular key is scattered away from the start of the key space
+		assert.Greater(t, counts[scatter(1, n)], counts[1])
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		counts := countKeys(t, "latest:1.5")
+		assert.Greater(t, float64(counts[n-1]+counts[n-2]+counts[n-3])/count, 0.6)
+		assert.Greater(t, counts[n-1], counts[n-2])
+	})
+
+	t.Run("hotspot", func(t *testing.T) {
+		counts := countKeys(t, "hotspot:0.1:0.9")
+		assert.InEpsilon(t, 0.9, float64(countTop(counts, n/10))/count, 0.02)
+
+		hot := 0
+		for rank := 0; rank < n/10; rank++ {
+			hot += counts[scatter(uint64(rank), n)]
+		}
+		assert.InEpsilon(t, 0.9, float64(hot)/count, 0.02)
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		d, err := Parse("sequential")
+		require.Nil(t, err)
+		g, err := d.NewGenerator(rand.New(rand.NewSource(1)), 3)
+		require.Nil(t, err)
+		first := g.Next()
+		assert.Equal(t, []int{(first + 1) % 3, (first + 2) % 3, first}, []int{g.Next(), g.Next(), g.Next()})
+	})
+
+	t.Run("single key", func(t *testing.T) {
+		for _, spec := range []string{"uniform", "zipfian", "latest", "hotspot", "sequential"} {
+			d, err := Parse(spec)
+			require.Nil(t, err)
+			g, err := d.NewGenerator(rand.New(rand.NewSource(1)), 1)
+			require.Nil(t, err)
+			for i := 0; i < 10; i++ {
+				assert.Equal(t, 0, g.Next(), spec)
+			}
+		}
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		for _, spec := range []string{"uniform", "zipfian", "latest", "hotspot", "sequential"} {
+			d, err := Parse(spec)
+			require.Nil(t, err)
+			for _, n := range []int{0, -1} {
+				_, err := d.NewGenerator(rand.New(rand.NewSource(1)), n)
+				assert.EqualError(t, err, fmt.Sprintf("key distribution %s needs at least one key, actual number of keys: %d", d, n))
+			}
+		}
+	})
+}
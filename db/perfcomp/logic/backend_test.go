@@ -0,0 +1,18 @@
+package logic
+
+// testBackend opens file-based DAO at the given path
+type testBackend struct {
+	name string
+	open func(path string) (Dao, error)
+}
+
+// file-based backends of the tests, bolt-batch shares write transactions of concurrent callers
+var (
+	testSqlite    = &testBackend{"sqlite", NewSqliteDao}
+	testKvSqlite  = &testBackend{"kvsqlite", NewKvSqliteDao}
+	testBolt      = &testBackend{"bolt", NewBoltDao}
+	testLevelDb   = &testBackend{"leveldb", NewLevelDbDao}
+	testBoltBatch = &testBackend{"bolt-batch", func(path string) (Dao, error) {
+		return NewBoltDaoWithOptions(path, gobCodec{}, &BoltOptions{Batch: true})
+	}}
+)
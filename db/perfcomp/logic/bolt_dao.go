@@ -2,11 +2,12 @@ package logic
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/gob"
-	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -15,7 +16,34 @@ import (
 type boltDao struct {
 	Dao
 
-	db *bolt.DB
+	db            *bolt.DB
+	codec         Codec
+	options       *BoltOptions
+	changes       changeNotifier
+	schemaVersion int // behind the latest one only if DB is opened for reading
+}
+
+// BoltOptions defines settings of Bolt DB, zero values keep defaults of bolt
+type BoltOptions struct {
+	// NoSync skips fsync after every commit, which might lose last commits on power failure
+	NoSync bool
+
+	// NoGrowSync skips fsync after the database file grows
+	NoGrowSync bool
+
+	// FillPercent is a share of page filled before it is split, bolt uses 0.5 by default, while 1.0 suits
+	// insertion of ascending keys best
+	FillPercent float64
+
+	// Batch makes Add share write transactions of concurrent callers by means of bolt.DB.Batch
+	Batch bool
+
+	// MaxBatchSize and MaxBatchDelay limit the shared transactions, applicable to batch mode only
+	MaxBatchSize  int
+	MaxBatchDelay time.Duration
+
+	// ReadOnly opens the database for reading only, pending migrations are not applied to it then
+	ReadOnly bool
 }
 
 var (
@@ -23,46 +51,157 @@ var (
 	bucketMeta  = []byte("metadata")
 	bucketUsers = []byte("users")
 
+	// change feed bucket, keys are big-endian sequence numbers
+	bucketChanges = []byte("changes")
+
+	// secondary index buckets, keys of non-unique indexes are index values followed by big-endian user ID and
+	// their values are empty, keys of unique indexes are index values and their values are big-endian user IDs
+	bucketIdxName     = []byte("idx_name")
+	bucketIdxCreated  = []byte("idx_created")
+	bucketIdxRole     = []byte("idx_role")
+	bucketIdxProvider = []byte("idx_provider")
+	bucketIdxAccount  = []byte("idx_account")
+
 	// constants
 	versionName  = []byte("version")
 	versionValue = []byte("perfcomp-1.0")
+	codecName    = []byte("codec")
 )
 
-// NewBoltDao creates Bolt DB-based DAO
+// boltIndex describes secondary index, kept in its own bucket
+type boltIndex struct {
+	bucket []byte
+	unique bool
+	keys   func(p *UserProfile) [][]byte
+}
+
+var boltIndexes = []*boltIndex{
+	{bucket: bucketIdxName, keys: func(p *UserProfile) [][]byte {
+		return [][]byte{stringKey(p.Name, p.ID)}
+	}},
+	{bucket: bucketIdxCreated, keys: func(p *UserProfile) [][]byte {
+		return [][]byte{cursorKey(OrderByCreated, p)}
+	}},
+	{bucket: bucketIdxRole, keys: func(p *UserProfile) [][]byte {
+		result := [][]byte{}
+		for _, r := range p.Roles {
+			result = append(result, stringKey(r, p.ID))
+		}
+		return result
+	}},
+	{bucket: bucketIdxProvider, keys: func(p *UserProfile) [][]byte {
+		result := [][]byte{}
+		for _, a := range p.Accounts {
+			result = append(result, stringKey(a.Provider, p.ID)) // duplicates of the same provider collapse
+		}
+		return result
+	}},
+	{bucket: bucketIdxAccount, unique: true, keys: func(p *UserProfile) [][]byte {
+		result := [][]byte{}
+		for _, a := range p.Accounts {
+			result = append(result, accountKey(a.Provider, a.Token))
+		}
+		return result
+	}},
+}
+
+// boltMigration is a migration of Bolt DB schema, all the pending migrations are applied in one transaction
+type boltMigration struct {
+	migration
+	apply func(t *boltDao, tx *bolt.Tx) error
+}
+
+// boltMigrations is a registry of Bolt DB schema migrations, ordered by version
+var boltMigrations = []*boltMigration{
+	{migration{1, "initial schema"}, func(t *boltDao, tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(bucketMeta)
+		if err != nil {
+			return fmt.Errorf("unable to create version bucket: %v", err)
+		}
+
+		if err = meta.Put(versionName, versionValue); err != nil {
+			return err
+		}
+
+		if _, err = tx.CreateBucket(bucketUsers); err != nil {
+			return fmt.Errorf("unable to create users bucket: %v", err)
+		}
+		return nil
+	}},
+	{migration{2, "secondary indexes of filtered queries"}, func(t *boltDao, tx *bolt.Tx) error {
+		return buildMissingBoltIndexes(t.codec, tx, bucketIdxName, bucketIdxCreated, bucketIdxRole, bucketIdxProvider)
+	}},
+	{migration{3, "oauth account index"}, func(t *boltDao, tx *bolt.Tx) error {
+		return buildMissingBoltIndexes(t.codec, tx, bucketIdxAccount)
+	}},
+	{migration{4, "codec metadata"}, func(t *boltDao, tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(codecName, []byte(t.codec.Name()))
+	}},
+	{migration{5, "change feed"}, func(t *boltDao, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketChanges)
+		return err
+	}},
+}
+
+// NewBoltDao creates Bolt DB-based DAO, that keeps user profiles encoded with gob
 func NewBoltDao(dbPath string) (Dao, error) {
+	return NewBoltDaoWithCodec(dbPath, gobCodec{})
+}
+
+// NewBoltDaoWithCodec creates Bolt DB-based DAO, that keeps user profiles encoded with the given codec
+func NewBoltDaoWithCodec(dbPath string, codec Codec) (Dao, error) {
+	return NewBoltDaoWithOptions(dbPath, codec, &BoltOptions{})
+}
+
+// NewBoltDaoWithOptions creates Bolt DB-based DAO with the given settings, that keeps user profiles encoded with
+// the given codec
+func NewBoltDaoWithOptions(dbPath string, codec Codec, options *BoltOptions) (Dao, error) {
 	var err error
-	var result boltDao
+	result := boltDao{codec: codec, options: options}
 
-	if result.db, err = bolt.Open(dbPath, 0644, &bolt.Options{Timeout: 2 * time.Second, NoGrowSync: false}); err != nil {
-		return nil, fmt.Errorf("unable to open DB: %v", err)
+	if options.ReadOnly {
+		// bolt creates missing file even if it is opened for reading
+		if _, err := os.Stat(dbPath); err != nil {
+			return nil, fmt.Errorf("unable to open DB: %v", err)
+		}
 	}
 
-	if err = result.db.Update(func(tx *bolt.Tx) error {
-		meta := tx.Bucket(bucketMeta)
-		if meta == nil {
-			log.Printf("perform schema initialization for db=%s", dbPath)
-			if meta, err = tx.CreateBucket(bucketMeta); err != nil {
-				return fmt.Errorf("unable to create version bucket: %v", err)
-			}
+	if result.db, err = bolt.Open(dbPath, 0644, &bolt.Options{
+		Timeout:    2 * time.Second,
+		NoGrowSync: options.NoGrowSync,
+		ReadOnly:   options.ReadOnly,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to open DB: %v", err)
+	}
 
-			if err = meta.Put(versionName, versionValue); err != nil {
-				return err
-			}
+	result.db.NoSync = options.NoSync
+	if options.MaxBatchSize > 0 {
+		result.db.MaxBatchSize = options.MaxBatchSize
+	}
+	if options.MaxBatchDelay > 0 {
+		result.db.MaxBatchDelay = options.MaxBatchDelay
+	}
 
-			if _, err = tx.CreateBucket(bucketUsers); err != nil {
-				return fmt.Errorf("unable to create users bucket: %v", err)
-			}
-		} else {
-			log.Printf("perform schema validation for db=%s", dbPath)
-			actualVersionValue := meta.Get(versionName)
+	initialize := result.db.Update
+	if options.ReadOnly {
+		initialize = result.db.View
+	}
 
-			if actualVersionValue == nil || !bytes.Equal(versionValue, actualVersionValue) {
-				return fmt.Errorf("version mismatch, expected: %s, actual: %s", versionValue, actualVersionValue)
+	if err = initialize(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(bucketMeta); meta != nil {
+			if err := checkStoredCodec(meta.Get(codecName), codec); err != nil {
+				return err
 			}
 		}
 
-		return nil
+		if options.ReadOnly {
+			version, err := readBoltSchemaVersion(tx)
+			result.schemaVersion = version
+			return err
+		}
+		return result.migrate(tx, dbPath)
 	}); err != nil {
+		result.db.Close()
 		return nil, fmt.Errorf("unable to perform initialization: %v", err)
 	}
 
@@ -73,32 +212,127 @@ func (t *boltDao) Close() error {
 	return t.db.Close()
 }
 
-func (t *boltDao) Add(profiles []*UserProfile) error {
-	return t.db.Update(func(tx *bolt.Tx) error {
+func (t *boltDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	// batched function might be retried alone once the shared transaction fails, which is safe as the failed
+	// transaction leaves nothing behind
+	update := t.db.Update
+	if t.options.Batch {
+		update = t.db.Batch
+	}
+
+	if err := update(func(tx *bolt.Tx) error {
+		t.setFillPercent(tx)
+
 		users := tx.Bucket(bucketUsers)
 		if users == nil {
 			return fmt.Errorf("unable to add profiles slice: users bucket is missing; data corrupted?")
 		}
 
 		for _, p := range profiles {
-			var valueBuf bytes.Buffer
-			encoder := gob.NewEncoder(&valueBuf)
-			if err := encoder.Encode(p); err != nil {
-				return fmt.Errorf("unable to encode profile=%s, error: %v", p, err)
+			// write transaction might have waited for the other writers and large slices take a while to write,
+			// so deadline is checked before every profile
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if users.Get(getBytesFromID(p.ID)) != nil {
+				return fmt.Errorf("unable to add profile=%s: %w", p, ErrAlreadyExists)
+			}
+
+			if err := putBoltProfile(t.codec, tx, users, p); err != nil {
+				return fmt.Errorf("unable to add profile=%s, error: %w", p, err)
 			}
 
-			if err := users.Put(getBytesFromID(p.ID), valueBuf.Bytes()); err != nil {
-				return fmt.Errorf("unable to add profile=%s, error: %v", p, err)
+			if err := putBoltChange(tx, newChange(ChangeAdd, p)); err != nil {
+				return err
 			}
 		}
 
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
+}
+
+func (t *boltDao) Update(ctx context.Context, profile *UserProfile) error {
+	if err := t.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.setFillPercent(tx)
+
+		users := tx.Bucket(bucketUsers)
+		if users == nil {
+			return fmt.Errorf("unable to update profile: users bucket is missing; data corrupted?")
+		}
+
+		v := users.Get(getBytesFromID(profile.ID))
+		if v == nil {
+			return fmt.Errorf("unable to update profile with id=%d: %w", profile.ID, ErrNotFound)
+		}
+
+		if err := deleteBoltIndexEntries(t.codec, tx, profile.ID, v); err != nil {
+			return err
+		}
+
+		if err := putBoltProfile(t.codec, tx, users, profile); err != nil {
+			return fmt.Errorf("unable to update profile=%s, error: %w", profile, err)
+		}
+
+		return putBoltChange(tx, newChange(ChangeUpdate, profile))
+	}); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
+}
+
+func (t *boltDao) Delete(ctx context.Context, id int) error {
+	if err := t.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.setFillPercent(tx)
+
+		users := tx.Bucket(bucketUsers)
+		if users == nil {
+			return fmt.Errorf("unable to delete profile: users bucket is missing; data corrupted?")
+		}
+
+		key := getBytesFromID(id)
+		v := users.Get(key)
+		if v == nil {
+			return fmt.Errorf("unable to delete profile with id=%d: %w", id, ErrNotFound)
+		}
+
+		if err := deleteBoltIndexEntries(t.codec, tx, id, v); err != nil {
+			return err
+		}
+
+		if err := users.Delete(key); err != nil {
+			return err
+		}
+
+		return putBoltChange(tx, newDeleteChange(id))
+	}); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
 }
 
-func (t *boltDao) Get(id int) (*UserProfile, error) {
+func (t *boltDao) Get(ctx context.Context, id int) (*UserProfile, error) {
 	var profile *UserProfile
 	if err := t.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		users := tx.Bucket(bucketUsers)
 		if users == nil {
 			return fmt.Errorf("unable to query users: users bucket is missing; data corrupted?")
@@ -106,44 +340,45 @@ func (t *boltDao) Get(id int) (*UserProfile, error) {
 
 		v := users.Get(getBytesFromID(id))
 		if v == nil {
-			return fmt.Errorf("unable to get user with id=%d", id)
+			return ErrNotFound
 		}
 
-		decoder := gob.NewDecoder(bytes.NewBuffer(v))
-		var p UserProfile
-		if err := decoder.Decode(&p); err != nil {
+		p, err := t.codec.Decode(v)
+		if err != nil {
 			return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
 		}
 
-		profile = &p
+		profile = p
 
 		return nil
 
 	}); err != nil {
-		return nil, fmt.Errorf("unable to get user {id: %d}: %v", id, err)
+		return nil, fmt.Errorf("unable to get user {id: %d}: %w", id, err)
 	}
 
 	return profile, nil
 }
 
-func (t *boltDao) GetIDRange() (from int, to int, err error) {
+func (t *boltDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
 	var min int
 	var max int
 	if err := t.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		users := tx.Bucket(bucketUsers)
 		if users == nil {
 			return fmt.Errorf("unable to query users: users bucket is missing; data corrupted?")
 		}
 
+		// keys are big-endian IDs, so the first and the last keys are the smallest and the largest IDs
 		cur := users.Cursor()
-		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
-			key := int(binary.BigEndian.Uint32(k))
-			if key < min || min == 0 {
-				min = key
-			}
-			if key > max {
-				max = key
-			}
+		if k, _ := cur.First(); k != nil {
+			min = int(binary.BigEndian.Uint32(k))
+		}
+		if k, _ := cur.Last(); k != nil {
+			max = int(binary.BigEndian.Uint32(k))
 		}
 
 		return nil
@@ -155,68 +390,592 @@ func (t *boltDao) GetIDRange() (from int, to int, err error) {
 	return min, max, nil
 }
 
-func (t *boltDao) QueryUsers(offsetToken string, limit int) (*UserPage, error) {
+func (t *boltDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	var profile *UserProfile
+	if err := t.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		users := tx.Bucket(bucketUsers)
+		accounts := tx.Bucket(bucketIdxAccount)
+		if users == nil || accounts == nil {
+			return fmt.Errorf("users or oauth account index bucket is missing; data corrupted?")
+		}
+
+		idBytes := accounts.Get(accountKey(provider, token))
+		if idBytes == nil {
+			return ErrNotFound
+		}
+
+		v := users.Get(idBytes)
+		if v == nil {
+			return fmt.Errorf("index=%s refers to missing user with id=%d; data corrupted?", bucketIdxAccount, binary.BigEndian.Uint32(idBytes))
+		}
+
+		p, err := t.codec.Decode(v)
+		if err != nil {
+			return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", binary.BigEndian.Uint32(idBytes), err)
+		}
+
+		profile = p
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %w", provider, token, err)
+	}
+
+	return profile, nil
+}
+
+func (t *boltDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
 	var result UserPage
+	if err := checkPageLimit(limit); err != nil {
+		return nil, err
+	}
+
+	var cursor []byte
+	if len(offsetToken) > 0 {
+		var err error
+		if cursor, err = decodeOffsetToken(boltBackendTag, query, offsetToken); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := getBoltQueryPlan(query, cursor)
 
 	if err := t.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		users := tx.Bucket(bucketUsers)
 		if users == nil {
 			return fmt.Errorf("unable to query users: users bucket is missing; data corrupted?")
 		}
 
-		var k, v []byte
+		bucket := tx.Bucket(plan.bucket)
+		if bucket == nil {
+			return fmt.Errorf("unable to query users: %s bucket is missing; data corrupted?", plan.bucket)
+		}
 
-		cur := users.Cursor()
-		if len(offsetToken) > 0 {
-			keyBytes, err := hex.DecodeString(offsetToken)
+		cur := bucket.Cursor()
+		for k, v := cur.Seek(plan.start); k != nil && plan.within(k); k, v = cur.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			id := int(binary.BigEndian.Uint32(k[len(k)-4:]))
+			if !bytes.Equal(plan.bucket, bucketUsers) {
+				// index entry, profile has to be fetched from the users bucket
+				if v = users.Get(k[len(k)-4:]); v == nil {
+					return fmt.Errorf("index=%s refers to missing user with id=%d; data corrupted?", plan.bucket, id)
+				}
+			}
+
+			p, err := t.codec.Decode(v)
 			if err != nil {
-				return fmt.Errorf("corrupted offset token: %v", err)
+				return fmt.Errorf("unable to decode user profile value: id=%d, offsetToken=%s, error=%v", id, offsetToken, err)
+			}
+
+			if !query.Matches(p) {
+				continue
 			}
-			k, v = cur.Seek(keyBytes)
-		} else {
-			k, v = cur.First()
-		}
 
-		size := 0
-		for {
-			if k == nil {
+			if len(result.Profiles) >= limit {
+				result.OffsetToken = encodeOffsetToken(boltBackendTag, query, cursorKey(queryOrder(query), p))
 				break
 			}
 
-			decoder := gob.NewDecoder(bytes.NewBuffer(v))
-			var p UserProfile
-			if err := decoder.Decode(&p); err != nil {
-				return fmt.Errorf("unable to decode user profile value: offset=%d, offsetToken=%s, error=%v", size, offsetToken, err)
+			result.Profiles = append(result.Profiles, p)
+		}
+
+		return nil
+
+	}); err != nil {
+		return nil, fmt.Errorf("unable to query users: %v", err)
+	}
+
+	return &result, nil
+}
+
+// RebuildIndexes drops all secondary indexes and builds them again out of the stored users
+func (t *boltDao) RebuildIndexes() error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		for _, index := range boltIndexes {
+			if err := tx.DeleteBucket(index.bucket); err != nil && err != bolt.ErrBucketNotFound {
+				return fmt.Errorf("unable to drop index=%s: %v", index.bucket, err)
 			}
 
-			result.Profiles = append(result.Profiles, &p)
+			if err := buildBoltIndex(t.codec, tx, index); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-			k, v = cur.Next()
+// VerifyIndexes checks that every secondary index has exactly the entries of the stored users
+func (t *boltDao) VerifyIndexes() error {
+	return t.db.View(func(tx *bolt.Tx) error {
+		problems := []string{}
+		for _, index := range boltIndexes {
+			if err := verifyBoltIndex(t.codec, tx, index); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
 
-			size++
-			if size >= limit {
-				if k != nil {
-					result.OffsetToken = hex.EncodeToString(k)
-				}
+		if len(problems) > 0 {
+			return fmt.Errorf("index verification failed: %s", strings.Join(problems, "; "))
+		}
+		return nil
+	})
+}
+
+func (t *boltDao) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	err := t.db.View(func(tx *bolt.Tx) error {
+		// page consistency check walks the whole file, so it can not be cancelled
+		for err := range tx.Check() {
+			report.add(StorageCheck, "%v", err)
+		}
+
+		if !report.verifySchemaVersion(t.schemaVersion, boltMigrations[len(boltMigrations)-1].version) {
+			return nil
+		}
+
+		for _, name := range [][]byte{bucketMeta, bucketUsers, bucketChanges} {
+			if tx.Bucket(name) == nil {
+				report.add(StorageCheck, "bucket=%s is missing", name)
+			}
+		}
+		users := tx.Bucket(bucketUsers)
+		if users == nil {
+			return nil
+		}
+
+		decoded := true
+		c := users.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			id := int(binary.BigEndian.Uint32(k))
+			if p, err := t.codec.Decode(v); err != nil {
+				report.add(ValueCheck, "user id=%d can not be decoded with codec=%s: %v", id, t.codec.Name(), err)
+				decoded = false
+			} else {
+				report.verifyProfile(id, p)
+			}
+		}
+
+		for _, index := range boltIndexes {
+			if !decoded {
+				// indexes are checked against decoded users, so damaged users would be reported twice
 				break
 			}
+			if err := verifyBoltIndex(t.codec, tx, index); err != nil {
+				report.add(IndexCheck, "%v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (t *boltDao) ReadChanges(ctx context.Context, fromSeq uint64, limit int) ([]*Change, error) {
+	result := []*Change{}
+	if err := t.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
+		changes := tx.Bucket(bucketChanges)
+		if changes == nil {
+			return fmt.Errorf("changes bucket is missing; data corrupted?")
+		}
+
+		c := changes.Cursor()
+		for k, v := c.Seek(getBytesFromSeq(fromSeq)); k != nil && len(result) < limit; k, v = c.Next() {
+			change, err := decodeChangeValue(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			result = append(result, change)
+		}
 		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read changes: %v", err)
+	}
 
+	return result, nil
+}
+
+func (t *boltDao) LastChangeSeq(ctx context.Context) (uint64, error) {
+	var seq uint64
+	if err := t.db.View(func(tx *bolt.Tx) error {
+		changes := tx.Bucket(bucketChanges)
+		if changes == nil {
+			return fmt.Errorf("changes bucket is missing; data corrupted?")
+		}
+
+		if k, _ := changes.Cursor().Last(); k != nil {
+			seq = binary.BigEndian.Uint64(k)
+		}
+		return nil
 	}); err != nil {
-		return nil, fmt.Errorf("unable to query users: %v", err)
+		return 0, fmt.Errorf("unable to get last change: %v", err)
 	}
 
-	return &result, nil
+	return seq, nil
+}
+
+func (t *boltDao) Subscribe(ctx context.Context, fromSeq uint64, fn func(c *Change) error) error {
+	return t.changes.subscribe(ctx, t.ReadChanges, fromSeq, fn)
 }
 
 //
 // Private
 //
 
+// setFillPercent applies fill percent to the buckets of users and indexes, writable transaction keeps the
+// buckets it has opened, so that the setting holds until commit
+func (t *boltDao) setFillPercent(tx *bolt.Tx) {
+	if t.options.FillPercent <= 0 {
+		return
+	}
+
+	buckets := [][]byte{bucketUsers}
+	for _, index := range boltIndexes {
+		buckets = append(buckets, index.bucket)
+	}
+	for _, name := range buckets {
+		if b := tx.Bucket(name); b != nil {
+			b.FillPercent = t.options.FillPercent
+		}
+	}
+}
+
+// migrate applies pending migrations within the given transaction
+func (t *boltDao) migrate(tx *bolt.Tx, dbPath string) error {
+	version, err := readBoltSchemaVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	initialVersion := version
+	for _, m := range boltMigrations {
+		if m.version <= version {
+			continue
+		}
+
+		logMigration(dbPath, m.migration)
+		if err := m.apply(t, tx); err != nil {
+			return fmt.Errorf("unable to apply migration %s: %v", m, err)
+		}
+		version = m.version
+	}
+
+	// indexes are derived from users, so that the ones lost by a database of the current version are built again
+	// rather than failing the queries
+	for _, index := range boltIndexes {
+		if tx.Bucket(index.bucket) != nil {
+			continue
+		}
+		log.Printf("build missing index=%s of db=%s", index.bucket, dbPath)
+		if err := buildBoltIndex(t.codec, tx, index); err != nil {
+			return err
+		}
+	}
+
+	t.schemaVersion = version
+	if version == initialVersion {
+		return nil
+	}
+	return tx.Bucket(bucketMeta).Put(schemaVersionName, encodeSchemaVersion(version))
+}
+
+// readBoltSchemaVersion returns schema version of the DB without applying pending migrations
+func readBoltSchemaVersion(tx *bolt.Tx) (int, error) {
+	version, err := getBoltSchemaVersion(tx)
+	if err != nil {
+		return 0, err
+	}
+	return version, checkSchemaVersion(version, boltMigrations[len(boltMigrations)-1].version)
+}
+
+func getBoltSchemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(bucketMeta)
+	if meta == nil {
+		return 0, nil // fresh DB
+	}
+
+	if v := meta.Get(schemaVersionName); v != nil {
+		return decodeSchemaVersion(v)
+	}
+
+	// databases created before migrations were introduced are only told apart by the version string
+	if actualVersionValue := meta.Get(versionName); !bytes.Equal(versionValue, actualVersionValue) {
+		return 0, fmt.Errorf("version mismatch, expected: %s, actual: %s", versionValue, actualVersionValue)
+	}
+	return legacySchemaVersion, nil
+}
+
+// putBoltChange appends change to the feed within the given transaction, sequence numbers only grow, so that
+// pages of the feed are filled completely
+func putBoltChange(tx *bolt.Tx, c *Change) error {
+	changes := tx.Bucket(bucketChanges)
+	if changes == nil {
+		return fmt.Errorf("unable to record change: changes bucket is missing; data corrupted?")
+	}
+	changes.FillPercent = 1.0
+
+	seq, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	value, err := encodeChangeValue(c)
+	if err != nil {
+		return fmt.Errorf("unable to encode change of user id=%d: %v", c.ID, err)
+	}
+	return changes.Put(getBytesFromSeq(seq), value)
+}
+
+func getBytesFromSeq(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
 func getBytesFromID(id int) []byte {
 	key := make([]byte, 4)
 	binary.BigEndian.PutUint32(key, uint32(id))
 	return key
 }
+
+// boltQueryPlan defines keys of the bucket that are scanned in order to find users matching the query,
+// every scanned user is checked against the query anyway, so plan only narrows down the scan
+type boltQueryPlan struct {
+	bucket []byte
+	start  []byte
+	prefix []byte // every scanned key should start with prefix
+	end    []byte // every scanned key should be less than end, unless it is nil
+}
+
+func (p *boltQueryPlan) within(key []byte) bool {
+	return bytes.HasPrefix(key, p.prefix) && (p.end == nil || bytes.Compare(key, p.end) < 0)
+}
+
+func getBoltQueryPlan(query *UserQuery, cursor []byte) *boltQueryPlan {
+	result := &boltQueryPlan{bucket: bucketUsers}
+	if query == nil {
+		query = &UserQuery{}
+	}
+
+	switch query.Order {
+	case OrderByName:
+		result.bucket = bucketIdxName
+		result.prefix = []byte(query.NamePrefix)
+		result.start = result.prefix
+	case OrderByCreated:
+		result.bucket = bucketIdxCreated
+		if !query.CreatedFrom.IsZero() {
+			result.start = createdKey(query.CreatedFrom)
+		}
+		if !query.CreatedTo.IsZero() {
+			result.end = createdKey(query.CreatedTo)
+		}
+	default:
+		// users are sorted by ID within role and provider indexes as well as in the users bucket
+		if len(query.Role) > 0 {
+			result.bucket = bucketIdxRole
+			result.prefix = append([]byte(query.Role), 0)
+		} else if len(query.Provider) > 0 {
+			result.bucket = bucketIdxProvider
+			result.prefix = append([]byte(query.Provider), 0)
+		}
+		result.start = result.prefix
+	}
+
+	// cursor key is a key of the index being scanned, save for the prefix of role and provider indexes
+	if cursor != nil {
+		start := append(append([]byte{}, result.prefix...), cursor...)
+		if query.Order != OrderByID {
+			start = cursor
+		}
+		if bytes.Compare(start, result.start) > 0 {
+			result.start = start
+		}
+	}
+
+	if result.start == nil {
+		result.start = []byte{}
+	}
+
+	return result
+}
+
+func putBoltProfile(codec Codec, tx *bolt.Tx, users *bolt.Bucket, p *UserProfile) error {
+	value, err := codec.Encode(p)
+	if err != nil {
+		return fmt.Errorf("unable to encode profile: %v", err)
+	}
+
+	if err := users.Put(getBytesFromID(p.ID), value); err != nil {
+		return err
+	}
+
+	for _, index := range boltIndexes {
+		bucket := tx.Bucket(index.bucket)
+		if bucket == nil {
+			return fmt.Errorf("index bucket=%s is missing; data corrupted?", index.bucket)
+		}
+
+		if err := putBoltIndexEntries(bucket, index, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func putBoltIndexEntries(bucket *bolt.Bucket, index *boltIndex, p *UserProfile) error {
+	value := index.value(p.ID)
+	for _, key := range index.keys(p) {
+		// oauth accounts have the only unique index
+		if index.unique {
+			if v := bucket.Get(key); v != nil && !bytes.Equal(v, value) {
+				return fmt.Errorf("unable to update index=%s: key=%q is already taken by user with id=%d: %w",
+					index.bucket, key, binary.BigEndian.Uint32(v), ErrAccountTaken)
+			}
+		}
+
+		if err := bucket.Put(key, value); err != nil {
+			return fmt.Errorf("unable to update index=%s: %v", index.bucket, err)
+		}
+	}
+	return nil
+}
+
+// value returns value of every index entry of the user with the given ID
+func (t *boltIndex) value(id int) []byte {
+	if t.unique {
+		return getBytesFromID(id)
+	}
+	return []byte{}
+}
+
+// deleteBoltIndexEntries removes index entries of the profile stored in the given value
+func deleteBoltIndexEntries(codec Codec, tx *bolt.Tx, id int, v []byte) error {
+	p, err := codec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
+	}
+
+	for _, index := range boltIndexes {
+		bucket := tx.Bucket(index.bucket)
+		if bucket == nil {
+			return fmt.Errorf("index bucket=%s is missing; data corrupted?", index.bucket)
+		}
+
+		for _, key := range index.keys(p) {
+			if index.unique && !bytes.Equal(bucket.Get(key), index.value(id)) {
+				continue // entry belongs to another user
+			}
+			if err := bucket.Delete(key); err != nil {
+				return fmt.Errorf("unable to update index=%s: %v", index.bucket, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildMissingBoltIndexes builds indexes of the given buckets, unless they already exist
+func buildMissingBoltIndexes(codec Codec, tx *bolt.Tx, buckets ...[]byte) error {
+	for _, index := range boltIndexes {
+		for _, bucket := range buckets {
+			if !bytes.Equal(index.bucket, bucket) || tx.Bucket(bucket) != nil {
+				continue
+			}
+
+			if err := buildBoltIndex(codec, tx, index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildBoltIndex creates index bucket and fills it with entries of all the existing users
+func buildBoltIndex(codec Codec, tx *bolt.Tx, index *boltIndex) error {
+	users := tx.Bucket(bucketUsers)
+	if users == nil {
+		return fmt.Errorf("unable to build index=%s: users bucket is missing; data corrupted?", index.bucket)
+	}
+
+	bucket, err := tx.CreateBucket(index.bucket)
+	if err != nil {
+		return fmt.Errorf("unable to create index bucket=%s: %v", index.bucket, err)
+	}
+
+	return users.ForEach(func(k, v []byte) error {
+		p, err := codec.Decode(v)
+		if err != nil {
+			return fmt.Errorf("unable to decode user profile value: key=%x, error=%v", k, err)
+		}
+
+		return putBoltIndexEntries(bucket, index, p)
+	})
+}
+
+// verifyBoltIndex compares entries of the index bucket with the entries expected for all the existing users
+func verifyBoltIndex(codec Codec, tx *bolt.Tx, index *boltIndex) error {
+	users := tx.Bucket(bucketUsers)
+	if users == nil {
+		return fmt.Errorf("unable to verify index=%s: users bucket is missing; data corrupted?", index.bucket)
+	}
+
+	bucket := tx.Bucket(index.bucket)
+	if bucket == nil {
+		return fmt.Errorf("index bucket=%s is missing", index.bucket)
+	}
+
+	expected := map[string][]byte{}
+	if err := users.ForEach(func(k, v []byte) error {
+		p, err := codec.Decode(v)
+		if err != nil {
+			return fmt.Errorf("unable to decode user profile value: key=%x, error=%v", k, err)
+		}
+
+		for _, key := range index.keys(p) {
+			expected[string(key)] = index.value(p.ID)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	stale := 0
+	if err := bucket.ForEach(func(k, v []byte) error {
+		if value, ok := expected[string(k)]; ok && bytes.Equal(value, v) {
+			delete(expected, string(k))
+		} else {
+			stale++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if stale > 0 || len(expected) > 0 {
+		return fmt.Errorf("index=%s has %d stale and %d missing entries", index.bucket, stale, len(expected))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltIndexes(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+	newProfiles := func() []*UserProfile {
+		return []*UserProfile{
+			{ID: 1, Name: "Alice", Created: created, Roles: []string{"ADMIN"},
+				Accounts: []*OauthAccount{{Provider: "Google", Token: "t1", Created: created}}},
+			{ID: 2, Name: "Bob", Created: created.Add(time.Hour), Roles: []string{"READER", "EDITOR"},
+				Accounts: []*OauthAccount{{Provider: "VK", Token: "t2", Created: created}}},
+		}
+	}
+
+	openDao := func(t *testing.T) (*boltDao, string) {
+		path := filepath.Join(t.TempDir(), "bolt.db")
+		dao, err := NewBoltDao(path)
+		require.Nil(t, err)
+		require.Nil(t, dao.Add(ctx, newProfiles()))
+		return dao.(*boltDao), path
+	}
+
+	t.Run("verify consistent indexes", func(t *testing.T) {
+		dao, _ := openDao(t)
+		defer dao.Close()
+
+		updated := newProfiles()[1]
+		updated.Roles = []string{"MODERATOR"}
+		updated.Accounts = nil
+		require.Nil(t, dao.Update(ctx, updated))
+		require.Nil(t, dao.Delete(ctx, 1))
+
+		assert.Nil(t, dao.VerifyIndexes())
+	})
+
+	t.Run("verify and rebuild corrupted indexes", func(t *testing.T) {
+		dao, _ := openDao(t)
+		defer dao.Close()
+
+		require.Nil(t, dao.db.Update(func(tx *bolt.Tx) error {
+			roles := tx.Bucket(bucketIdxRole)
+			if err := roles.Delete(stringKey("ADMIN", 1)); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketIdxAccount).Put(accountKey("VK", "t3"), getBytesFromID(2))
+		}))
+
+		assert.EqualError(t, dao.VerifyIndexes(), "index verification failed: "+
+			"index=idx_role has 0 stale and 1 missing entries; index=idx_account has 1 stale and 0 missing entries")
+
+		require.Nil(t, dao.RebuildIndexes())
+		assert.Nil(t, dao.VerifyIndexes())
+	})
+
+	t.Run("missing indexes are built on open", func(t *testing.T) {
+		dao, path := openDao(t)
+		require.Nil(t, dao.db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket(bucketIdxName)
+		}))
+		require.Nil(t, dao.Close())
+
+		reopened, err := NewBoltDao(path)
+		require.Nil(t, err)
+		defer reopened.Close()
+
+		assert.Nil(t, reopened.(*boltDao).VerifyIndexes())
+		page, err := reopened.QueryUsers(ctx, &UserQuery{Order: OrderByName, NamePrefix: "B"}, "", 10)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(page.Profiles))
+		assert.Equal(t, 2, page.Profiles[0].ID)
+	})
+
+	t.Run("oauth account belongs to a single user", func(t *testing.T) {
+		dao, _ := openDao(t)
+		defer dao.Close()
+
+		duplicate := newProfiles()[0]
+		duplicate.ID = 3
+		assert.NotNil(t, dao.Add(ctx, []*UserProfile{duplicate}))
+
+		_, err := dao.Get(ctx, 3)
+		assert.NotNil(t, err, "failed add should be rolled back")
+		assert.Nil(t, dao.VerifyIndexes())
+	})
+}
+
+func TestBoltOptions(t *testing.T) {
+	ctx := context.Background()
+	openDao := func(t *testing.T, options *BoltOptions) *boltDao {
+		dao, err := NewBoltDaoWithOptions(filepath.Join(t.TempDir(), "bolt.db"), gobCodec{}, options)
+		require.Nil(t, err)
+		return dao.(*boltDao)
+	}
+	newProfile := func(id int, token string) *UserProfile {
+		return &UserProfile{ID: id, Name: fmt.Sprintf("User %d", id), Roles: []string{"READER"},
+			Accounts: []*OauthAccount{{Provider: "VK", Token: token}}}
+	}
+
+	t.Run("options are applied to database", func(t *testing.T) {
+		dao := openDao(t, &BoltOptions{NoSync: true, NoGrowSync: true, MaxBatchSize: 10, MaxBatchDelay: time.Second})
+		defer dao.Close()
+
+		assert.True(t, dao.db.NoSync)
+		assert.True(t, dao.db.NoGrowSync)
+		assert.Equal(t, 10, dao.db.MaxBatchSize)
+		assert.Equal(t, time.Second, dao.db.MaxBatchDelay)
+	})
+
+	t.Run("concurrent adds in batch mode", func(t *testing.T) {
+		dao := openDao(t, &BoltOptions{Batch: true, FillPercent: 1.0, MaxBatchDelay: 50 * time.Millisecond})
+		defer dao.Close()
+		require.Nil(t, dao.Add(ctx, []*UserProfile{newProfile(1, "t1")}))
+
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// the last writer reuses oauth account of the first profile, which fails only its own add
+				token := fmt.Sprintf("t%d", i+2)
+				if i == len(errs)-1 {
+					token = "t1"
+				}
+				errs[i] = dao.Add(ctx, []*UserProfile{newProfile(i+2, token)})
+			}(i)
+		}
+		wg.Wait()
+
+		for i, err := range errs[:len(errs)-1] {
+			assert.Nil(t, err, "add #%d", i)
+		}
+		assert.NotNil(t, errs[len(errs)-1])
+
+		_, to, err := dao.GetIDRange(ctx)
+		require.Nil(t, err)
+		assert.Equal(t, 10, to)
+		assert.Nil(t, dao.VerifyIndexes())
+	})
+}
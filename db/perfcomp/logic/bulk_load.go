@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// BulkLoadOptions defines how profiles are grouped into batches by BulkLoad
+type BulkLoadOptions struct {
+	// BatchSize is a maximum number of profiles added by a single Dao.Add call, i.e. in one transaction
+	BatchSize int
+
+	// CommitInterval is a maximum time a partial batch waits for more profiles, zero means that batches are only
+	// added once they are full or the stream ends
+	CommitInterval time.Duration
+
+	// ResumeAfter is the last ID committed by the previous load, profiles up to it are skipped
+	ResumeAfter int
+
+	// Progress, if set, is called after a batch is added at most once per ProgressInterval and once the load ends
+	Progress         func(progress *BulkLoadProgress)
+	ProgressInterval time.Duration
+}
+
+// BulkLoadProgress describes state of the load
+type BulkLoadProgress struct {
+	Loaded  int // number of added profiles
+	Skipped int // number of profiles skipped as committed by the previous load
+	Batches int
+	LastID  int // ID of the last added profile
+	Elapsed time.Duration
+}
+
+func (p *BulkLoadProgress) String() string {
+	return fmt.Sprintf(
+		"{loaded: %d, skipped: %d, batches: %d, lastID: %d, elapsed: %s}",
+		p.Loaded,
+		p.Skipped,
+		p.Batches,
+		p.LastID,
+		p.Elapsed,
+	)
+}
+
+// BulkLoad adds profiles received from the given channel until it is closed, profiles are expected to come in
+// ascending order of IDs, so that once the load is interrupted every ID up to the largest stored one is committed
+// and the load can be resumed after that ID
+func BulkLoad(ctx context.Context, dao Dao, profiles <-chan *UserProfile, options *BulkLoadOptions) (*BulkLoadProgress, error) {
+	if options.BatchSize <= 0 {
+		return nil, fmt.Errorf("batch size should be positive, actual: %d", options.BatchSize)
+	}
+
+	l := &bulkLoader{
+		dao:      dao,
+		options:  options,
+		started:  time.Now(),
+		progress: &BulkLoadProgress{LastID: options.ResumeAfter},
+	}
+
+	// timer fires once a partial batch has waited for CommitInterval, it is only armed while batch is not empty
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return l.progress, ctx.Err()
+
+		case p, ok := <-profiles:
+			if !ok {
+				err := l.flush(ctx)
+				l.report(true)
+				return l.progress, err
+			}
+
+			if p.ID <= options.ResumeAfter {
+				l.progress.Skipped++
+				continue
+			}
+
+			if len(l.batch) == 0 && options.CommitInterval > 0 {
+				timer.Reset(options.CommitInterval)
+			}
+
+			l.batch = append(l.batch, p)
+			if len(l.batch) < options.BatchSize {
+				continue
+			}
+
+			timer.Stop()
+			if err := l.flush(ctx); err != nil {
+				return l.progress, err
+			}
+
+		case <-timer.C:
+			if err := l.flush(ctx); err != nil {
+				return l.progress, err
+			}
+		}
+	}
+}
+
+//
+// Private
+//
+
+type bulkLoader struct {
+	dao      Dao
+	options  *BulkLoadOptions
+	started  time.Time
+	reported time.Time
+	batch    []*UserProfile
+	progress *BulkLoadProgress
+}
+
+func (t *bulkLoader) flush(ctx context.Context) error {
+	if len(t.batch) == 0 {
+		return nil
+	}
+
+	if err := t.dao.Add(ctx, t.batch); err != nil {
+		return fmt.Errorf("unable to add batch of %d profiles after id=%d: %v", len(t.batch), t.progress.LastID, err)
+	}
+
+	t.progress.Loaded += len(t.batch)
+	t.progress.Batches++
+	t.progress.LastID = t.batch[len(t.batch)-1].ID
+	t.batch = nil
+	t.report(false)
+	return nil
+}
+
+func (t *bulkLoader) report(last bool) {
+	t.progress.Elapsed = time.Since(t.started)
+	if t.options.Progress == nil || (!last && time.Since(t.reported) < t.options.ProgressInterval) {
+		return
+	}
+
+	t.reported = time.Now()
+	t.options.Progress(t.progress)
+}
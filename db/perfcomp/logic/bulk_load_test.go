@@ -0,0 +1,125 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkLoad(t *testing.T) {
+	ctx := context.Background()
+	newProfile := func(id int) *UserProfile {
+		return &UserProfile{ID: id, Name: fmt.Sprintf("User %d", id), Roles: []string{"READER"},
+			Accounts: []*OauthAccount{{Provider: "VK", Token: fmt.Sprintf("t%d", id)}}}
+	}
+	stream := func(ids ...int) <-chan *UserProfile {
+		result := make(chan *UserProfile, len(ids))
+		for _, id := range ids {
+			result <- newProfile(id)
+		}
+		close(result)
+		return result
+	}
+
+	t.Run("profiles are added in batches", func(t *testing.T) {
+		dao := &batchRecordingDao{Dao: NewMemoryDao()}
+		reports := 0
+		progress, err := BulkLoad(ctx, dao, stream(1, 2, 3, 4, 5, 6, 7), &BulkLoadOptions{
+			BatchSize: 3,
+			Progress:  func(p *BulkLoadProgress) { reports++ },
+		})
+		require.Nil(t, err)
+
+		assert.Equal(t, []int{3, 3, 1}, dao.batchSizes)
+		assert.Equal(t, 7, progress.Loaded)
+		assert.Equal(t, 3, progress.Batches)
+		assert.Equal(t, 7, progress.LastID)
+		assert.Equal(t, 4, reports, "progress should be reported after every batch and once the load ends")
+
+		from, to, err := dao.GetIDRange(ctx)
+		require.Nil(t, err)
+		assert.Equal(t, 1, from)
+		assert.Equal(t, 7, to)
+	})
+
+	t.Run("partial batch is added after commit interval", func(t *testing.T) {
+		dao := NewMemoryDao()
+		profiles := make(chan *UserProfile)
+		done := make(chan error)
+		go func() {
+			_, err := BulkLoad(ctx, dao, profiles, &BulkLoadOptions{BatchSize: 100, CommitInterval: 10 * time.Millisecond})
+			done <- err
+		}()
+
+		profiles <- newProfile(1)
+		profiles <- newProfile(2)
+		assert.Eventually(t, func() bool {
+			_, err := dao.Get(ctx, 2)
+			return err == nil
+		}, time.Second, 5*time.Millisecond, "partial batch should be added while the stream is open")
+
+		close(profiles)
+		assert.Nil(t, <-done)
+	})
+
+	t.Run("load is resumed after the last committed ID", func(t *testing.T) {
+		dao := NewMemoryDao()
+		require.Nil(t, dao.Add(ctx, []*UserProfile{newProfile(1), newProfile(2)}))
+
+		_, lastID, err := dao.GetIDRange(ctx)
+		require.Nil(t, err)
+
+		progress, err := BulkLoad(ctx, dao, stream(1, 2, 3, 4), &BulkLoadOptions{BatchSize: 10, ResumeAfter: lastID})
+		require.Nil(t, err)
+		assert.Equal(t, 2, progress.Skipped)
+		assert.Equal(t, 2, progress.Loaded)
+		assert.Equal(t, 4, progress.LastID)
+	})
+
+	t.Run("failed batch stops the load", func(t *testing.T) {
+		dao := NewMemoryDao()
+		duplicate := newProfile(4)
+		duplicate.Accounts = newProfile(1).Accounts
+
+		profiles := make(chan *UserProfile, 5)
+		for _, p := range []*UserProfile{newProfile(1), newProfile(2), newProfile(3), duplicate, newProfile(5)} {
+			profiles <- p
+		}
+		close(profiles)
+
+		progress, err := BulkLoad(ctx, dao, profiles, &BulkLoadOptions{BatchSize: 2})
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "unable to add batch of 2 profiles after id=2")
+		assert.Equal(t, 2, progress.Loaded)
+		assert.Equal(t, 2, progress.LastID)
+	})
+
+	t.Run("cancelled load", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := BulkLoad(ctx, NewMemoryDao(), make(chan *UserProfile), &BulkLoadOptions{BatchSize: 10})
+		assert.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("invalid batch size", func(t *testing.T) {
+		_, err := BulkLoad(ctx, NewMemoryDao(), stream(1), &BulkLoadOptions{})
+		assert.EqualError(t, err, "batch size should be positive, actual: 0")
+	})
+}
+
+// batchRecordingDao records sizes of added batches
+type batchRecordingDao struct {
+	Dao
+
+	batchSizes []int
+}
+
+func (t *batchRecordingDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	t.batchSizes = append(t.batchSizes, len(profiles))
+	return t.Dao.Add(ctx, profiles)
+}
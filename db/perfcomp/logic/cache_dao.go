@@ -0,0 +1,277 @@
+package logic
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+)
+
+type cacheDao struct {
+	Dao
+
+	dao  Dao
+	size int
+
+	lock    sync.Mutex
+	entries map[int]*list.Element // elements of lru keyed by user IDs
+	lru     *list.List            // cached profiles, the most recently used one is at the front
+	loads   map[int]*cacheLoad    // profiles being read from the backend, keyed by user IDs
+	sketch  *frequencySketch      // recent frequencies of requests, nil unless admission is enabled
+	stats   CacheStats
+}
+
+// CacheOptions defines settings of the cache of DAO created by NewCacheDao
+type CacheOptions struct {
+	// Size is the maximum number of cached profiles
+	Size int
+
+	// Admission enables TinyLFU admission policy: once the cache is full, a missed profile is only cached if it has
+	// been requested more often recently than the least recently used profile, which it would evict
+	Admission bool
+}
+
+// CacheStats counts lookups of the cache
+type CacheStats struct {
+	Hits          int64
+	Misses        int64
+	Evictions     int64 // cached profiles evicted to make room for the missed ones
+	Rejections    int64 // missed profiles not admitted to the cache
+	Invalidations int64 // cached profiles dropped because of writes
+}
+
+// HitRatio returns share of lookups served by the cache
+func (s *CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s *CacheStats) String() string {
+	return fmt.Sprintf("hits=%d, misses=%d, hitRatio=%.3f, evictions=%d, rejections=%d, invalidations=%d",
+		s.Hits, s.Misses, s.HitRatio(), s.Evictions, s.Rejections, s.Invalidations)
+}
+
+// CachedDao is implemented by DAOs that cache user profiles
+type CachedDao interface {
+	// CacheStats returns counters accumulated since the DAO has been created
+	CacheStats() *CacheStats
+}
+
+// NewCacheDao creates DAO that keeps profiles returned by Get of the given DAO in LRU cache of a bounded size,
+// profiles are dropped from the cache once they are written through the created DAO, while writes made bypassing
+// it are not noticed; the other methods are forwarded as is
+func NewCacheDao(dao Dao, options *CacheOptions) Dao {
+	result := &cacheDao{
+		dao:     dao,
+		size:    options.Size,
+		entries: map[int]*list.Element{},
+		lru:     list.New(),
+		loads:   map[int]*cacheLoad{},
+	}
+	if options.Admission {
+		result.sketch = newFrequencySketch(options.Size)
+	}
+	return result
+}
+
+func (t *cacheDao) Close() error {
+	return t.dao.Close()
+}
+
+func (t *cacheDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	// failed writes might still have been applied, e.g. if the deadline is exceeded during commit
+	err := t.dao.Add(ctx, profiles)
+	ids := []int{}
+	for _, p := range profiles {
+		ids = append(ids, p.ID)
+	}
+	t.invalidate(ids...)
+	return err
+}
+
+func (t *cacheDao) Update(ctx context.Context, profile *UserProfile) error {
+	err := t.dao.Update(ctx, profile)
+	t.invalidate(profile.ID)
+	return err
+}
+
+func (t *cacheDao) Delete(ctx context.Context, id int) error {
+	err := t.dao.Delete(ctx, id)
+	t.invalidate(id)
+	return err
+}
+
+func (t *cacheDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
+	return t.dao.QueryUsers(ctx, query, offsetToken, limit)
+}
+
+func (t *cacheDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	t.lock.Lock()
+	if t.sketch != nil {
+		t.sketch.increment(id)
+	}
+	if e, ok := t.entries[id]; ok {
+		t.lru.MoveToFront(e)
+		t.stats.Hits++
+		p := copyUserProfile(e.Value.(*UserProfile))
+		t.lock.Unlock()
+		return p, nil
+	}
+	t.stats.Misses++
+	load := t.loads[id]
+	if load == nil {
+		load = &cacheLoad{}
+		t.loads[id] = load
+	}
+	load.readers++
+	t.lock.Unlock()
+
+	p, err := t.dao.Get(ctx, id)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	load.readers--
+	if load.readers == 0 {
+		delete(t.loads, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !load.stale {
+		t.put(p)
+	}
+	return p, nil
+}
+
+func (t *cacheDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	return t.dao.FindByOauthAccount(ctx, provider, token)
+}
+
+func (t *cacheDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	return t.dao.GetIDRange(ctx)
+}
+
+func (t *cacheDao) CacheStats() *CacheStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats := t.stats
+	return &stats
+}
+
+//
+// Private
+//
+
+// cacheLoad tracks concurrent reads of the same missed profile, a write made during the reads makes the profiles
+// they return stale, so that they are not cached
+type cacheLoad struct {
+	readers int
+	stale   bool
+}
+
+// put caches the given profile, evicting the least recently used one if the cache is full
+func (t *cacheDao) put(p *UserProfile) {
+	if e, ok := t.entries[p.ID]; ok {
+		e.Value = copyUserProfile(p)
+		t.lru.MoveToFront(e)
+		return
+	}
+
+	if t.lru.Len() >= t.size {
+		victim := t.lru.Back()
+		if victim == nil {
+			return // zero size
+		}
+		victimID := victim.Value.(*UserProfile).ID
+		if t.sketch != nil && t.sketch.estimate(p.ID) <= t.sketch.estimate(victimID) {
+			t.stats.Rejections++
+			return
+		}
+		t.lru.Remove(victim)
+		delete(t.entries, victimID)
+		t.stats.Evictions++
+	}
+
+	t.entries[p.ID] = t.lru.PushFront(copyUserProfile(p))
+}
+
+// invalidate drops profiles with the given IDs, it is called once the write completes, so that profiles read
+// before the write are either dropped here or not cached at all
+func (t *cacheDao) invalidate(ids ...int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, id := range ids {
+		if e, ok := t.entries[id]; ok {
+			t.lru.Remove(e)
+			delete(t.entries, id)
+			t.stats.Invalidations++
+		}
+		if load, ok := t.loads[id]; ok {
+			load.stale = true
+		}
+	}
+}
+
+// frequencySketch is a count-min sketch of recent request frequencies used by TinyLFU admission, its counters
+// saturate at 15 and are halved once the sketch takes as many increments as ten cache sizes, so that the old
+// requests fade away
+type frequencySketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	increments int
+	resetAt    int
+}
+
+// sketchSeeds make rows of the sketch use independent hashes
+var sketchSeeds = [4]uint64{0x9e3779b97f4a7c15, 0xc2b2ae3d27d4eb4f, 0x165667b19e3779f9, 0x27d4eb2f165667c5}
+
+func newFrequencySketch(size int) *frequencySketch {
+	width := 16
+	for width < size {
+		width <<= 1
+	}
+
+	result := &frequencySketch{mask: uint64(width - 1), resetAt: 10 * size}
+	for i := range result.rows {
+		result.rows[i] = make([]uint8, width)
+	}
+	return result
+}
+
+func (s *frequencySketch) increment(id int) {
+	for i, row := range s.rows {
+		if j := s.index(i, id); row[j] < 15 {
+			row[j]++
+		}
+	}
+
+	s.increments++
+	if s.increments >= s.resetAt {
+		for _, row := range s.rows {
+			for j := range row {
+				row[j] /= 2
+			}
+		}
+		s.increments /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(id int) uint8 {
+	result := uint8(15)
+	for i, row := range s.rows {
+		if v := row[s.index(i, id)]; v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+// index mixes ID with the seed of the row by means of splitmix64 finalizer, as close IDs should not collide
+func (s *frequencySketch) index(row int, id int) uint64 {
+	h := uint64(id) + sketchSeeds[row]
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return (h ^ (h >> 31)) & s.mask
+}
@@ -0,0 +1,166 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheDao(t *testing.T) {
+	ctx := context.Background()
+	newProfile := func(id int) *UserProfile {
+		return &UserProfile{ID: id, Name: fmt.Sprintf("User %d", id), Roles: []string{"READER"}}
+	}
+	newDao := func(t *testing.T, options *CacheOptions, ids ...int) Dao {
+		backend := NewMemoryDao()
+		profiles := []*UserProfile{}
+		for _, id := range ids {
+			profiles = append(profiles, newProfile(id))
+		}
+		require.Nil(t, backend.Add(ctx, profiles))
+		return NewCacheDao(backend, options)
+	}
+	get := func(t *testing.T, dao Dao, ids ...int) {
+		for _, id := range ids {
+			p, err := dao.Get(ctx, id)
+			require.Nil(t, err)
+			require.Equal(t, id, p.ID)
+		}
+	}
+	stats := func(dao Dao) CacheStats {
+		return *dao.(CachedDao).CacheStats()
+	}
+
+	t.Run("hits and misses", func(t *testing.T) {
+		dao := newDao(t, &CacheOptions{Size: 10}, 1, 2)
+		get(t, dao, 1, 1, 2, 1)
+		assert.Equal(t, CacheStats{Hits: 2, Misses: 2}, stats(dao))
+		assert.Equal(t, 0.5, dao.(CachedDao).CacheStats().HitRatio())
+
+		// missing users are not cached
+		for i := 0; i < 2; i++ {
+			_, err := dao.Get(ctx, 3)
+			assert.True(t, errors.Is(err, ErrNotFound), "unexpected error: %v", err)
+		}
+		assert.Equal(t, int64(4), stats(dao).Misses)
+	})
+
+	t.Run("cached profiles are copied", func(t *testing.T) {
+		dao := newDao(t, &CacheOptions{Size: 10}, 1)
+		p, err := dao.Get(ctx, 1)
+		require.Nil(t, err)
+		p.Roles[0] = "ADMIN"
+
+		p, err = dao.Get(ctx, 1)
+		require.Nil(t, err)
+		p.Name = "Changed"
+		p, err = dao.Get(ctx, 1)
+		require.Nil(t, err)
+		assert.Equal(t, newProfile(1), p)
+		assert.Equal(t, int64(2), stats(dao).Hits)
+	})
+
+	t.Run("least recently used profile is evicted", func(t *testing.T) {
+		dao := newDao(t, &CacheOptions{Size: 2}, 1, 2, 3)
+		get(t, dao, 1, 2, 1, 3) // evicts 2
+		get(t, dao, 1, 3)
+		assert.Equal(t, CacheStats{Hits: 3, Misses: 3, Evictions: 1}, stats(dao))
+
+		get(t, dao, 2)
+		assert.Equal(t, int64(4), stats(dao).Misses)
+	})
+
+	t.Run("writes invalidate profiles", func(t *testing.T) {
+		dao := newDao(t, &CacheOptions{Size: 10}, 1, 2, 3)
+		get(t, dao, 1, 2, 3)
+
+		updated := newProfile(1)
+		updated.Name = "Updated"
+		require.Nil(t, dao.Update(ctx, updated))
+		require.Nil(t, dao.Delete(ctx, 2))
+		added := newProfile(3)
+		added.Name = "Added"
+		require.Nil(t, dao.Delete(ctx, 3))
+		require.Nil(t, dao.Add(ctx, []*UserProfile{added}))
+		assert.Equal(t, int64(3), stats(dao).Invalidations)
+
+		p, err := dao.Get(ctx, 1)
+		require.Nil(t, err)
+		assert.Equal(t, "Updated", p.Name)
+		_, err = dao.Get(ctx, 2)
+		assert.True(t, errors.Is(err, ErrNotFound), "unexpected error: %v", err)
+		p, err = dao.Get(ctx, 3)
+		require.Nil(t, err)
+		assert.Equal(t, "Added", p.Name)
+	})
+
+	t.Run("profile read before write is not cached", func(t *testing.T) {
+		backend := &blockingGetDao{Dao: NewMemoryDao(), started: make(chan struct{}), resume: make(chan struct{})}
+		require.Nil(t, backend.Add(ctx, []*UserProfile{newProfile(1)}))
+		dao := NewCacheDao(backend, &CacheOptions{Size: 10})
+
+		read := make(chan *UserProfile)
+		go func() {
+			p, _ := dao.Get(ctx, 1)
+			read <- p
+		}()
+		<-backend.started
+		updated := newProfile(1)
+		updated.Name = "Updated"
+		require.Nil(t, dao.Update(ctx, updated))
+		close(backend.resume)
+		assert.Equal(t, "User 1", (<-read).Name)
+
+		p, err := dao.Get(ctx, 1)
+		require.Nil(t, err)
+		assert.Equal(t, "Updated", p.Name)
+		assert.Equal(t, int64(2), stats(dao).Misses)
+	})
+
+	t.Run("admission keeps frequently requested profiles", func(t *testing.T) {
+		dao := newDao(t, &CacheOptions{Size: 2, Admission: true}, 1, 2, 3)
+		get(t, dao, 1, 1, 1, 2, 2, 2)
+		get(t, dao, 3) // requested once, so it is not worth evicting 1
+		assert.Equal(t, CacheStats{Hits: 4, Misses: 3, Rejections: 1}, stats(dao))
+
+		get(t, dao, 3, 3, 3) // becomes more popular than 1, which is the least recently used
+		get(t, dao, 2)
+		assert.Equal(t, CacheStats{Hits: 5, Misses: 6, Evictions: 1, Rejections: 3}, stats(dao))
+		get(t, dao, 3)
+		assert.Equal(t, int64(6), stats(dao).Hits)
+	})
+
+	t.Run("sketch forgets old requests", func(t *testing.T) {
+		s := newFrequencySketch(2)
+		for i := 0; i < 19; i++ {
+			s.increment(1)
+		}
+		assert.Equal(t, uint8(15), s.estimate(1))
+		assert.Equal(t, uint8(0), s.estimate(2))
+
+		s.increment(2) // 20 increments halve the counters
+		assert.Equal(t, uint8(7), s.estimate(1))
+		assert.Equal(t, uint8(0), s.estimate(2))
+	})
+}
+
+// blockingGetDao signals start of Get and waits until it is resumed
+type blockingGetDao struct {
+	Dao
+	started chan struct{}
+	resume  chan struct{}
+}
+
+func (t *blockingGetDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	p, err := t.Dao.Get(ctx, id)
+	select {
+	case t.started <- struct{}{}:
+		<-t.resume
+	default:
+	}
+	return p, err
+}
@@ -0,0 +1,257 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ChangeFeedDao is implemented by DAOs that record every write of users in the change feed, change records are
+// appended in the same transaction as the write, so that the feed never misses nor invents changes
+type ChangeFeedDao interface {
+	// ReadChanges returns at most limit changes with sequence numbers starting at fromSeq, in order of the
+	// sequence numbers; the first change has sequence number 1
+	ReadChanges(ctx context.Context, fromSeq uint64, limit int) ([]*Change, error)
+
+	// LastChangeSeq returns sequence number of the last recorded change or 0 if there are no changes
+	LastChangeSeq(ctx context.Context) (uint64, error)
+
+	// Subscribe passes the recorded changes with sequence numbers starting at fromSeq to fn, then waits for the new
+	// ones until ctx is done or fn fails; error of ctx or fn is returned
+	Subscribe(ctx context.Context, fromSeq uint64, fn func(c *Change) error) error
+}
+
+// ChangeType tells which write made the change
+type ChangeType int
+
+// Change types
+const (
+	ChangeAdd ChangeType = iota + 1
+	ChangeUpdate
+	ChangeDelete
+)
+
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeAdd:
+		return "add"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(c))
+	}
+}
+
+// Change is a record of the change feed
+type Change struct {
+	Seq     uint64
+	Type    ChangeType
+	ID      int          // ID of the changed user
+	Profile *UserProfile // written profile, nil for deletes
+	Time    time.Time    // time of the write
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("{seq: %d, type: %s, id: %d, time: %s, profile: %v}",
+		c.Seq, c.Type, c.ID, c.Time.Format(time.RFC3339Nano), c.Profile)
+}
+
+// ChangePollInterval is how often subscribers look for changes written by the other processes, changes written
+// through the same DAO are passed to subscribers as soon as they are committed
+var ChangePollInterval = time.Second
+
+//
+// Private
+//
+
+// changeBatchSize is a number of changes read by subscribers at once
+const changeBatchSize = 100
+
+// changeCodec encodes profiles of change records regardless of the codec of the stored values, so that the feed
+// has the same format for every backend
+var changeCodec Codec = protobufCodec{}
+
+// changeNotifier wakes up subscribers once changes are committed
+type changeNotifier struct {
+	lock    sync.Mutex
+	waiting chan struct{}
+}
+
+// wait returns channel, that is closed by the next notify
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.waiting == nil {
+		n.waiting = make(chan struct{})
+	}
+	return n.waiting
+}
+
+func (n *changeNotifier) notify() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.waiting != nil {
+		close(n.waiting)
+		n.waiting = nil
+	}
+}
+
+// subscribe implements ChangeFeedDao.Subscribe by means of the given ReadChanges
+func (n *changeNotifier) subscribe(
+	ctx context.Context,
+	read func(ctx context.Context, fromSeq uint64, limit int) ([]*Change, error),
+	fromSeq uint64,
+	fn func(c *Change) error,
+) error {
+	ticker := time.NewTicker(ChangePollInterval)
+	defer ticker.Stop()
+
+	for {
+		// channel is taken before reading, so that changes committed meanwhile are not missed
+		committed := n.wait()
+		changes, err := read(ctx, fromSeq, changeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			if err := fn(c); err != nil {
+				return err
+			}
+			fromSeq = c.Seq + 1
+		}
+		if len(changes) == changeBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-committed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// newChange creates change of the given profile, that is written now
+func newChange(changeType ChangeType, p *UserProfile) *Change {
+	return &Change{Type: changeType, ID: p.ID, Profile: p, Time: time.Now().UTC()}
+}
+
+// newDeleteChange creates change of the user with the given ID, who is deleted now
+func newDeleteChange(id int) *Change {
+	return &Change{Type: ChangeDelete, ID: id, Time: time.Now().UTC()}
+}
+
+// encodeChangeValue encodes change of key-value backends, that keep sequence number in the key: type byte followed
+// by 4 bytes of user ID, 8 bytes of write time in Unix nanoseconds and encoded profile, if any
+func encodeChangeValue(c *Change) ([]byte, error) {
+	result := make([]byte, 13)
+	result[0] = byte(c.Type)
+	copy(result[1:5], getBytesFromID(c.ID))
+	binary.BigEndian.PutUint64(result[5:13], uint64(c.Time.UnixNano()))
+	if c.Profile == nil {
+		return result, nil
+	}
+
+	profile, err := changeCodec.Encode(c.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, profile...), nil
+}
+
+func decodeChangeValue(seq uint64, value []byte) (*Change, error) {
+	if len(value) < 13 {
+		return nil, fmt.Errorf("malformed change seq=%d of %d bytes", seq, len(value))
+	}
+
+	c := &Change{
+		Seq:  seq,
+		Type: ChangeType(value[0]),
+		ID:   int(binary.BigEndian.Uint32(value[1:5])),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(value[5:13]))).UTC(),
+	}
+	if len(value) > 13 {
+		var err error
+		if c.Profile, err = changeCodec.Decode(value[13:]); err != nil {
+			return nil, fmt.Errorf("unable to decode profile of change seq=%d: %v", seq, err)
+		}
+	}
+	return c, nil
+}
+
+// sqliteChangesSchema defines change feed of sqlite-based backends, AUTOINCREMENT keeps sequence numbers from
+// being reused even if the last changes are deleted
+const sqliteChangesSchema = `
+CREATE TABLE IF NOT EXISTS changes (
+	seq						INTEGER PRIMARY KEY AUTOINCREMENT,
+	change_type		INTEGER NOT NULL,
+	user_id				INTEGER NOT NULL,
+	changed				INTEGER NOT NULL,
+	profile				BLOB NULL
+);
+`
+
+// addSqliteChange appends change within the given transaction, sqlite serializes write transactions, so changes
+// become visible in order of their sequence numbers
+func addSqliteChange(ctx context.Context, tx *sql.Tx, c *Change) error {
+	var profile []byte
+	if c.Profile != nil {
+		var err error
+		if profile, err = changeCodec.Encode(c.Profile); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO changes (change_type, user_id, changed, profile) VALUES (?, ?, ?, ?)",
+		int(c.Type),
+		c.ID,
+		c.Time.UnixNano(),
+		profile); err != nil {
+		return fmt.Errorf("unable to record change of user id=%d: %v", c.ID, err)
+	}
+	return nil
+}
+
+func readSqliteChanges(ctx context.Context, db *sql.DB, fromSeq uint64, limit int) ([]*Change, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT seq, change_type, user_id, changed, profile FROM changes WHERE seq>=? ORDER BY seq LIMIT ?",
+		int64(fromSeq), limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read changes: %v", err)
+	}
+	defer rows.Close()
+
+	result := []*Change{}
+	for rows.Next() {
+		var c Change
+		var changed int64
+		var profile []byte
+		if err := rows.Scan(&c.Seq, &c.Type, &c.ID, &changed, &profile); err != nil {
+			return nil, err
+		}
+
+		c.Time = time.Unix(0, changed).UTC()
+		if len(profile) > 0 {
+			if c.Profile, err = changeCodec.Decode(profile); err != nil {
+				return nil, fmt.Errorf("unable to decode profile of change seq=%d: %v", c.Seq, err)
+			}
+		}
+		result = append(result, &c)
+	}
+	return result, rows.Err()
+}
+
+func getSqliteLastChangeSeq(ctx context.Context, db *sql.DB) (uint64, error) {
+	var seq int64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM changes").Scan(&seq); err != nil {
+		return 0, fmt.Errorf("unable to get last change: %v", err)
+	}
+	return uint64(seq), nil
+}
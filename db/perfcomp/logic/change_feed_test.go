@@ -0,0 +1,165 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeFeed(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+	newProfile := func(id int, name string) *UserProfile {
+		return &UserProfile{ID: id, Name: name, Created: created, Roles: []string{"READER"},
+			Accounts: []*OauthAccount{{Provider: "VK", Token: name, Created: created}}}
+	}
+	// summarize leaves out time of the changes, which is only checked to be set
+	summarize := func(t *testing.T, changes []*Change) []string {
+		result := []string{}
+		for _, c := range changes {
+			assert.False(t, c.Time.IsZero(), "change seq=%d has no time", c.Seq)
+			name := ""
+			if c.Profile != nil {
+				assert.Equal(t, c.ID, c.Profile.ID)
+				name = c.Profile.Name
+			}
+			result = append(result, fmt.Sprintf("%d %s id=%d %s", c.Seq, c.Type, c.ID, name))
+		}
+		return result
+	}
+
+	for _, b := range []*testBackend{testSqlite, testKvSqlite, testBolt, testBoltBatch} {
+		t.Run(b.name, func(t *testing.T) {
+			openDao := func(t *testing.T) (ChangeFeedDao, Dao, string) {
+				path := filepath.Join(t.TempDir(), b.name+".db")
+				dao, err := b.open(path)
+				require.Nil(t, err)
+				return dao.(ChangeFeedDao), dao, path
+			}
+
+			t.Run("writes are recorded", func(t *testing.T) {
+				feed, dao, _ := openDao(t)
+				defer dao.Close()
+
+				seq, err := feed.LastChangeSeq(ctx)
+				require.Nil(t, err)
+				assert.Equal(t, uint64(0), seq)
+
+				require.Nil(t, dao.Add(ctx, []*UserProfile{newProfile(1, "Alice"), newProfile(2, "Bob")}))
+				require.Nil(t, dao.Update(ctx, newProfile(1, "Alicia")))
+				require.Nil(t, dao.Delete(ctx, 2))
+
+				// failed writes are rolled back along with their changes
+				assert.NotNil(t, dao.Update(ctx, newProfile(3, "Carol")))
+				assert.NotNil(t, dao.Delete(ctx, 3))
+				assert.NotNil(t, dao.Add(ctx, []*UserProfile{newProfile(3, "Carol"), newProfile(4, "Alicia")}),
+					"oauth account should belong to a single user")
+
+				changes, err := feed.ReadChanges(ctx, 0, 10)
+				require.Nil(t, err)
+				assert.Equal(t, []string{
+					"1 add id=1 Alice",
+					"2 add id=2 Bob",
+					"3 update id=1 Alicia",
+					"4 delete id=2 ",
+				}, summarize(t, changes))
+				assert.Equal(t, newProfile(1, "Alicia"), changes[2].Profile)
+
+				changes, err = feed.ReadChanges(ctx, 2, 2)
+				require.Nil(t, err)
+				assert.Equal(t, []string{"2 add id=2 Bob", "3 update id=1 Alicia"}, summarize(t, changes))
+
+				seq, err = feed.LastChangeSeq(ctx)
+				require.Nil(t, err)
+				assert.Equal(t, uint64(4), seq)
+			})
+
+			t.Run("sequence continues after reopen", func(t *testing.T) {
+				_, dao, path := openDao(t)
+				require.Nil(t, dao.Add(ctx, []*UserProfile{newProfile(1, "Alice")}))
+				require.Nil(t, dao.Close())
+
+				dao, err := b.open(path)
+				require.Nil(t, err)
+				defer dao.Close()
+				require.Nil(t, dao.Delete(ctx, 1))
+
+				changes, err := dao.(ChangeFeedDao).ReadChanges(ctx, 1, 10)
+				require.Nil(t, err)
+				assert.Equal(t, []string{"1 add id=1 Alice", "2 delete id=1 "}, summarize(t, changes))
+			})
+
+			t.Run("subscriber tails new changes", func(t *testing.T) {
+				feed, dao, _ := openDao(t)
+				defer dao.Close()
+				require.Nil(t, dao.Add(ctx, []*UserProfile{newProfile(1, "Alice"), newProfile(2, "Bob")}))
+
+				subscribeCtx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				received := make(chan *Change, 10)
+				done := make(chan error)
+				go func() {
+					done <- feed.Subscribe(subscribeCtx, 2, func(c *Change) error {
+						received <- c
+						return nil
+					})
+				}()
+
+				receive := func() *Change {
+					select {
+					case c := <-received:
+						return c
+					case <-time.After(ChangePollInterval / 2):
+						require.Fail(t, "change is not received")
+						return nil
+					}
+				}
+				assert.Equal(t, []string{"2 add id=2 Bob"}, summarize(t, []*Change{receive()}))
+
+				// the new changes are passed sooner than they are polled
+				require.Nil(t, dao.Update(ctx, newProfile(2, "Bobby")))
+				assert.Equal(t, []string{"3 update id=2 Bobby"}, summarize(t, []*Change{receive()}))
+				require.Nil(t, dao.Delete(ctx, 1))
+				assert.Equal(t, []string{"4 delete id=1 "}, summarize(t, []*Change{receive()}))
+
+				cancel()
+				assert.Equal(t, context.Canceled, <-done)
+			})
+
+			t.Run("subscriber error stops subscription", func(t *testing.T) {
+				feed, dao, _ := openDao(t)
+				defer dao.Close()
+				require.Nil(t, dao.Add(ctx, []*UserProfile{newProfile(1, "Alice"), newProfile(2, "Bob")}))
+
+				seqs := []uint64{}
+				err := feed.Subscribe(ctx, 0, func(c *Change) error {
+					seqs = append(seqs, c.Seq)
+					return ErrNotFound
+				})
+				assert.Equal(t, ErrNotFound, err)
+				assert.Equal(t, []uint64{1}, seqs)
+			})
+		})
+	}
+
+	t.Run("change value round trip", func(t *testing.T) {
+		for _, c := range []*Change{
+			{Seq: 7, Type: ChangeAdd, ID: 1, Profile: newProfile(1, "Alice"), Time: created},
+			{Seq: 8, Type: ChangeDelete, ID: 1, Time: created.Add(time.Nanosecond)},
+		} {
+			value, err := encodeChangeValue(c)
+			require.Nil(t, err)
+			decoded, err := decodeChangeValue(c.Seq, value)
+			require.Nil(t, err)
+			assert.Equal(t, c, decoded)
+		}
+
+		_, err := decodeChangeValue(9, []byte{1, 2})
+		assert.EqualError(t, err, "malformed change seq=9 of 2 bytes")
+	})
+}
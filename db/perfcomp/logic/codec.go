@@ -0,0 +1,391 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/pbwire"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec serializes user profiles, that key-value backends store as opaque values. Decoded profiles should not
+// refer to the given data, which might be reused by the backend once Decode returns.
+type Codec interface {
+	Name() string
+	Encode(p *UserProfile) ([]byte, error)
+	Decode(data []byte) (*UserProfile, error)
+}
+
+// Codec names
+const (
+	GobCodecName      = "gob"
+	JSONCodecName     = "json"
+	ProtobufCodecName = "protobuf"
+	BinaryCodecName   = "binary"
+)
+
+// CodecNames lists names of all the supported codecs
+var CodecNames = []string{GobCodecName, JSONCodecName, ProtobufCodecName, BinaryCodecName}
+
+// NewCodec returns codec with the given name
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case GobCodecName:
+		return gobCodec{}, nil
+	case JSONCodecName:
+		return jsonCodec{}, nil
+	case ProtobufCodecName:
+		return protobufCodec{}, nil
+	case BinaryCodecName:
+		return binaryCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec=%s, expected one of %s", name, CodecNames)
+	}
+}
+
+//
+// Private
+//
+
+// checkStoredCodec fails if values of the initialized database are encoded with a codec other than the given one,
+// stored is the codec name recorded in the database or nil if the database has been created before codecs were
+// introduced, so that it keeps gob-encoded values. Backends check codec on open before migrations, as some of them
+// decode the stored values.
+func checkStoredCodec(stored []byte, codec Codec) error {
+	if stored == nil {
+		stored = []byte(GobCodecName)
+	}
+	if string(stored) != codec.Name() {
+		return fmt.Errorf("codec mismatch, expected: %s, actual: %s", codec.Name(), stored)
+	}
+	return nil
+}
+
+// gobCodec creates a new encoder per value, so that every value carries its own type description and can be
+// decoded on its own; this makes gob values much larger than the ones of the other codecs
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return GobCodecName }
+
+func (gobCodec) Encode(p *UserProfile) ([]byte, error) {
+	var valueBuf bytes.Buffer
+	encoder := gob.NewEncoder(&valueBuf)
+	if err := encoder.Encode(p); err != nil {
+		return nil, err
+	}
+	return valueBuf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte) (*UserProfile, error) {
+	decoder := gob.NewDecoder(bytes.NewBuffer(data))
+	var p UserProfile
+	if err := decoder.Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return JSONCodecName }
+
+func (jsonCodec) Encode(p *UserProfile) ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func (jsonCodec) Decode(data []byte) (*UserProfile, error) {
+	var p UserProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// protobufCodec writes protocol buffers wire format of the messages defined in proto/user_profile.proto, messages
+// are encoded by hand with pbwire
+type protobufCodec struct{}
+
+// protobuf field numbers, see proto/user_profile.proto
+const (
+	pbProfileID       protowire.Number = 1
+	pbProfileName     protowire.Number = 2
+	pbProfileCreated  protowire.Number = 3
+	pbProfileRoles    protowire.Number = 4
+	pbProfileAccounts protowire.Number = 5
+
+	pbAccountToken    protowire.Number = 1
+	pbAccountProvider protowire.Number = 2
+	pbAccountCreated  protowire.Number = 3
+
+	pbTimestampSeconds protowire.Number = 1
+	pbTimestampNanos   protowire.Number = 2
+)
+
+func (protobufCodec) Name() string { return ProtobufCodecName }
+
+func (protobufCodec) Encode(p *UserProfile) ([]byte, error) {
+	b := make([]byte, 0, 128)
+	b = protowire.AppendTag(b, pbProfileID, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(p.ID))
+	b = protowire.AppendTag(b, pbProfileName, protowire.BytesType)
+	b = protowire.AppendString(b, p.Name)
+	b = protowire.AppendTag(b, pbProfileCreated, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendPbTimestamp(nil, p.Created))
+	for _, r := range p.Roles {
+		b = protowire.AppendTag(b, pbProfileRoles, protowire.BytesType)
+		b = protowire.AppendString(b, r)
+	}
+
+	for _, a := range p.Accounts {
+		var m []byte
+		m = protowire.AppendTag(m, pbAccountToken, protowire.BytesType)
+		m = protowire.AppendString(m, a.Token)
+		m = protowire.AppendTag(m, pbAccountProvider, protowire.BytesType)
+		m = protowire.AppendString(m, a.Provider)
+		m = protowire.AppendTag(m, pbAccountCreated, protowire.BytesType)
+		m = protowire.AppendBytes(m, appendPbTimestamp(nil, a.Created))
+
+		b = protowire.AppendTag(b, pbProfileAccounts, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+
+	return b, nil
+}
+
+func (protobufCodec) Decode(data []byte) (*UserProfile, error) {
+	var p UserProfile
+	if err := pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == pbProfileID && typ == protowire.VarintType:
+			id, n := protowire.ConsumeVarint(v)
+			p.ID = int(id)
+			return n, nil
+		case num == pbProfileName && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(v)
+			p.Name = s
+			return n, nil
+		case num == pbProfileCreated && typ == protowire.BytesType:
+			m, n := protowire.ConsumeBytes(v)
+			if n < 0 {
+				return n, nil
+			}
+			var err error
+			p.Created, err = decodePbTimestamp(m)
+			return n, err
+		case num == pbProfileRoles && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(v)
+			p.Roles = append(p.Roles, s)
+			return n, nil
+		case num == pbProfileAccounts && typ == protowire.BytesType:
+			m, n := protowire.ConsumeBytes(v)
+			if n < 0 {
+				return n, nil
+			}
+			a, err := decodePbAccount(m)
+			p.Accounts = append(p.Accounts, a)
+			return n, err
+		default:
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func decodePbAccount(data []byte) (*OauthAccount, error) {
+	var a OauthAccount
+	err := pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		switch {
+		case num == pbAccountToken && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(v)
+			a.Token = s
+			return n, nil
+		case num == pbAccountProvider && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(v)
+			a.Provider = s
+			return n, nil
+		case num == pbAccountCreated && typ == protowire.BytesType:
+			m, n := protowire.ConsumeBytes(v)
+			if n < 0 {
+				return n, nil
+			}
+			var err error
+			a.Created, err = decodePbTimestamp(m)
+			return n, err
+		default:
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+	})
+	return &a, err
+}
+
+// appendPbTimestamp appends fields of google.protobuf.Timestamp compatible message
+func appendPbTimestamp(b []byte, t time.Time) []byte {
+	b = protowire.AppendTag(b, pbTimestampSeconds, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Unix()))
+	b = protowire.AppendTag(b, pbTimestampNanos, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.Nanosecond()))
+}
+
+func decodePbTimestamp(data []byte) (time.Time, error) {
+	var seconds int64
+	var nanos int64
+	err := pbwire.ConsumeMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+		if typ != protowire.VarintType || (num != pbTimestampSeconds && num != pbTimestampNanos) {
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		}
+
+		x, n := protowire.ConsumeVarint(v)
+		if num == pbTimestampSeconds {
+			seconds = int64(x)
+		} else {
+			nanos = int64(x)
+		}
+		return n, nil
+	})
+	return time.Unix(seconds, nanos).UTC(), err
+}
+
+// binaryCodec uses hand-rolled layout: version byte, ID, name, created, roles and accounts, where integers
+// are varints, strings and lists are prefixed with their lengths and times are seconds followed by nanoseconds
+type binaryCodec struct{}
+
+// binaryCodecVersion is a version of binary codec layout, it should be bumped whenever layout changes
+const binaryCodecVersion = 1
+
+func (binaryCodec) Name() string { return BinaryCodecName }
+
+func (binaryCodec) Encode(p *UserProfile) ([]byte, error) {
+	b := make([]byte, 0, 128)
+	b = append(b, binaryCodecVersion)
+	b = binary.AppendVarint(b, int64(p.ID))
+	b = appendBinaryString(b, p.Name)
+	b = appendBinaryTime(b, p.Created)
+
+	b = binary.AppendUvarint(b, uint64(len(p.Roles)))
+	for _, r := range p.Roles {
+		b = appendBinaryString(b, r)
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(p.Accounts)))
+	for _, a := range p.Accounts {
+		b = appendBinaryString(b, a.Token)
+		b = appendBinaryString(b, a.Provider)
+		b = appendBinaryTime(b, a.Created)
+	}
+
+	return b, nil
+}
+
+func (binaryCodec) Decode(data []byte) (*UserProfile, error) {
+	if len(data) == 0 || data[0] != binaryCodecVersion {
+		return nil, fmt.Errorf("unsupported binary codec value")
+	}
+
+	r := &binaryReader{data: data[1:]}
+	p := &UserProfile{
+		ID:      int(r.varint()),
+		Name:    r.string(),
+		Created: r.time(),
+	}
+
+	for n := r.count(); n > 0; n-- {
+		p.Roles = append(p.Roles, r.string())
+	}
+
+	for n := r.count(); n > 0; n-- {
+		p.Accounts = append(p.Accounts, &OauthAccount{
+			Token:    r.string(),
+			Provider: r.string(),
+			Created:  r.time(),
+		})
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) > 0 {
+		return nil, fmt.Errorf("malformed binary codec value: %d trailing bytes", len(r.data))
+	}
+
+	return p, nil
+}
+
+func appendBinaryString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBinaryTime(b []byte, t time.Time) []byte {
+	b = binary.AppendVarint(b, t.Unix())
+	return binary.AppendUvarint(b, uint64(t.Nanosecond()))
+}
+
+// binaryReader reads values written by binary codec, once an error occurs all the subsequent reads return
+// zero values and the error is kept
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed binary codec value: bad varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed binary codec value: bad uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads length of a list, which can never exceed number of the remaining bytes
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = fmt.Errorf("malformed binary codec value: bad list length")
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.data)) {
+		r.err = fmt.Errorf("malformed binary codec value: bad string length")
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binaryReader) time() time.Time {
+	seconds := r.varint()
+	nanos := r.uvarint()
+	return time.Unix(seconds, int64(nanos)).UTC()
+}
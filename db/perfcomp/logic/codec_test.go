@@ -0,0 +1,67 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 891, time.UTC)
+	profiles := []*UserProfile{
+		{ID: 1, Name: "Alice", Created: created, Roles: []string{"ADMIN", "READER"}, Accounts: []*OauthAccount{
+			{Provider: "Google", Token: "t1", Created: created.Add(time.Minute)},
+			{Provider: "VK", Token: "t2", Created: created.Add(-time.Hour)},
+		}},
+		{ID: 1<<31 - 1, Name: "Имя с юникодом", Created: created.In(time.FixedZone("UTC+3", 3*3600))},
+		{ID: 0}, // zero time, no roles and no accounts
+	}
+
+	for _, name := range CodecNames {
+		codec, err := NewCodec(name)
+		require.Nil(t, err)
+
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, name, codec.Name())
+
+			for _, p := range profiles {
+				data, err := codec.Encode(p)
+				require.Nil(t, err)
+
+				actual, err := codec.Decode(data)
+				require.Nil(t, err)
+				assert.Equal(t, p.ID, actual.ID)
+				assert.Equal(t, p.Name, actual.Name)
+				assert.True(t, p.Created.Equal(actual.Created), "created: expected %s, actual %s", p.Created, actual.Created)
+				assert.Equal(t, len(p.Roles), len(actual.Roles))
+				for i, r := range p.Roles {
+					assert.Equal(t, r, actual.Roles[i])
+				}
+				require.Equal(t, len(p.Accounts), len(actual.Accounts))
+				for i, a := range p.Accounts {
+					assert.Equal(t, a.Provider, actual.Accounts[i].Provider)
+					assert.Equal(t, a.Token, actual.Accounts[i].Token)
+					assert.True(t, a.Created.Equal(actual.Accounts[i].Created))
+				}
+			}
+		})
+	}
+
+	t.Run("malformed values", func(t *testing.T) {
+		for _, name := range CodecNames {
+			codec, _ := NewCodec(name)
+			data, err := codec.Encode(profiles[0])
+			require.Nil(t, err)
+
+			_, err = codec.Decode(data[:len(data)-3])
+			assert.NotNil(t, err, "codec=%s", name)
+		}
+	})
+
+	t.Run("unknown codec", func(t *testing.T) {
+		_, err := NewCodec("xml")
+		assert.EqualError(t, err, "unknown codec=xml, expected one of [gob json protobuf binary]")
+	})
+}
@@ -1,6 +1,8 @@
 package logic
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -14,6 +16,29 @@ var Roles = [...]string{
 	"READER",
 }
 
+// OauthProviders defines allowable values for providers of oauth accounts
+var OauthProviders = [...]string{
+	"VK",
+	"Facebook",
+	"Google",
+	"Twitter",
+}
+
+// ErrNotFound is wrapped by errors of Get, FindByOauthAccount, Update and Delete caused by absence of the requested
+// user
+var ErrNotFound = errors.New("user not found")
+
+// ErrAlreadyExists is wrapped by errors of Add caused by a user, whose ID is stored already or repeated in the added
+// profiles
+var ErrAlreadyExists = errors.New("user already exists")
+
+// ErrAccountTaken is wrapped by errors of Add and Update caused by an oauth account, that belongs to another user
+var ErrAccountTaken = errors.New("oauth account taken")
+
+// ErrInvalidOffsetToken is wrapped by errors of QueryUsers caused by offset token that is malformed, tampered with or
+// issued by another backend or for another query
+var ErrInvalidOffsetToken = errors.New("invalid offset token")
+
 // UserProfile represents user account
 type UserProfile struct {
 	ID       int
@@ -56,12 +81,27 @@ type UserPage struct {
 	OffsetToken string
 }
 
-// Dao represents an interface to user DAO
+// Dao represents an interface to user DAO, every operation gives up once the given context is done
 type Dao interface {
 	io.Closer
 
-	Add(profiles []*UserProfile) error
-	QueryUsers(offsetToken string, limit int) (*UserPage, error)
-	Get(id int) (*UserProfile, error)
-	GetIDRange() (from int, to int, err error)
+	// Add stores all the given profiles or none of them, profiles are never overwritten: one with the taken ID fails
+	// the whole call with ErrAlreadyExists
+	Add(ctx context.Context, profiles []*UserProfile) error
+	Update(ctx context.Context, profile *UserProfile) error
+	Delete(ctx context.Context, id int) error
+	QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error)
+	Get(ctx context.Context, id int) (*UserProfile, error)
+	FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error)
+	GetIDRange(ctx context.Context) (from int, to int, err error)
+}
+
+// IndexedDao is implemented by DAOs that maintain secondary indexes on their own, rather than relying on
+// the underlying database to do so
+type IndexedDao interface {
+	// RebuildIndexes drops all secondary indexes and builds them again out of the stored users
+	RebuildIndexes() error
+
+	// VerifyIndexes checks that every secondary index has exactly the entries of the stored users
+	VerifyIndexes() error
 }
@@ -0,0 +1,89 @@
+package logic_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"github.com/avshabanov/go-code/db/perfcomp/logic/daotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaoConformance(t *testing.T) {
+	gob, err := logic.NewCodec(logic.GobCodecName)
+	require.Nil(t, err)
+
+	backends := []daotest.Backend{
+		{Name: "sqlite", Open: logic.NewSqliteDao, Persistent: true},
+		{Name: "bolt", Open: logic.NewBoltDao, Persistent: true},
+		{Name: "bolt-tuned", Open: func(path string) (logic.Dao, error) {
+			return logic.NewBoltDaoWithOptions(path, gob, &logic.BoltOptions{
+				NoSync:      true,
+				NoGrowSync:  true,
+				FillPercent: 0.9,
+				Batch:       true,
+			})
+		}, Persistent: true},
+		{Name: "kvsqlite", Open: logic.NewKvSqliteDao, Persistent: true},
+		{Name: "leveldb", Open: logic.NewLevelDbDao, Persistent: true},
+		{Name: "memory", Open: func(string) (logic.Dao, error) { return logic.NewMemoryDao(), nil }},
+	}
+
+	// key-value backends are tested with every codec, gob is tested above as the default one
+	for _, name := range logic.CodecNames[1:] {
+		codec, err := logic.NewCodec(name)
+		require.Nil(t, err)
+
+		backends = append(backends,
+			daotest.Backend{Name: "bolt-" + name, Open: func(path string) (logic.Dao, error) {
+				return logic.NewBoltDaoWithCodec(path, codec)
+			}, Persistent: true},
+			daotest.Backend{Name: "kvsqlite-" + name, Open: func(path string) (logic.Dao, error) {
+				return logic.NewKvSqliteDaoWithCodec(path, codec)
+			}, Persistent: true},
+			daotest.Backend{Name: "leveldb-" + name, Open: func(path string) (logic.Dao, error) {
+				return logic.NewLevelDbDaoWithCodec(path, codec)
+			}, Persistent: true},
+		)
+	}
+
+	for _, b := range backends {
+		b := b
+		t.Run(b.Name, func(t *testing.T) {
+			daotest.Run(t, b)
+		})
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	ctx := context.Background()
+	json, err := logic.NewCodec(logic.JSONCodecName)
+	require.Nil(t, err)
+
+	for _, b := range []struct {
+		name      string
+		open      func(path string) (logic.Dao, error)
+		openCodec func(path string, codec logic.Codec) (logic.Dao, error)
+	}{
+		{"bolt", logic.NewBoltDao, logic.NewBoltDaoWithCodec},
+		{"kvsqlite", logic.NewKvSqliteDao, logic.NewKvSqliteDaoWithCodec},
+		{"leveldb", logic.NewLevelDbDao, logic.NewLevelDbDaoWithCodec},
+	} {
+		t.Run(b.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), b.name+".db")
+			dao, err := b.open(path)
+			require.Nil(t, err)
+			require.Nil(t, dao.Add(ctx, daotest.NewProfiles(1)))
+			require.Nil(t, dao.Close())
+
+			_, err = b.openCodec(path, json)
+			assert.Contains(t, err.Error(), "codec mismatch, expected: json, actual: gob")
+
+			dao, err = b.open(path)
+			require.Nil(t, err, "db should be accessible with the original codec")
+			assert.Nil(t, dao.Close())
+		})
+	}
+}
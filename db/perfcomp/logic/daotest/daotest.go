@@ -0,0 +1,642 @@
+// Package daotest provides conformance tests that every logic.Dao implementation is expected to pass
+package daotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Backend describes DAO implementation under test
+type Backend struct {
+	Name string
+
+	// Open creates DAO that keeps its data at the given path, which does not exist when DAO is opened first time
+	Open func(path string) (logic.Dao, error)
+
+	// Persistent tells whether data survives closing DAO and opening it again at the same path
+	Persistent bool
+}
+
+// Run runs conformance test suite against the given backend, each test gets its own fresh database
+func Run(t *testing.T, b Backend) {
+	for _, tc := range conformanceTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), b.Name+".db")
+			dao, err := b.Open(path)
+			require.Nil(t, err, "unable to open %s dao", b.Name)
+
+			e := &env{backend: b, path: path, dao: dao, ctx: context.Background()}
+			defer func() {
+				if e.dao != nil {
+					e.dao.Close()
+				}
+			}()
+
+			tc.test(t, e)
+		})
+	}
+}
+
+// NewProfiles creates sample user profiles with the given IDs
+func NewProfiles(ids ...int) []*logic.UserProfile {
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+	result := []*logic.UserProfile{}
+	for i, id := range ids {
+		p := &logic.UserProfile{
+			ID:      id,
+			Name:    "User " + string(rune('A'+i%26)),
+			Created: created.Add(time.Duration(i) * time.Hour),
+			Roles:   []string{logic.Roles[i%len(logic.Roles)]},
+		}
+
+		if i%2 == 0 {
+			p.Roles = append(p.Roles, logic.Roles[(i+1)%len(logic.Roles)])
+			p.Accounts = append(p.Accounts, &logic.OauthAccount{
+				Provider: "Google",
+				Token:    "google-token-" + p.Name,
+				Created:  p.Created.Add(time.Minute),
+			})
+		}
+		if i%3 == 0 {
+			p.Accounts = append(p.Accounts, &logic.OauthAccount{
+				Provider: "VK",
+				Token:    "vk-token-" + p.Name,
+				Created:  p.Created.Add(2 * time.Minute),
+			})
+		}
+
+		result = append(result, p)
+	}
+	return result
+}
+
+// AssertProfilesEqual checks that profiles are equal regardless of order of roles and accounts, which is not
+// guaranteed by DAO, and of time zones
+func AssertProfilesEqual(t *testing.T, expected *logic.UserProfile, actual *logic.UserProfile) {
+	if !assert.NotNil(t, actual, "missing profile %s", expected) {
+		return
+	}
+
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.Equal(t, expected.Name, actual.Name)
+	assert.True(t, expected.Created.Equal(actual.Created), "created: expected %s, actual %s", expected.Created, actual.Created)
+
+	assert.Equal(t, sortedRoles(expected), sortedRoles(actual), "roles of %s", expected)
+
+	expectedAccounts := sortedAccounts(expected)
+	actualAccounts := sortedAccounts(actual)
+	if !assert.Equal(t, len(expectedAccounts), len(actualAccounts), "accounts of %s", expected) {
+		return
+	}
+	for i, a := range expectedAccounts {
+		assert.Equal(t, a.Provider, actualAccounts[i].Provider)
+		assert.Equal(t, a.Token, actualAccounts[i].Token)
+		assert.True(t, a.Created.Equal(actualAccounts[i].Created), "account created: expected %s, actual %s", a.Created, actualAccounts[i].Created)
+	}
+}
+
+// QueryAllIDs pages through all users with the given limit and returns their IDs along with number of pages
+func QueryAllIDs(t *testing.T, dao logic.Dao, limit int) (ids []int, pages int) {
+	return QueryIDs(t, dao, nil, limit)
+}
+
+// QueryIDs pages through users matching the given query and returns their IDs along with number of pages
+func QueryIDs(t *testing.T, dao logic.Dao, query *logic.UserQuery, limit int) (ids []int, pages int) {
+	offsetToken := ""
+	for {
+		page, err := dao.QueryUsers(context.Background(), query, offsetToken, limit)
+		require.Nil(t, err)
+		require.True(t, len(page.Profiles) <= limit, "page size %d exceeds limit %d", len(page.Profiles), limit)
+
+		pages++
+		for _, p := range page.Profiles {
+			ids = append(ids, p.ID)
+		}
+
+		if len(page.OffsetToken) == 0 {
+			return ids, pages
+		}
+
+		require.True(t, pages <= 1000, "too many pages, offset token does not advance: %s", page.OffsetToken)
+		offsetToken = page.OffsetToken
+	}
+}
+
+//
+// Private
+//
+
+type env struct {
+	backend Backend
+	path    string
+	dao     logic.Dao
+	ctx     context.Context
+}
+
+type conformanceTest struct {
+	name string
+	test func(t *testing.T, e *env)
+}
+
+var conformanceTests = []conformanceTest{
+	{"add and get round trip", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2, 3, 4, 5, 6, 7)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		for _, p := range profiles {
+			actual, err := dao.Get(e.ctx, p.ID)
+			assert.Nil(t, err)
+			AssertProfilesEqual(t, p, actual)
+		}
+	}},
+
+	{"get missing id", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(1, 3)))
+
+		p, err := dao.Get(e.ctx, 2)
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+		assert.Nil(t, p)
+	}},
+
+	{"add taken id", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2, 3, 4, 5)
+		require.Nil(t, dao.Add(e.ctx, profiles[:2]))
+
+		// add fails as a whole and leaves the stored profile intact
+		taken := profiles[2:]
+		taken[1].ID = 2
+		err := dao.Add(e.ctx, taken[:2])
+		assert.True(t, errors.Is(err, logic.ErrAlreadyExists), "unexpected error: %v", err)
+
+		actual, err := dao.Get(e.ctx, 2)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, profiles[1], actual)
+
+		// the same ID repeated in the added profiles is rejected too
+		taken[2].ID = 3
+		err = dao.Add(e.ctx, []*logic.UserProfile{taken[0], taken[2]})
+		assert.True(t, errors.Is(err, logic.ErrAlreadyExists), "unexpected error: %v", err)
+
+		ids, _ := QueryAllIDs(t, dao, 10)
+		assert.Equal(t, []int{1, 2}, ids)
+	}},
+
+	{"update", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		updated := NewProfiles(100, 101, 102)[2] // different name, roles and accounts
+		updated.ID = 1
+		require.Nil(t, dao.Update(e.ctx, updated))
+
+		actual, err := dao.Get(e.ctx, 1)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, updated, actual)
+
+		actual, err = dao.Get(e.ctx, 2)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, profiles[1], actual)
+	}},
+
+	{"update missing id", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(1)))
+
+		err := dao.Update(e.ctx, NewProfiles(2)[0])
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+
+		_, err = dao.Get(e.ctx, 2)
+		assert.NotNil(t, err, "update should not create missing profile")
+	}},
+
+	{"delete", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2, 3)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		require.Nil(t, dao.Delete(e.ctx, 2))
+
+		_, err := dao.Get(e.ctx, 2)
+		assert.NotNil(t, err)
+
+		ids, _ := QueryAllIDs(t, dao, 10)
+		assert.Equal(t, []int{1, 3}, ids)
+
+		// associated roles and accounts should not leak into a new profile with the same ID
+		readded := NewProfiles(2)[0]
+		readded.Roles = []string{"READER"}
+		readded.Accounts = nil
+		require.Nil(t, dao.Add(e.ctx, []*logic.UserProfile{readded}))
+
+		actual, err := dao.Get(e.ctx, 2)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, readded, actual)
+	}},
+
+	{"delete missing id", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(1)))
+
+		err := dao.Delete(e.ctx, 2)
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+	}},
+
+	{"find by oauth account", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2, 3, 4, 5, 6)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		for _, p := range profiles {
+			for _, a := range p.Accounts {
+				actual, err := dao.FindByOauthAccount(e.ctx, a.Provider, a.Token)
+				assert.Nil(t, err)
+				AssertProfilesEqual(t, p, actual)
+			}
+		}
+
+		a := profiles[0].Accounts[0]
+		for _, missing := range []*logic.OauthAccount{
+			{Provider: a.Provider, Token: "unknown"},
+			{Provider: "Twitter", Token: a.Token},
+		} {
+			p, err := dao.FindByOauthAccount(e.ctx, missing.Provider, missing.Token)
+			assert.True(t, errors.Is(err, logic.ErrNotFound), "account=%s, error: %v", missing, err)
+			assert.Nil(t, p)
+		}
+	}},
+
+	{"find by oauth account after update and delete", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2, 3)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		// update replaces accounts of the user
+		oldAccount := profiles[0].Accounts[0]
+		updated := *profiles[0]
+		updated.Accounts = []*logic.OauthAccount{{Provider: "Facebook", Token: "new-token", Created: updated.Created}}
+		require.Nil(t, dao.Update(e.ctx, &updated))
+
+		_, err := dao.FindByOauthAccount(e.ctx, oldAccount.Provider, oldAccount.Token)
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+
+		actual, err := dao.FindByOauthAccount(e.ctx, "Facebook", "new-token")
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, &updated, actual)
+
+		// accounts of the deleted user are released and can be taken by another user
+		deletedAccount := profiles[2].Accounts[0]
+		require.Nil(t, dao.Delete(e.ctx, 3))
+
+		_, err = dao.FindByOauthAccount(e.ctx, deletedAccount.Provider, deletedAccount.Token)
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+
+		taker := *profiles[1]
+		taker.Accounts = append(taker.Accounts, deletedAccount)
+		require.Nil(t, dao.Update(e.ctx, &taker))
+
+		actual, err = dao.FindByOauthAccount(e.ctx, deletedAccount.Provider, deletedAccount.Token)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, &taker, actual)
+	}},
+
+	{"oauth account belongs to a single user", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+		taken := profiles[0].Accounts[0]
+
+		// add fails as a whole
+		added := NewProfiles(10, 11, 12)
+		for _, p := range added {
+			for _, a := range p.Accounts {
+				a.Token = "new-" + a.Token
+			}
+		}
+		added[2].Accounts = append(added[2].Accounts, taken)
+		err := dao.Add(e.ctx, added)
+		assert.True(t, errors.Is(err, logic.ErrAccountTaken), "unexpected error: %v", err)
+
+		for _, p := range added {
+			_, err := dao.Get(e.ctx, p.ID)
+			assert.NotNil(t, err, "user=%d should not be added", p.ID)
+		}
+
+		updated := *profiles[1]
+		updated.Accounts = append(updated.Accounts, taken)
+		err = dao.Update(e.ctx, &updated)
+		assert.True(t, errors.Is(err, logic.ErrAccountTaken), "unexpected error: %v", err)
+
+		actual, err := dao.Get(e.ctx, 2)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, profiles[1], actual)
+
+		actual, err = dao.FindByOauthAccount(e.ctx, taken.Provider, taken.Token)
+		assert.Nil(t, err)
+		AssertProfilesEqual(t, profiles[0], actual)
+	}},
+
+	{"query users paging", func(t *testing.T, e *env) {
+		dao := e.dao
+
+		// use IDs with gaps, so that offset tokens point to keys that are not adjacent to the previous ones
+		allIDs := []int{2, 4, 6, 8, 10, 12, 14, 16, 18, 20}
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(allIDs...)))
+
+		for _, tc := range []struct {
+			limit int
+			pages int
+		}{
+			{limit: 1, pages: 10},
+			{limit: 3, pages: 4},
+			{limit: 5, pages: 2},
+			{limit: 9, pages: 2},
+			{limit: 10, pages: 1},
+			{limit: 11, pages: 1},
+			{limit: 100, pages: 1},
+		} {
+			ids, pages := QueryAllIDs(t, dao, tc.limit)
+			assert.Equal(t, allIDs, ids, "limit=%d", tc.limit)
+			assert.Equal(t, tc.pages, pages, "limit=%d", tc.limit)
+		}
+	}},
+
+	{"query users returns complete profiles", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := NewProfiles(1, 2, 3, 4)
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		page, err := dao.QueryUsers(e.ctx, nil, "", 2)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(page.Profiles))
+		assert.NotEmpty(t, page.OffsetToken)
+		AssertProfilesEqual(t, profiles[0], page.Profiles[0])
+		AssertProfilesEqual(t, profiles[1], page.Profiles[1])
+
+		page, err = dao.QueryUsers(e.ctx, nil, page.OffsetToken, 2)
+		require.Nil(t, err)
+		require.Equal(t, 2, len(page.Profiles))
+		assert.Empty(t, page.OffsetToken)
+		AssertProfilesEqual(t, profiles[2], page.Profiles[0])
+		AssertProfilesEqual(t, profiles[3], page.Profiles[1])
+	}},
+
+	{"query users with non-positive limit", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(1, 2)))
+
+		for _, limit := range []int{0, -1} {
+			_, err := dao.QueryUsers(e.ctx, nil, "", limit)
+			assert.EqualError(t, err, fmt.Sprintf("limit should be positive, actual: %d", limit))
+		}
+	}},
+
+	{"query users with invalid offset token", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(1, 2, 3)))
+
+		page, err := dao.QueryUsers(e.ctx, nil, "", 1)
+		require.Nil(t, err)
+		token := page.OffsetToken
+
+		// flip characters of the valid token one by one, none of the results should be accepted
+		for i := 0; i < len(token); i++ {
+			c := byte('A')
+			if token[i] == c {
+				c = 'B'
+			}
+			tampered := token[:i] + string(c) + token[i+1:]
+			_, err := dao.QueryUsers(e.ctx, nil, tampered, 1)
+			assert.True(t, errors.Is(err, logic.ErrInvalidOffsetToken), "tampered token=%s, error: %v", tampered, err)
+		}
+
+		for _, malformed := range []string{"00000002", "2", "not a token"} {
+			_, err := dao.QueryUsers(e.ctx, nil, malformed, 1)
+			assert.True(t, errors.Is(err, logic.ErrInvalidOffsetToken), "malformed token=%s, error: %v", malformed, err)
+		}
+	}},
+
+	{"query users with filters and orders", func(t *testing.T, e *env) {
+		dao := e.dao
+
+		// IDs are added out of order, so that neither names nor creation times follow ID order
+		profiles := newQueryProfiles()
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		for _, query := range queryCases() {
+			expected := expectedIDs(profiles, query)
+			for _, limit := range []int{1, 4, 100} {
+				ids, _ := QueryIDs(t, dao, query, limit)
+				assert.Equal(t, expected, ids, "query=%s, limit=%d", query, limit)
+			}
+		}
+	}},
+
+	{"query users reflects updates and deletes", func(t *testing.T, e *env) {
+		dao := e.dao
+		profiles := newQueryProfiles()
+		require.Nil(t, dao.Add(e.ctx, profiles))
+
+		updated := *profiles[0]
+		updated.Name = "Zed"
+		updated.Roles = []string{logic.Roles[len(logic.Roles)-1]}
+		updated.Accounts = nil
+		updated.Created = time.Date(1999, time.January, 1, 0, 0, 0, 0, time.UTC)
+		require.Nil(t, dao.Update(e.ctx, &updated))
+		profiles[0] = &updated
+
+		require.Nil(t, dao.Delete(e.ctx, profiles[1].ID))
+		profiles = append(profiles[:1], profiles[2:]...)
+
+		for _, query := range append(queryCases(), &logic.UserQuery{Role: logic.Roles[len(logic.Roles)-1]}) {
+			ids, _ := QueryIDs(t, dao, query, 3)
+			assert.Equal(t, expectedIDs(profiles, query), ids, "query=%s", query)
+		}
+	}},
+
+	{"query users rejects offset token of another query", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, newQueryProfiles()))
+
+		page, err := dao.QueryUsers(e.ctx, &logic.UserQuery{Order: logic.OrderByName}, "", 1)
+		require.Nil(t, err)
+		require.NotEmpty(t, page.OffsetToken)
+
+		for _, query := range []*logic.UserQuery{
+			nil,
+			{Order: logic.OrderByCreated},
+			{Order: logic.OrderByName, NamePrefix: "A"},
+		} {
+			_, err := dao.QueryUsers(e.ctx, query, page.OffsetToken, 1)
+			assert.NotNil(t, err, "query=%s", query)
+		}
+	}},
+
+	{"operations give up once context is done", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(1, 2)))
+
+		ctx, cancel := context.WithCancel(e.ctx)
+		cancel()
+
+		assert.NotNil(t, dao.Add(ctx, NewProfiles(3)))
+		assert.NotNil(t, dao.Update(ctx, NewProfiles(1)[0]))
+		assert.NotNil(t, dao.Delete(ctx, 2))
+		_, err := dao.Get(ctx, 1)
+		assert.NotNil(t, err)
+		_, err = dao.FindByOauthAccount(ctx, "Google", "google-token-User A")
+		assert.NotNil(t, err)
+		_, err = dao.QueryUsers(ctx, nil, "", 10)
+		assert.NotNil(t, err)
+		_, _, err = dao.GetIDRange(ctx)
+		assert.NotNil(t, err)
+
+		ids, _ := QueryAllIDs(t, dao, 10)
+		assert.Equal(t, []int{1, 2}, ids, "cancelled writes should not be applied")
+	}},
+
+	{"query empty database", func(t *testing.T, e *env) {
+		page, err := e.dao.QueryUsers(e.ctx, nil, "", 10)
+		assert.Nil(t, err)
+		assert.Empty(t, page.Profiles)
+		assert.Empty(t, page.OffsetToken)
+	}},
+
+	{"id range", func(t *testing.T, e *env) {
+		dao := e.dao
+		require.Nil(t, dao.Add(e.ctx, NewProfiles(5, 3, 42, 7)))
+
+		from, to, err := dao.GetIDRange(e.ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, from)
+		assert.Equal(t, 42, to)
+	}},
+
+	{"id range of empty database", func(t *testing.T, e *env) {
+		from, to, err := e.dao.GetIDRange(e.ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, from)
+		assert.Equal(t, 0, to)
+	}},
+
+	{"close and reopen", func(t *testing.T, e *env) {
+		profiles := NewProfiles(1, 2)
+		require.Nil(t, e.dao.Add(e.ctx, profiles))
+
+		err := e.dao.Close()
+		e.dao = nil
+		require.Nil(t, err)
+
+		if !e.backend.Persistent {
+			return
+		}
+
+		dao, err := e.backend.Open(e.path)
+		require.Nil(t, err, "unable to reopen %s dao", e.backend.Name)
+		e.dao = dao
+
+		for _, p := range profiles {
+			actual, err := dao.Get(e.ctx, p.ID)
+			assert.Nil(t, err)
+			AssertProfilesEqual(t, p, actual)
+		}
+	}},
+}
+
+// newQueryProfiles creates profiles with distinct as well as duplicate names and creation times
+func newQueryProfiles() []*logic.UserProfile {
+	names := []string{"Bob", "Alice", "Bobby", "alice", "Carl", "Bob", "Al", "Dora", "Carla", "Bo", "Eve", "Alice"}
+	ids := []int{17, 3, 9, 1, 12, 25, 4, 30, 8, 2, 21, 14}
+	base := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	result := NewProfiles(ids...)
+	for i, p := range result {
+		p.Name = names[i]
+		p.Created = base.Add(time.Duration((i*7)%5) * 24 * time.Hour)
+	}
+	return result
+}
+
+func queryCases() []*logic.UserQuery {
+	from := time.Date(2010, time.March, 5, 5, 6, 7, 0, time.UTC)
+	to := from.Add(2 * 24 * time.Hour)
+	result := []*logic.UserQuery{nil}
+	for _, order := range []logic.UserOrder{logic.OrderByID, logic.OrderByName, logic.OrderByCreated} {
+		result = append(result,
+			&logic.UserQuery{Order: order},
+			&logic.UserQuery{Order: order, Role: logic.Roles[0]},
+			&logic.UserQuery{Order: order, Role: "MISSING"},
+			&logic.UserQuery{Order: order, Provider: "Google"},
+			&logic.UserQuery{Order: order, Provider: "VK", Role: logic.Roles[1]},
+			&logic.UserQuery{Order: order, CreatedFrom: from},
+			&logic.UserQuery{Order: order, CreatedTo: to},
+			&logic.UserQuery{Order: order, CreatedFrom: from, CreatedTo: to},
+			&logic.UserQuery{Order: order, NamePrefix: "Bo"},
+			&logic.UserQuery{Order: order, NamePrefix: "Alice"},
+			&logic.UserQuery{Order: order, NamePrefix: "Z"},
+			&logic.UserQuery{Order: order, NamePrefix: "A", Provider: "VK", CreatedTo: to},
+		)
+	}
+	return result
+}
+
+// expectedIDs returns IDs of profiles matching the query in the order of the query
+func expectedIDs(profiles []*logic.UserProfile, query *logic.UserQuery) []int {
+	matched := []*logic.UserProfile{}
+	for _, p := range profiles {
+		if query.Matches(p) {
+			matched = append(matched, p)
+		}
+	}
+
+	order := logic.OrderByID
+	if query != nil {
+		order = query.Order
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		switch {
+		case order == logic.OrderByName && a.Name != b.Name:
+			return a.Name < b.Name
+		case order == logic.OrderByCreated && !a.Created.Equal(b.Created):
+			return a.Created.Before(b.Created)
+		}
+		return a.ID < b.ID
+	})
+
+	var result []int
+	for _, p := range matched {
+		result = append(result, p.ID)
+	}
+	return result
+}
+
+func sortedRoles(p *logic.UserProfile) []string {
+	result := append([]string{}, p.Roles...)
+	sort.Strings(result)
+	return result
+}
+
+func sortedAccounts(p *logic.UserProfile) []*logic.OauthAccount {
+	result := append([]*logic.OauthAccount{}, p.Accounts...)
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Provider != result[j].Provider {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].Token < result[j].Token
+	})
+	return result
+}
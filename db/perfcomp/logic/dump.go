@@ -0,0 +1,211 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Dump formats
+const (
+	// JSONDumpFormat keeps every user profile as a JSON object on its own line
+	JSONDumpFormat = "json"
+
+	// ProtobufDumpFormat keeps every user profile as a protobuf message prefixed by its varint-encoded length
+	ProtobufDumpFormat = "protobuf"
+)
+
+// DumpFormats lists names of all the supported dump formats
+var DumpFormats = []string{JSONDumpFormat, ProtobufDumpFormat}
+
+// DumpWriter writes user profiles to a dump
+type DumpWriter interface {
+	Write(p *UserProfile) error
+
+	// Flush writes buffered profiles to the underlying writer
+	Flush() error
+}
+
+// DumpReader reads user profiles from a dump, io.EOF is returned once the dump ends
+type DumpReader interface {
+	Read() (*UserProfile, error)
+}
+
+// NewDumpWriter creates writer of the dump of the given format
+func NewDumpWriter(w io.Writer, format string) (DumpWriter, error) {
+	switch format {
+	case JSONDumpFormat:
+		return &jsonDumpWriter{w: bufio.NewWriter(w)}, nil
+	case ProtobufDumpFormat:
+		return &protobufDumpWriter{w: bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown dump format=%s, expected one of %s", format, DumpFormats)
+	}
+}
+
+// NewDumpReader creates reader of the dump of the given format
+func NewDumpReader(r io.Reader, format string) (DumpReader, error) {
+	switch format {
+	case JSONDumpFormat:
+		return &jsonDumpReader{r: bufio.NewReader(r)}, nil
+	case ProtobufDumpFormat:
+		return &protobufDumpReader{r: bufio.NewReader(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown dump format=%s, expected one of %s", format, DumpFormats)
+	}
+}
+
+// ExportUsers writes all the users of DAO to the dump in ascending order of IDs, so that the dump can be
+// imported in batches, and returns number of the exported users
+func ExportUsers(ctx context.Context, dao Dao, w DumpWriter, pageSize int) (int, error) {
+	count := 0
+	offsetToken := ""
+	for {
+		page, err := dao.QueryUsers(ctx, &UserQuery{Order: OrderByID}, offsetToken, pageSize)
+		if err != nil {
+			return count, fmt.Errorf("unable to query users after %d exported ones: %v", count, err)
+		}
+
+		for _, p := range page.Profiles {
+			if err := w.Write(p); err != nil {
+				return count, fmt.Errorf("unable to write profile with id=%d: %v", p.ID, err)
+			}
+			count++
+		}
+
+		if len(page.OffsetToken) == 0 {
+			return count, w.Flush()
+		}
+		offsetToken = page.OffsetToken
+	}
+}
+
+// ImportUsers loads all the users of the dump into DAO by means of BulkLoad
+func ImportUsers(ctx context.Context, dao Dao, r DumpReader, options *BulkLoadOptions) (*BulkLoadProgress, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// readErr is set before profiles are closed, so it is only safe to check once the load consumed all of them
+	var readErr error
+	profiles := make(chan *UserProfile, options.BatchSize)
+	go func() {
+		defer close(profiles)
+		for {
+			p, err := r.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+
+			select {
+			case profiles <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	progress, err := BulkLoad(ctx, dao, profiles, options)
+	if err == nil && readErr != nil {
+		err = fmt.Errorf("unable to read dump after id=%d: %v", progress.LastID, readErr)
+	}
+	return progress, err
+}
+
+//
+// Private
+//
+
+type jsonDumpWriter struct {
+	w *bufio.Writer
+}
+
+func (t *jsonDumpWriter) Write(p *UserProfile) error {
+	// compact JSON never contains new lines, so that they separate profiles
+	data, err := jsonCodec{}.Encode(p)
+	if err != nil {
+		return err
+	}
+	if _, err := t.w.Write(data); err != nil {
+		return err
+	}
+	return t.w.WriteByte('\n')
+}
+
+func (t *jsonDumpWriter) Flush() error {
+	return t.w.Flush()
+}
+
+type jsonDumpReader struct {
+	r *bufio.Reader
+}
+
+func (t *jsonDumpReader) Read() (*UserProfile, error) {
+	for {
+		line, err := t.r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			return nil, fmt.Errorf("unexpected end of dump after %d bytes of the last line", len(line))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// blank lines are tolerated, e.g. the ones added by text editors
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return jsonCodec{}.Decode(line)
+		}
+	}
+}
+
+type protobufDumpWriter struct {
+	w *bufio.Writer
+}
+
+func (t *protobufDumpWriter) Write(p *UserProfile) error {
+	data, err := protobufCodec{}.Encode(p)
+	if err != nil {
+		return err
+	}
+
+	size := binary.AppendUvarint(nil, uint64(len(data)))
+	if _, err := t.w.Write(size); err != nil {
+		return err
+	}
+	_, err = t.w.Write(data)
+	return err
+}
+
+func (t *protobufDumpWriter) Flush() error {
+	return t.w.Flush()
+}
+
+// maxDumpMessageSize limits size of a message of protobuf dump, so that a corrupted size does not make the reader
+// allocate gigabytes of memory
+const maxDumpMessageSize = 4 << 20
+
+type protobufDumpReader struct {
+	r *bufio.Reader
+}
+
+func (t *protobufDumpReader) Read() (*UserProfile, error) {
+	size, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		// io.EOF is only returned if no bytes of the length were read
+		return nil, err
+	}
+	if size > maxDumpMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes, dump is corrupted?", size, maxDumpMessageSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(t.r, data); err != nil {
+		return nil, fmt.Errorf("unable to read message of %d bytes: %v", size, err)
+	}
+	return protobufCodec{}.Decode(data)
+}
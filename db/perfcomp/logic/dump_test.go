@@ -0,0 +1,89 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDump(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 891, time.UTC)
+	newDao := func(t *testing.T, count int) Dao {
+		dao := NewMemoryDao()
+		profiles := []*UserProfile{}
+		for id := 1; id <= count; id++ {
+			profiles = append(profiles, &UserProfile{ID: id, Name: fmt.Sprintf("User %d", id), Created: created,
+				Roles: []string{"READER"}, Accounts: []*OauthAccount{{Provider: "VK", Token: fmt.Sprintf("t%d", id), Created: created}}})
+		}
+		require.Nil(t, dao.Add(ctx, profiles))
+		return dao
+	}
+	export := func(t *testing.T, dao Dao, format string) []byte {
+		var buf bytes.Buffer
+		w, err := NewDumpWriter(&buf, format)
+		require.Nil(t, err)
+		count, err := ExportUsers(ctx, dao, w, 3)
+		require.Nil(t, err)
+		assert.Equal(t, 7, count)
+		return buf.Bytes()
+	}
+
+	for _, format := range DumpFormats {
+		t.Run(format, func(t *testing.T) {
+			t.Run("round-trip is lossless", func(t *testing.T) {
+				source := newDao(t, 7)
+				r, err := NewDumpReader(bytes.NewReader(export(t, source, format)), format)
+				require.Nil(t, err)
+
+				target := NewMemoryDao()
+				progress, err := ImportUsers(ctx, target, r, &BulkLoadOptions{BatchSize: 2})
+				require.Nil(t, err)
+				assert.Equal(t, 7, progress.Loaded)
+				assert.Equal(t, 4, progress.Batches)
+
+				for id := 1; id <= 7; id++ {
+					expected, err := source.Get(ctx, id)
+					require.Nil(t, err)
+					actual, err := target.Get(ctx, id)
+					require.Nil(t, err)
+					assert.Equal(t, expected, actual)
+				}
+			})
+
+			t.Run("truncated dump", func(t *testing.T) {
+				data := export(t, newDao(t, 7), format)
+				r, err := NewDumpReader(bytes.NewReader(data[:len(data)-3]), format)
+				require.Nil(t, err)
+
+				progress, err := ImportUsers(ctx, NewMemoryDao(), r, &BulkLoadOptions{BatchSize: 10})
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), "unable to read dump after id=6")
+				assert.Equal(t, 6, progress.Loaded, "profiles read before the error should be loaded")
+			})
+		})
+	}
+
+	t.Run("oversized protobuf message", func(t *testing.T) {
+		data := binary.AppendUvarint(nil, 1<<40)
+		r, err := NewDumpReader(bytes.NewReader(data), "protobuf")
+		require.Nil(t, err)
+
+		_, err = r.Read()
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "exceeds the limit")
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := NewDumpWriter(&bytes.Buffer{}, "csv")
+		assert.EqualError(t, err, "unknown dump format=csv, expected one of [json protobuf]")
+		_, err = NewDumpReader(&bytes.Buffer{}, "csv")
+		assert.EqualError(t, err, "unknown dump format=csv, expected one of [json protobuf]")
+	})
+}
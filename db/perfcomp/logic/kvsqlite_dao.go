@@ -1,16 +1,11 @@
 package logic
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/gob"
 	"fmt"
-	"log"
-	"strconv"
 
 	"github.com/avshabanov/go-code/db/sqlutil"
-	"github.com/mattn/go-sqlite3"
 )
 
 type kvSqliteDao struct {
@@ -18,8 +13,16 @@ type kvSqliteDao struct {
 
 	db         *sql.DB
 	insertUser *sql.Stmt
+	updateUser *sql.Stmt
+	deleteUser *sql.Stmt
 	queryUsers *sql.Stmt
 	getUser    *sql.Stmt
+
+	findByOauthAccount *sql.Stmt
+
+	codec         Codec
+	changes       changeNotifier
+	schemaVersion int // behind the latest one only if DB is opened for reading
 }
 
 const kvSqliteSchema = `
@@ -30,17 +33,44 @@ CREATE TABLE kv_users (
 );
 `
 
-// NewKvSqliteDao creates new DAO that uses sqlite in a key-value DB fashion
+// kvSqliteAccountsSchema defines oauth account index, values are opaque to sqlite, so the index is maintained
+// by DAO in the same transaction as users
+const kvSqliteAccountsSchema = `
+CREATE TABLE kv_oauth_accounts (
+	provider			VARCHAR(64) NOT NULL,
+	token					VARCHAR(256) NOT NULL,
+	user_id				INTEGER NOT NULL,
+	CONSTRAINT pk_kv_oauth_accounts PRIMARY KEY (provider, token)
+);
+
+CREATE INDEX idx_kv_oauth_accounts_user ON kv_oauth_accounts (user_id);
+`
+
+// kvSqliteMetaSchema defines table of DB-wide settings, such as codec of the stored values
+const kvSqliteMetaSchema = `
+CREATE TABLE IF NOT EXISTS kv_meta (
+	name					VARCHAR(64) NOT NULL,
+	value					VARCHAR(256) NOT NULL,
+	CONSTRAINT pk_kv_meta PRIMARY KEY (name)
+);
+`
+
+// NewKvSqliteDao creates new DAO that uses sqlite in a key-value DB fashion and keeps user profiles encoded with gob
 func NewKvSqliteDao(dbPath string) (Dao, error) {
-	version, versionNumber, sourceID := sqlite3.Version()
-	log.Printf("use sqlite3 dao: version=%s, versionNumber=%d, sourceID=%s", version, versionNumber, sourceID)
+	return NewKvSqliteDaoWithCodec(dbPath, gobCodec{})
+}
 
-	var err error
-	result := &kvSqliteDao{}
+// NewKvSqliteDaoWithCodec creates new DAO that uses sqlite in a key-value DB fashion and keeps user profiles
+// encoded with the given codec
+func NewKvSqliteDaoWithCodec(dbPath string, codec Codec) (Dao, error) {
+	return NewKvSqliteDaoWithTuning(dbPath, codec, sqliteTunings[0])
+}
 
-	if result.db, err = sql.Open("sqlite3", dbPath); err != nil {
-		return nil, err
-	}
+// NewKvSqliteDaoWithTuning creates new DAO that uses sqlite in a key-value DB fashion with the given connection
+// settings and keeps user profiles encoded with the given codec
+func NewKvSqliteDaoWithTuning(dbPath string, codec Codec, tuning *SqliteTuning) (Dao, error) {
+	var err error
+	result := &kvSqliteDao{db: openSqlite(dbPath, tuning), codec: codec}
 
 	// begin transaction that potentially might modify the DB schema
 	tx, err := result.db.BeginTx(context.Background(), &sql.TxOptions{
@@ -52,27 +82,46 @@ func NewKvSqliteDao(dbPath string) (Dao, error) {
 	}
 	defer tx.Rollback()
 
-	// at this point of time we may not be able to use prepared statements, so run simple query
-	r, err := tx.Query("SELECT * FROM kv_users LIMIT 1")
-	if err != nil {
-		log.Printf("Unable to access 'kv_users' table, looks like DB has not been initialized. Proceeding with init")
-		if _, err := tx.Exec(kvSqliteSchema); err != nil {
-			return nil, fmt.Errorf("can't create schema: %v", err)
+	if actualCodecName, initialized, err := getKvSqliteCodecName(tx); err != nil {
+		return nil, err
+	} else if initialized {
+		if err := checkStoredCodec(actualCodecName, codec); err != nil {
+			return nil, err
 		}
+	}
+
+	if tuning.ReadOnly {
+		result.schemaVersion, err = readSqliteSchemaVersion(tx, "kv_users", result.migrations())
 	} else {
-		log.Printf("The 'kv_users' table is ready for queries, skip initialization")
-		r.Close()
+		result.schemaVersion, err = migrateSqlite(tx, dbPath, "kv_users", result.migrations())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't migrate schema: %v", err)
 	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, err // unlikely
 	}
 
+	migrations := result.migrations()
+	if result.schemaVersion < migrations[len(migrations)-1].version {
+		// statements need the latest schema, so that DB opened for reading with pending migrations is only verified
+		return result, nil
+	}
+
 	if result.insertUser, err = result.db.Prepare("INSERT INTO kv_users (id, v) VALUES (?, ?)"); err != nil {
 		return nil, err
 	}
 
-	if result.queryUsers, err = result.db.Prepare("SELECT id, v FROM kv_users WHERE id>? ORDER BY id LIMIT ?"); err != nil {
+	if result.updateUser, err = result.db.Prepare("UPDATE kv_users SET v=? WHERE id=?"); err != nil {
+		return nil, err
+	}
+
+	if result.deleteUser, err = result.db.Prepare("DELETE FROM kv_users WHERE id=?"); err != nil {
+		return nil, err
+	}
+
+	if result.queryUsers, err = result.db.Prepare("SELECT id, v FROM kv_users WHERE id>=? ORDER BY id LIMIT ?"); err != nil {
 		return nil, err
 	}
 
@@ -80,6 +129,11 @@ func NewKvSqliteDao(dbPath string) (Dao, error) {
 		return nil, err
 	}
 
+	if result.findByOauthAccount, err = result.db.Prepare(
+		"SELECT u.id, u.v FROM kv_users AS u INNER JOIN kv_oauth_accounts AS a ON a.user_id=u.id WHERE a.provider=? AND a.token=?"); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
@@ -87,72 +141,158 @@ func (t *kvSqliteDao) Close() error {
 	return t.db.Close()
 }
 
-func (t *kvSqliteDao) Add(profiles []*UserProfile) error {
-	tx, err := t.db.Begin()
+func (t *kvSqliteDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	if err := t.checkStatements(); err != nil {
+		return err
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("unable to start tx: %v", err)
 	}
 	defer tx.Rollback()
 
-	insertStmt, err := tx.Prepare("INSERT INTO kv_users (id, v) VALUES (?, ?)")
+	insertStmt, err := tx.PrepareContext(ctx, "INSERT INTO kv_users (id, v) VALUES (?, ?)")
 	if err != nil {
 		return fmt.Errorf("unable to prepare insert stmt: %v", err)
 	}
 
 	for _, p := range profiles {
-		var valueBuf bytes.Buffer
-		encoder := gob.NewEncoder(&valueBuf)
-		if err := encoder.Encode(p); err != nil {
+		value, err := t.codec.Encode(p)
+		if err != nil {
 			return fmt.Errorf("unable to encode profile=%s, error: %v", p, err)
 		}
 
-		if _, err := insertStmt.Exec(p.ID, valueBuf.Bytes()); err != nil {
-			return fmt.Errorf("unable to add profile: %s, %v", p, err)
+		if _, err := insertStmt.ExecContext(ctx, p.ID, value); err != nil {
+			return fmt.Errorf("unable to add profile: %s, %w", p, expectNewProfile(err, p.ID))
 		}
+
+		if err := addKvSqliteAccounts(ctx, tx, p); err != nil {
+			return fmt.Errorf("unable to add profile: %s, %w", p, err)
+		}
+
+		if err := addSqliteChange(ctx, tx, newChange(ChangeAdd, p)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
-	return tx.Commit()
+	t.changes.notify()
+	return nil
 }
 
-func (t *kvSqliteDao) Get(id int) (*UserProfile, error) {
-	tx, err := t.db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelSerializable,
-		ReadOnly:  true,
-	})
+func (t *kvSqliteDao) Update(ctx context.Context, profile *UserProfile) error {
+	if err := t.checkStatements(); err != nil {
+		return err
+	}
+
+	value, err := t.codec.Encode(profile)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("unable to encode profile=%s, error: %v", profile, err)
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start tx: %v", err)
 	}
 	defer tx.Rollback()
 
-	getUser := tx.Stmt(t.getUser)
+	res, err := tx.StmtContext(ctx, t.updateUser).ExecContext(ctx, value, profile.ID)
+	if err != nil {
+		return fmt.Errorf("unable to update profile: %s, %v", profile, err)
+	}
 
-	var profile UserProfile
-	if err := sqlutil.SelectSingleValue(func(rows *sql.Rows) error {
-		var id int64
-		var v sql.RawBytes // []byte is safer, but RawBytes gives (theoretically) better performance
+	if err := expectAffectedRows(res, profile.ID); err != nil {
+		return err
+	}
 
-		if err := rows.Scan(&id, &v); err != nil {
-			return err
-		}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM kv_oauth_accounts WHERE user_id=?", profile.ID); err != nil {
+		return fmt.Errorf("unable to update profile: %s, %v", profile, err)
+	}
 
-		decoder := gob.NewDecoder(bytes.NewBuffer(v))
-		if err := decoder.Decode(&profile); err != nil {
-			return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
-		}
-		return nil
-	}, getUser, id); err != nil {
+	if err := addKvSqliteAccounts(ctx, tx, profile); err != nil {
+		return fmt.Errorf("unable to update profile: %s, %w", profile, err)
+	}
+
+	if err := addSqliteChange(ctx, tx, newChange(ChangeUpdate, profile)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
+}
+
+func (t *kvSqliteDao) Delete(ctx context.Context, id int) error {
+	if err := t.checkStatements(); err != nil {
+		return err
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM kv_oauth_accounts WHERE user_id=?", id); err != nil {
+		return fmt.Errorf("unable to delete profile {id: %d}: %v", id, err)
+	}
+
+	res, err := tx.StmtContext(ctx, t.deleteUser).ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("unable to delete profile {id: %d}: %v", id, err)
+	}
+
+	if err := expectAffectedRows(res, id); err != nil {
+		return err
+	}
+
+	if err := addSqliteChange(ctx, tx, newDeleteChange(id)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
+}
+
+func (t *kvSqliteDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	if err := t.checkStatements(); err != nil {
 		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
+	profile, err := t.selectProfile(ctx, t.getUser, id)
+	if err == sqlutil.ErrNoResults {
+		return nil, fmt.Errorf("there is no profile with id=%d: %w", id, ErrNotFound)
+	}
+	return profile, err
+}
+
+func (t *kvSqliteDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	if err := t.checkStatements(); err != nil {
 		return nil, err
 	}
 
-	return &profile, nil
+	profile, err := t.selectProfile(ctx, t.findByOauthAccount, provider, token)
+	if err == sqlutil.ErrNoResults {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %w", provider, token, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %v", provider, token, err)
+	}
+	return profile, nil
 }
 
-func (t *kvSqliteDao) GetIDRange() (from int, to int, err error) {
-	tx, err := t.db.BeginTx(context.Background(), &sql.TxOptions{
+func (t *kvSqliteDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  true,
 	})
@@ -161,12 +301,12 @@ func (t *kvSqliteDao) GetIDRange() (from int, to int, err error) {
 	}
 	defer tx.Rollback()
 
-	min, err := sqlutil.SelectSingleInt(tx, "SELECT MIN(id) FROM kv_users")
+	min, err := sqlutil.SelectSingleIntContext(ctx, tx, "SELECT COALESCE(MIN(id), 0) FROM kv_users")
 	if err != nil {
 		return 0, 0, err
 	}
 
-	max, err := sqlutil.SelectSingleInt(tx, "SELECT MAX(id) FROM kv_users")
+	max, err := sqlutil.SelectSingleIntContext(ctx, tx, "SELECT COALESCE(MAX(id), 0) FROM kv_users")
 	if err != nil {
 		return 0, 0, err
 	}
@@ -177,17 +317,25 @@ func (t *kvSqliteDao) GetIDRange() (from int, to int, err error) {
 
 	return min, max, nil
 }
-func (t *kvSqliteDao) QueryUsers(offsetToken string, limit int) (*UserPage, error) {
-	var err error
-	var startID int64
 
-	if len(offsetToken) > 0 {
-		if startID, err = strconv.ParseInt(offsetToken, 10, 32); err != nil {
-			return nil, fmt.Errorf("invalid offset token: %v", err)
-		}
+func (t *kvSqliteDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
+	if err := t.checkStatements(); err != nil {
+		return nil, err
 	}
 
-	tx, err := t.db.BeginTx(context.Background(), &sql.TxOptions{
+	c, err := newPageCollector(kvSqliteBackendTag, query, offsetToken, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// values are opaque to sqlite, so unless every user matches the query and users are sorted by ID,
+	// all the remaining rows have to be scanned
+	rowLimit := -1
+	if queryMatchesAll(query) && c.order == OrderByID {
+		rowLimit = c.limit + 1
+	}
+
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  true,
 	})
@@ -196,17 +344,14 @@ func (t *kvSqliteDao) QueryUsers(offsetToken string, limit int) (*UserPage, erro
 	}
 	defer tx.Rollback()
 
-	queryUsersStmt := tx.Stmt(t.queryUsers)
+	queryUsersStmt := tx.StmtContext(ctx, t.queryUsers)
 
-	rows, err := queryUsersStmt.Query(startID, limit+1)
+	rows, err := queryUsersStmt.QueryContext(ctx, c.startID(), rowLimit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result := &UserPage{}
-
-	rowsScanned := 0
 	for rows.Next() {
 		var id int64
 		var v sql.RawBytes // []byte is safer, but RawBytes gives (theoretically) better performance
@@ -215,24 +360,235 @@ func (t *kvSqliteDao) QueryUsers(offsetToken string, limit int) (*UserPage, erro
 			return nil, err
 		}
 
-		decoder := gob.NewDecoder(bytes.NewBuffer(v))
-		var p UserProfile
-		if err := decoder.Decode(&p); err != nil {
-			return nil, fmt.Errorf("unable to decode user profile value: offset=%d, offsetToken=%s, error=%v", rowsScanned, offsetToken, err)
+		p, err := t.codec.Decode(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode user profile value: id=%d, offsetToken=%s, error=%v", id, offsetToken, err)
 		}
-		result.Profiles = append(result.Profiles, &p)
 
-		rowsScanned++
-		if rowsScanned >= limit {
-			if rows.Next() {
-				if err := rows.Scan(&id, &v); err != nil {
-					return nil, err
-				}
-				result.OffsetToken = strconv.FormatInt(id, 10)
-			}
+		if c.add(p) {
 			break
 		}
 	}
 
-	return result, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return c.result(), nil
+}
+
+func (t *kvSqliteDao) Verify(ctx context.Context) (*VerifyReport, error) {
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to start tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	report := &VerifyReport{}
+	if err := verifySqliteIntegrity(ctx, tx, report); err != nil {
+		return nil, err
+	}
+	migrations := t.migrations()
+	if !report.verifySchemaVersion(t.schemaVersion, migrations[len(migrations)-1].version) {
+		return report, nil
+	}
+
+	for _, table := range []string{"kv_users", "kv_oauth_accounts", "kv_meta", "changes"} {
+		exists, err := hasSqliteTable(tx, table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			report.add(StorageCheck, "table=%s is missing", table)
+		}
+	}
+	if !report.OK() {
+		// the other checks need all the tables to be in place
+		return report, nil
+	}
+
+	accounts := newAccountIndexVerifier(report)
+	if err := verifySqliteRows(ctx, tx, "SELECT id, v FROM kv_users", func(rows *sql.Rows) error {
+		var id int
+		var v []byte
+		if err := rows.Scan(&id, &v); err != nil {
+			return err
+		}
+
+		p, err := t.codec.Decode(v)
+		if err != nil {
+			report.add(ValueCheck, "user id=%d can not be decoded with codec=%s: %v", id, t.codec.Name(), err)
+		} else {
+			report.verifyProfile(id, p)
+		}
+		accounts.addUser(id, p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := verifySqliteRows(ctx, tx, "SELECT provider, token, user_id FROM kv_oauth_accounts", func(rows *sql.Rows) error {
+		var provider, token string
+		var id int
+		if err := rows.Scan(&provider, &token, &id); err != nil {
+			return err
+		}
+		accounts.addEntry(accountKey(provider, token), id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	accounts.finish()
+
+	return report, nil
+}
+
+func (t *kvSqliteDao) ReadChanges(ctx context.Context, fromSeq uint64, limit int) ([]*Change, error) {
+	return readSqliteChanges(ctx, t.db, fromSeq, limit)
+}
+
+func (t *kvSqliteDao) LastChangeSeq(ctx context.Context) (uint64, error) {
+	return getSqliteLastChangeSeq(ctx, t.db)
+}
+
+func (t *kvSqliteDao) Subscribe(ctx context.Context, fromSeq uint64, fn func(c *Change) error) error {
+	return t.changes.subscribe(ctx, t.ReadChanges, fromSeq, fn)
+}
+
+//
+// Private
+//
+
+// checkStatements fails operations of DAO, that is opened for verification only, as their statements need the latest
+// schema and are not prepared then
+func (t *kvSqliteDao) checkStatements() error {
+	if t.getUser == nil {
+		return fmt.Errorf("schema version=%d is behind, opened for verification only", t.schemaVersion)
+	}
+	return nil
+}
+
+// migrations returns a registry of kvsqlite schema migrations, ordered by version
+func (t *kvSqliteDao) migrations() []*sqliteMigration {
+	return []*sqliteMigration{
+		{migration{1, "initial schema"}, execSqlite(kvSqliteSchema)},
+		{migration{2, "oauth account index"}, func(tx *sql.Tx) error {
+			// legacy databases might already have the index
+			if ok, err := hasSqliteTable(tx, "kv_oauth_accounts"); err != nil || ok {
+				return err
+			}
+			return buildKvSqliteAccountIndex(t.codec, tx)
+		}},
+		{migration{3, "codec metadata"}, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(kvSqliteMetaSchema); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT OR IGNORE INTO kv_meta (name, value) VALUES ('codec', ?)", t.codec.Name())
+			return err
+		}},
+		{migration{4, "change feed"}, execSqlite(sqliteChangesSchema)},
+	}
+}
+
+// getKvSqliteCodecName returns codec name recorded in DB, if any, and whether DB has been initialized
+func getKvSqliteCodecName(tx *sql.Tx) ([]byte, bool, error) {
+	if ok, err := hasSqliteTable(tx, "kv_meta"); err != nil {
+		return nil, false, err
+	} else if ok {
+		var result []byte
+		if err := tx.QueryRow("SELECT value FROM kv_meta WHERE name='codec'").Scan(&result); err != nil && err != sql.ErrNoRows {
+			return nil, false, err
+		}
+		return result, true, nil
+	}
+
+	ok, err := hasSqliteTable(tx, "kv_users")
+	return nil, ok, err
+}
+
+// selectProfile runs the given statement, that selects a single user
+func (t *kvSqliteDao) selectProfile(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (*UserProfile, error) {
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var profile *UserProfile
+	if err := sqlutil.SelectSingleValueContext(ctx, func(rows *sql.Rows) error {
+		var id int64
+		var v sql.RawBytes // []byte is safer, but RawBytes gives (theoretically) better performance
+
+		if err := rows.Scan(&id, &v); err != nil {
+			return err
+		}
+
+		var err error
+		if profile, err = t.codec.Decode(v); err != nil {
+			return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
+		}
+		return nil
+	}, tx.StmtContext(ctx, stmt), args...); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func addKvSqliteAccounts(ctx context.Context, tx *sql.Tx, p *UserProfile) error {
+	for _, a := range p.Accounts {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO kv_oauth_accounts (provider, token, user_id) VALUES (?, ?, ?)",
+			a.Provider,
+			a.Token,
+			p.ID); err != nil {
+			return expectFreeAccount(err, a)
+		}
+	}
+	return nil
+}
+
+// buildKvSqliteAccountIndex creates oauth account index and fills it with accounts of all the existing users
+func buildKvSqliteAccountIndex(codec Codec, tx *sql.Tx) error {
+	if _, err := tx.Exec(kvSqliteAccountsSchema); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, v FROM kv_users")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	profiles := []*UserProfile{}
+	for rows.Next() {
+		var id int64
+		var v []byte
+		if err := rows.Scan(&id, &v); err != nil {
+			return err
+		}
+
+		p, err := codec.Decode(v)
+		if err != nil {
+			return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
+		}
+		profiles = append(profiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range profiles {
+		if err := addKvSqliteAccounts(context.Background(), tx, p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,507 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type levelDbDao struct {
+	Dao
+
+	db            *leveldb.DB
+	codec         Codec
+	schemaVersion int // behind the latest one only if DB is opened for reading
+
+	// writeLock makes read-modify-write operations, such as writes that maintain oauth account index, atomic
+	writeLock sync.Mutex
+}
+
+// LevelDbOptions defines settings of LevelDB, zero values keep defaults of goleveldb
+type LevelDbOptions struct {
+	// ReadOnly opens the database for reading only, pending migrations are not applied to it then
+	ReadOnly bool
+}
+
+var (
+	// leveldb has no buckets, so key prefixes are used instead, user keys are followed by big-endian ID
+	levelDbMetaPrefix  = []byte("m/")
+	levelDbUsersPrefix = []byte("u/")
+
+	// oauth account keys are followed by accountKey and their values are big-endian IDs of the owning users
+	levelDbAccountsPrefix = []byte("a/")
+)
+
+// levelDbMigration is a migration of LevelDB schema, every migration is written in its own batch along with
+// the schema version
+type levelDbMigration struct {
+	migration
+	apply func(t *levelDbDao, batch *leveldb.Batch) error
+}
+
+// levelDbMigrations is a registry of LevelDB schema migrations, ordered by version
+var levelDbMigrations = []*levelDbMigration{
+	{migration{1, "initial schema"}, func(t *levelDbDao, batch *leveldb.Batch) error {
+		batch.Put(levelDbKey(levelDbMetaPrefix, versionName), versionValue)
+		return nil
+	}},
+	{migration{2, "oauth account index"}, func(t *levelDbDao, batch *leveldb.Batch) error {
+		return t.buildAccountIndex(batch)
+	}},
+	{migration{3, "codec metadata"}, func(t *levelDbDao, batch *leveldb.Batch) error {
+		batch.Put(levelDbKey(levelDbMetaPrefix, codecName), []byte(t.codec.Name()))
+		return nil
+	}},
+}
+
+// NewLevelDbDao creates DAO that uses LevelDB, a log-structured merge-tree key-value store, and keeps user profiles
+// encoded with gob
+func NewLevelDbDao(dbPath string) (Dao, error) {
+	return NewLevelDbDaoWithCodec(dbPath, gobCodec{})
+}
+
+// NewLevelDbDaoWithCodec creates DAO that uses LevelDB and keeps user profiles encoded with the given codec
+func NewLevelDbDaoWithCodec(dbPath string, codec Codec) (Dao, error) {
+	return NewLevelDbDaoWithOptions(dbPath, codec, &LevelDbOptions{})
+}
+
+// NewLevelDbDaoWithOptions creates DAO that uses LevelDB with the given settings and keeps user profiles encoded
+// with the given codec
+func NewLevelDbDaoWithOptions(dbPath string, codec Codec, options *LevelDbOptions) (Dao, error) {
+	var err error
+	result := &levelDbDao{codec: codec}
+
+	if result.db, err = leveldb.OpenFile(dbPath, &opt.Options{
+		ReadOnly:       options.ReadOnly,
+		ErrorIfMissing: options.ReadOnly,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to open DB: %v", err)
+	}
+
+	if err := result.checkCodec(); err != nil {
+		result.db.Close()
+		return nil, err
+	}
+
+	if options.ReadOnly {
+		result.schemaVersion, err = result.readSchemaVersion()
+	} else {
+		err = result.migrate(dbPath)
+	}
+	if err != nil {
+		result.db.Close()
+		return nil, fmt.Errorf("unable to perform initialization: %v", err)
+	}
+
+	return result, nil
+}
+
+func (t *levelDbDao) Close() error {
+	return t.db.Close()
+}
+
+func (t *levelDbDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	// writer might have waited for the lock longer than the caller is ready to wait
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	taken := map[string]int{} // accounts of the profiles being added
+	added := map[int]bool{}   // batch is not visible to the reads, so IDs of the profiles being added are tracked too
+	for _, p := range profiles {
+		exists, err := t.db.Has(levelDbUserKey(p.ID), nil)
+		if err != nil {
+			return fmt.Errorf("unable to add profile=%s, error: %v", p, err)
+		}
+		if exists || added[p.ID] {
+			return fmt.Errorf("unable to add profile=%s: %w", p, ErrAlreadyExists)
+		}
+		added[p.ID] = true
+
+		for _, a := range p.Accounts {
+			key := string(accountKey(a.Provider, a.Token))
+			if id, ok := taken[key]; ok && id != p.ID {
+				return fmt.Errorf("unable to add profile=%s: oauth account %s is already taken by user with id=%d: %w", p, a, id, ErrAccountTaken)
+			}
+			taken[key] = p.ID
+		}
+
+		if err := t.putProfile(batch, nil, p); err != nil {
+			return fmt.Errorf("unable to add profile=%s, error: %w", p, err)
+		}
+	}
+
+	if err := t.db.Write(batch, nil); err != nil {
+		return fmt.Errorf("unable to add profiles slice: %v", err)
+	}
+
+	return nil
+}
+
+func (t *levelDbDao) Update(ctx context.Context, profile *UserProfile) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	old, err := t.getProfile(profile.ID)
+	if err != nil {
+		return fmt.Errorf("unable to update profile=%s, error: %v", profile, err)
+	} else if old == nil {
+		return fmt.Errorf("unable to update profile with id=%d: %w", profile.ID, ErrNotFound)
+	}
+
+	batch := new(leveldb.Batch)
+	if err := t.putProfile(batch, old, profile); err != nil {
+		return fmt.Errorf("unable to update profile=%s, error: %w", profile, err)
+	}
+
+	if err := t.db.Write(batch, nil); err != nil {
+		return fmt.Errorf("unable to update profile=%s, error: %v", profile, err)
+	}
+
+	return nil
+}
+
+func (t *levelDbDao) Delete(ctx context.Context, id int) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	old, err := t.getProfile(id)
+	if err != nil {
+		return fmt.Errorf("unable to delete profile {id: %d}: %v", id, err)
+	} else if old == nil {
+		return fmt.Errorf("unable to delete profile with id=%d: %w", id, ErrNotFound)
+	}
+
+	batch := new(leveldb.Batch)
+	for _, a := range old.Accounts {
+		batch.Delete(levelDbKey(levelDbAccountsPrefix, accountKey(a.Provider, a.Token)))
+	}
+	batch.Delete(levelDbUserKey(id))
+
+	return t.db.Write(batch, nil)
+}
+
+func (t *levelDbDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	v, err := t.db.Get(levelDbUserKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("unable to get user {id: %d}: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get user {id: %d}: %v", id, err)
+	}
+
+	p, err := t.codec.Decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
+	}
+
+	return p, nil
+}
+
+func (t *levelDbDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	v, err := t.db.Get(levelDbKey(levelDbAccountsPrefix, accountKey(provider, token)), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %w", provider, token, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %v", provider, token, err)
+	}
+
+	// account and user entries are read separately rather than from one snapshot, so the user might be gone by now
+	return t.Get(ctx, int(binary.BigEndian.Uint32(v)))
+}
+
+func (t *levelDbDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	it := t.db.NewIterator(util.BytesPrefix(levelDbUsersPrefix), nil)
+	defer it.Release()
+
+	// unlike bolt, keys are sorted within the whole keyspace, so the range boundaries are found without full scan
+	if it.First() {
+		from = levelDbIDFromKey(it.Key())
+	}
+	if it.Last() {
+		to = levelDbIDFromKey(it.Key())
+	}
+
+	return from, to, it.Error()
+}
+
+func (t *levelDbDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
+	c, err := newPageCollector(levelDbBackendTag, query, offsetToken, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	it := t.db.NewIterator(util.BytesPrefix(levelDbUsersPrefix), nil)
+	defer it.Release()
+
+	for ok := it.Seek(levelDbUserKey(c.startID())); ok; ok = it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("unable to query users: %v", err)
+		}
+
+		p, err := t.codec.Decode(it.Value())
+		if err != nil {
+			return nil, fmt.Errorf("unable to query users: unable to decode user profile value: id=%d, offsetToken=%s, error=%v", levelDbIDFromKey(it.Key()), offsetToken, err)
+		}
+
+		if c.add(p) {
+			break
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return nil, fmt.Errorf("unable to query users: %v", err)
+	}
+
+	return c.result(), nil
+}
+
+func (t *levelDbDao) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	// snapshot keeps users and index entries consistent with each other while they are iterated
+	snapshot, err := t.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	if _, err := snapshot.Get(levelDbKey(levelDbMetaPrefix, versionName), nil); err != nil {
+		report.add(StorageCheck, "version metadata can not be read: %v", err)
+	}
+	if !report.verifySchemaVersion(t.schemaVersion, levelDbMigrations[len(levelDbMigrations)-1].version) {
+		return report, nil
+	}
+
+	accounts := newAccountIndexVerifier(report)
+	it := snapshot.NewIterator(util.BytesPrefix(levelDbUsersPrefix), nil)
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			it.Release()
+			return nil, err
+		}
+
+		id := levelDbIDFromKey(it.Key())
+		p, err := t.codec.Decode(it.Value())
+		if err != nil {
+			report.add(ValueCheck, "user id=%d can not be decoded with codec=%s: %v", id, t.codec.Name(), err)
+		} else {
+			report.verifyProfile(id, p)
+		}
+		accounts.addUser(id, p)
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		// corrupted tables and journals surface as iteration errors
+		report.add(StorageCheck, "users can not be read: %v", err)
+		return report, nil
+	}
+
+	it = snapshot.NewIterator(util.BytesPrefix(levelDbAccountsPrefix), nil)
+	for it.Next() {
+		key := append([]byte{}, it.Key()[len(levelDbAccountsPrefix):]...)
+		if len(it.Value()) != 4 {
+			provider, token := splitAccountKey(key)
+			report.add(ValueCheck, "account provider=%s, token=%s has malformed user id=%x", provider, token, it.Value())
+			continue
+		}
+		accounts.addEntry(key, int(binary.BigEndian.Uint32(it.Value())))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		report.add(StorageCheck, "oauth account index can not be read: %v", err)
+		return report, nil
+	}
+	accounts.finish()
+
+	return report, nil
+}
+
+//
+// Private
+//
+
+// getProfile returns stored profile with the given ID or nil if there is no such profile
+func (t *levelDbDao) getProfile(id int) (*UserProfile, error) {
+	v, err := t.db.Get(levelDbUserKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	p, err := t.codec.Decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode user profile value: id=%d, error=%v", id, err)
+	}
+
+	return p, nil
+}
+
+// putProfile adds writes of the profile and its oauth account index entries to the batch, index entries of
+// the old profile are replaced unless it is nil
+func (t *levelDbDao) putProfile(batch *leveldb.Batch, old *UserProfile, p *UserProfile) error {
+	value, err := t.codec.Encode(p)
+	if err != nil {
+		return fmt.Errorf("unable to encode profile: %v", err)
+	}
+
+	if old != nil {
+		for _, a := range old.Accounts {
+			batch.Delete(levelDbKey(levelDbAccountsPrefix, accountKey(a.Provider, a.Token)))
+		}
+	}
+
+	for _, a := range p.Accounts {
+		key := levelDbKey(levelDbAccountsPrefix, accountKey(a.Provider, a.Token))
+		v, err := t.db.Get(key, nil)
+		if err == nil && int(binary.BigEndian.Uint32(v)) != p.ID {
+			return fmt.Errorf("oauth account %s is already taken by user with id=%d: %w", a, binary.BigEndian.Uint32(v), ErrAccountTaken)
+		} else if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+
+		batch.Put(key, getBytesFromID(p.ID))
+	}
+
+	batch.Put(levelDbUserKey(p.ID), value)
+	return nil
+}
+
+// checkCodec fails if DB keeps values encoded with another codec
+func (t *levelDbDao) checkCodec() error {
+	if ok, err := t.db.Has(levelDbKey(levelDbMetaPrefix, versionName), nil); err != nil {
+		return fmt.Errorf("unable to perform initialization: %v", err)
+	} else if !ok {
+		return nil // fresh DB
+	}
+
+	actualCodecName, err := t.db.Get(levelDbKey(levelDbMetaPrefix, codecName), nil)
+	if err == leveldb.ErrNotFound {
+		actualCodecName, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to perform initialization: %v", err)
+	}
+	return checkStoredCodec(actualCodecName, t.codec)
+}
+
+// migrate applies pending migrations, one batch per migration
+func (t *levelDbDao) migrate(dbPath string) error {
+	version, err := t.readSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	t.schemaVersion = version
+	for _, m := range levelDbMigrations {
+		if m.version <= version {
+			continue
+		}
+
+		logMigration(dbPath, m.migration)
+		batch := new(leveldb.Batch)
+		if err := m.apply(t, batch); err != nil {
+			return fmt.Errorf("unable to apply migration %s: %v", m, err)
+		}
+
+		batch.Put(levelDbKey(levelDbMetaPrefix, schemaVersionName), encodeSchemaVersion(m.version))
+		if err := t.db.Write(batch, nil); err != nil {
+			return fmt.Errorf("unable to apply migration %s: %v", m, err)
+		}
+		t.schemaVersion = m.version
+	}
+
+	return nil
+}
+
+// readSchemaVersion returns schema version of the DB without applying pending migrations
+func (t *levelDbDao) readSchemaVersion() (int, error) {
+	version, err := t.getSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	return version, checkSchemaVersion(version, levelDbMigrations[len(levelDbMigrations)-1].version)
+}
+
+func (t *levelDbDao) getSchemaVersion() (int, error) {
+	v, err := t.db.Get(levelDbKey(levelDbMetaPrefix, schemaVersionName), nil)
+	if err == nil {
+		return decodeSchemaVersion(v)
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+
+	// databases created before migrations were introduced are only told apart by the version string
+	actualVersionValue, err := t.db.Get(levelDbKey(levelDbMetaPrefix, versionName), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil // fresh DB
+	} else if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(versionValue, actualVersionValue) {
+		return 0, fmt.Errorf("version mismatch, expected: %s, actual: %s", versionValue, actualVersionValue)
+	}
+	return legacySchemaVersion, nil
+}
+
+// buildAccountIndex adds oauth account index entries of all the existing users to the batch
+func (t *levelDbDao) buildAccountIndex(batch *leveldb.Batch) error {
+	it := t.db.NewIterator(util.BytesPrefix(levelDbUsersPrefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		p, err := t.codec.Decode(it.Value())
+		if err != nil {
+			return fmt.Errorf("unable to decode user profile value: id=%d, error=%v", levelDbIDFromKey(it.Key()), err)
+		}
+
+		for _, a := range p.Accounts {
+			batch.Put(levelDbKey(levelDbAccountsPrefix, accountKey(a.Provider, a.Token)), getBytesFromID(p.ID))
+		}
+	}
+	return it.Error()
+}
+
+func levelDbKey(prefix []byte, key []byte) []byte {
+	result := make([]byte, 0, len(prefix)+len(key))
+	return append(append(result, prefix...), key...)
+}
+
+func levelDbUserKey(id int) []byte {
+	return levelDbKey(levelDbUsersPrefix, getBytesFromID(id))
+}
+
+func levelDbIDFromKey(key []byte) int {
+	return int(binary.BigEndian.Uint32(key[len(levelDbUsersPrefix):]))
+}
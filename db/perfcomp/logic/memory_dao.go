@@ -0,0 +1,234 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type memoryDao struct {
+	Dao
+
+	lock     sync.RWMutex
+	ids      []int // sorted IDs of all the stored profiles
+	profiles map[int]*UserProfile
+	accounts map[string]int // IDs of users owning oauth accounts, keyed by accountKey
+}
+
+// NewMemoryDao creates DAO that keeps user profiles in memory, it is meant to be used as a baseline for
+// performance measurements and as a reference implementation in correctness tests
+func NewMemoryDao() Dao {
+	return &memoryDao{profiles: map[int]*UserProfile{}, accounts: map[string]int{}}
+}
+
+func (t *memoryDao) Close() error {
+	return nil
+}
+
+func (t *memoryDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// writer might have waited for the lock longer than the caller is ready to wait
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// check all the accounts upfront, so that failed add leaves no partial changes
+	taken := map[string]int{}
+	added := map[int]bool{}
+	for _, p := range profiles {
+		if _, ok := t.profiles[p.ID]; ok || added[p.ID] {
+			return fmt.Errorf("unable to add profile=%s: %w", p, ErrAlreadyExists)
+		}
+		added[p.ID] = true
+
+		for _, a := range p.Accounts {
+			key := string(accountKey(a.Provider, a.Token))
+			if id, ok := taken[key]; ok && id != p.ID {
+				return fmt.Errorf("unable to add profile=%s: oauth account %s is already taken by user with id=%d: %w", p, a, id, ErrAccountTaken)
+			}
+			if err := t.checkAccount(p, a); err != nil {
+				return fmt.Errorf("unable to add profile=%s: %w", p, err)
+			}
+			taken[key] = p.ID
+		}
+	}
+
+	for _, p := range profiles {
+		t.insertID(p.ID)
+		t.profiles[p.ID] = copyUserProfile(p)
+		t.indexAccounts(p)
+	}
+
+	return nil
+}
+
+func (t *memoryDao) Update(ctx context.Context, profile *UserProfile) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	old, ok := t.profiles[profile.ID]
+	if !ok {
+		return fmt.Errorf("unable to update profile with id=%d: %w", profile.ID, ErrNotFound)
+	}
+
+	for _, a := range profile.Accounts {
+		if err := t.checkAccount(profile, a); err != nil {
+			return fmt.Errorf("unable to update profile=%s: %w", profile, err)
+		}
+	}
+
+	t.unindexAccounts(old)
+	t.profiles[profile.ID] = copyUserProfile(profile)
+	t.indexAccounts(profile)
+	return nil
+}
+
+func (t *memoryDao) Delete(ctx context.Context, id int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	old, ok := t.profiles[id]
+	if !ok {
+		return fmt.Errorf("unable to delete profile with id=%d: %w", id, ErrNotFound)
+	}
+
+	t.unindexAccounts(old)
+	delete(t.profiles, id)
+	pos := sort.SearchInts(t.ids, id)
+	t.ids = append(t.ids[:pos], t.ids[pos+1:]...)
+	return nil
+}
+
+func (t *memoryDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p, ok := t.profiles[id]
+	if !ok {
+		return nil, fmt.Errorf("unable to get user {id: %d}: %w", id, ErrNotFound)
+	}
+
+	return copyUserProfile(p), nil
+}
+
+func (t *memoryDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	id, ok := t.accounts[string(accountKey(provider, token))]
+	if !ok {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %w", provider, token, ErrNotFound)
+	}
+
+	return copyUserProfile(t.profiles[id]), nil
+}
+
+func (t *memoryDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if len(t.ids) == 0 {
+		return 0, 0, nil
+	}
+
+	return t.ids[0], t.ids[len(t.ids)-1], nil
+}
+
+func (t *memoryDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
+	c, err := newPageCollector(memoryBackendTag, query, offsetToken, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for pos := sort.SearchInts(t.ids, c.startID()); pos < len(t.ids); pos++ {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("unable to query users: %v", err)
+		}
+
+		if c.add(t.profiles[t.ids[pos]]) {
+			break
+		}
+	}
+
+	result := c.result()
+	for i, p := range result.Profiles {
+		result.Profiles[i] = copyUserProfile(p)
+	}
+
+	return result, nil
+}
+
+//
+// Private
+//
+
+func (t *memoryDao) insertID(id int) {
+	n := len(t.ids)
+	if n == 0 || t.ids[n-1] < id {
+		t.ids = append(t.ids, id) // fast path for sequentially added profiles
+		return
+	}
+
+	pos := sort.SearchInts(t.ids, id)
+	t.ids = append(t.ids, 0)
+	copy(t.ids[pos+1:], t.ids[pos:])
+	t.ids[pos] = id
+}
+
+// checkAccount makes sure that the given oauth account is not owned by any user but the given one
+func (t *memoryDao) checkAccount(p *UserProfile, a *OauthAccount) error {
+	if id, ok := t.accounts[string(accountKey(a.Provider, a.Token))]; ok && id != p.ID {
+		return fmt.Errorf("oauth account %s is already taken by user with id=%d: %w", a, id, ErrAccountTaken)
+	}
+	return nil
+}
+
+func (t *memoryDao) indexAccounts(p *UserProfile) {
+	for _, a := range p.Accounts {
+		t.accounts[string(accountKey(a.Provider, a.Token))] = p.ID
+	}
+}
+
+func (t *memoryDao) unindexAccounts(p *UserProfile) {
+	for _, a := range p.Accounts {
+		delete(t.accounts, string(accountKey(a.Provider, a.Token)))
+	}
+}
+
+// copyUserProfile makes a deep copy of the given profile, so that callers never share state with the DAO
+func copyUserProfile(p *UserProfile) *UserProfile {
+	result := *p
+	result.Roles = append([]string(nil), p.Roles...)
+	result.Accounts = nil
+	for _, a := range p.Accounts {
+		account := *a
+		result.Accounts = append(result.Accounts, &account)
+	}
+	return &result
+}
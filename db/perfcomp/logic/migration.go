@@ -0,0 +1,134 @@
+package logic
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/avshabanov/go-code/db/sqlutil"
+)
+
+// migration is a versioned up-step of DB schema, every backend keeps a registry of its migrations ordered by
+// version, migrations above the version recorded in the DB are applied at open time, so that databases created
+// by older builds are upgraded in place
+type migration struct {
+	version     int
+	description string
+}
+
+// legacySchemaVersion is a version of databases created before migrations were introduced, their schema is assumed
+// to be the initial one, so every later migration has to tolerate changes that such databases might already have
+const legacySchemaVersion = 1
+
+// schemaVersionName is a key of the schema version in metadata of key-value backends
+var schemaVersionName = []byte("schema_version")
+
+func (t migration) String() string {
+	return fmt.Sprintf("version=%d (%s)", t.version, t.description)
+}
+
+// checkSchemaVersion fails if the DB has been created or upgraded by a newer build, whose schema is unknown
+func checkSchemaVersion(version int, latest int) error {
+	if version > latest {
+		return fmt.Errorf("schema version=%d is newer than the latest supported version=%d", version, latest)
+	}
+	return nil
+}
+
+func logMigration(dbPath string, m migration) {
+	log.Printf("apply migration %s to db=%s", m, dbPath)
+}
+
+func encodeSchemaVersion(version int) []byte {
+	return []byte(strconv.Itoa(version))
+}
+
+func decodeSchemaVersion(value []byte) (int, error) {
+	version, err := strconv.Atoi(string(value))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("malformed schema version=%q", value)
+	}
+	return version, nil
+}
+
+// sqliteMigration is a migration of sqlite-based backends, all the pending migrations are applied in one transaction
+type sqliteMigration struct {
+	migration
+	apply func(tx *sql.Tx) error
+}
+
+// sqliteSchemaVersionSchema defines table that keeps a single row with schema version of sqlite-based backends
+const sqliteSchemaVersionSchema = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version				INTEGER NOT NULL
+);
+`
+
+// execSqlite returns migration step that runs the given statements
+func execSqlite(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// migrateSqlite applies pending migrations within the given transaction and returns the resulting schema version,
+// legacyTable is a table that is present in every DB created before migrations were introduced
+func migrateSqlite(tx *sql.Tx, dbPath string, legacyTable string, migrations []*sqliteMigration) (int, error) {
+	version, err := readSqliteSchemaVersion(tx, legacyTable, migrations)
+	if err != nil {
+		return 0, err
+	}
+
+	initialVersion := version
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		logMigration(dbPath, m.migration)
+		if err := m.apply(tx); err != nil {
+			return 0, fmt.Errorf("unable to apply migration %s: %v", m, err)
+		}
+		version = m.version
+	}
+
+	if version == initialVersion {
+		return version, nil
+	}
+
+	if _, err := tx.Exec(sqliteSchemaVersionSchema + "DELETE FROM schema_version;"); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version)
+	return version, err
+}
+
+// readSqliteSchemaVersion returns schema version of the DB without applying pending migrations, it is used for DBs
+// opened for reading only
+func readSqliteSchemaVersion(tx *sql.Tx, legacyTable string, migrations []*sqliteMigration) (int, error) {
+	version, err := getSqliteSchemaVersion(tx, legacyTable)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get schema version: %v", err)
+	}
+	return version, checkSchemaVersion(version, migrations[len(migrations)-1].version)
+}
+
+func getSqliteSchemaVersion(tx *sql.Tx, legacyTable string) (int, error) {
+	if ok, err := hasSqliteTable(tx, "schema_version"); err != nil {
+		return 0, err
+	} else if ok {
+		return sqlutil.SelectSingleInt(tx, "SELECT version FROM schema_version")
+	}
+
+	if ok, err := hasSqliteTable(tx, legacyTable); err != nil || !ok {
+		return 0, err // fresh DB
+	}
+	return legacySchemaVersion, nil
+}
+
+func hasSqliteTable(tx *sql.Tx, name string) (bool, error) {
+	n, err := sqlutil.SelectSingleInt(tx, "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", name)
+	return n > 0, err
+}
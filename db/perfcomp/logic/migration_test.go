@@ -0,0 +1,250 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+	newProfiles := func() []*UserProfile {
+		return []*UserProfile{
+			{ID: 1, Name: "Alice", Created: created, Roles: []string{"ADMIN"},
+				Accounts: []*OauthAccount{{Provider: "Google", Token: "t1", Created: created}}},
+			{ID: 2, Name: "Bob", Created: created, Roles: []string{"READER"},
+				Accounts: []*OauthAccount{{Provider: "VK", Token: "t2", Created: created}}},
+		}
+	}
+
+	for _, b := range []struct {
+		*testBackend
+		openReadOnly func(path string) (Dao, error)
+		versions     []int
+		// legacy turns DB into the one created before migrations and the latest indexes were introduced
+		legacy     func(dao Dao) error
+		setVersion func(dao Dao, version int) error
+	}{
+		{
+			testBackend: testSqlite,
+			openReadOnly: func(path string) (Dao, error) {
+				return NewSqliteDaoWithTuning(path, &SqliteTuning{ReadOnly: true})
+			},
+			versions: getSqliteMigrationVersions(sqliteMigrations),
+			legacy: func(dao Dao) error {
+				return execSqliteTx(dao.(*sqliteDao).db, "DROP TABLE schema_version; DROP INDEX idx_oauth_accounts_account;")
+			},
+			setVersion: func(dao Dao, version int) error {
+				return execSqliteTx(dao.(*sqliteDao).db, fmt.Sprintf("UPDATE schema_version SET version=%d", version))
+			},
+		},
+		{
+			testBackend: testKvSqlite,
+			openReadOnly: func(path string) (Dao, error) {
+				return NewKvSqliteDaoWithTuning(path, gobCodec{}, &SqliteTuning{ReadOnly: true})
+			},
+			versions: getSqliteMigrationVersions((&kvSqliteDao{codec: gobCodec{}}).migrations()),
+			legacy: func(dao Dao) error {
+				return execSqliteTx(dao.(*kvSqliteDao).db, "DROP TABLE schema_version; DROP TABLE kv_oauth_accounts; DROP TABLE kv_meta;")
+			},
+			setVersion: func(dao Dao, version int) error {
+				return execSqliteTx(dao.(*kvSqliteDao).db, fmt.Sprintf("UPDATE schema_version SET version=%d", version))
+			},
+		},
+		{
+			testBackend: testBolt,
+			openReadOnly: func(path string) (Dao, error) {
+				return NewBoltDaoWithOptions(path, gobCodec{}, &BoltOptions{ReadOnly: true})
+			},
+			versions: func() []int {
+				result := []int{}
+				for _, m := range boltMigrations {
+					result = append(result, m.version)
+				}
+				return result
+			}(),
+			legacy: func(dao Dao) error {
+				return dao.(*boltDao).db.Update(func(tx *bolt.Tx) error {
+					for _, index := range boltIndexes {
+						if err := tx.DeleteBucket(index.bucket); err != nil {
+							return err
+						}
+					}
+					if err := tx.Bucket(bucketMeta).Delete(codecName); err != nil {
+						return err
+					}
+					return tx.Bucket(bucketMeta).Delete(schemaVersionName)
+				})
+			},
+			setVersion: func(dao Dao, version int) error {
+				return dao.(*boltDao).db.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(bucketMeta).Put(schemaVersionName, encodeSchemaVersion(version))
+				})
+			},
+		},
+		{
+			testBackend: testLevelDb,
+			openReadOnly: func(path string) (Dao, error) {
+				return NewLevelDbDaoWithOptions(path, gobCodec{}, &LevelDbOptions{ReadOnly: true})
+			},
+			versions: func() []int {
+				result := []int{}
+				for _, m := range levelDbMigrations {
+					result = append(result, m.version)
+				}
+				return result
+			}(),
+			legacy: func(dao Dao) error {
+				db := dao.(*levelDbDao).db
+				batch := new(leveldb.Batch)
+				it := db.NewIterator(util.BytesPrefix(levelDbAccountsPrefix), nil)
+				for it.Next() {
+					batch.Delete(append([]byte{}, it.Key()...))
+				}
+				it.Release()
+				batch.Delete(levelDbKey(levelDbMetaPrefix, codecName))
+				batch.Delete(levelDbKey(levelDbMetaPrefix, schemaVersionName))
+				return db.Write(batch, nil)
+			},
+			setVersion: func(dao Dao, version int) error {
+				return dao.(*levelDbDao).db.Put(levelDbKey(levelDbMetaPrefix, schemaVersionName), encodeSchemaVersion(version), nil)
+			},
+		},
+	} {
+		t.Run(b.name, func(t *testing.T) {
+			latest := b.versions[len(b.versions)-1]
+			openDao := func(t *testing.T) (Dao, string) {
+				path := filepath.Join(t.TempDir(), b.name+".db")
+				dao, err := b.open(path)
+				require.Nil(t, err)
+				require.Nil(t, dao.Add(ctx, newProfiles()))
+				return dao, path
+			}
+
+			t.Run("migrations are ordered by version", func(t *testing.T) {
+				for i, version := range b.versions {
+					assert.Equal(t, i+1, version)
+				}
+			})
+
+			t.Run("legacy database is upgraded in place", func(t *testing.T) {
+				dao, path := openDao(t)
+				require.Nil(t, b.legacy(dao))
+				require.Nil(t, dao.Close())
+
+				dao, err := b.open(path)
+				require.Nil(t, err)
+				defer dao.Close()
+
+				p, err := dao.FindByOauthAccount(ctx, "VK", "t2")
+				require.Nil(t, err)
+				assert.Equal(t, 2, p.ID)
+
+				duplicate := newProfiles()[1]
+				duplicate.ID = 3
+				assert.NotNil(t, dao.Add(ctx, []*UserProfile{duplicate}), "oauth account index should be unique")
+
+				if indexed, ok := dao.(IndexedDao); ok {
+					assert.Nil(t, indexed.VerifyIndexes())
+				}
+			})
+
+			t.Run("upgraded database is reopened without migrations", func(t *testing.T) {
+				dao, path := openDao(t)
+				require.Nil(t, dao.Close())
+
+				dao, err := b.open(path)
+				require.Nil(t, err)
+				defer dao.Close()
+
+				profile, err := dao.Get(ctx, 1)
+				require.Nil(t, err)
+				assert.Equal(t, "Alice", profile.Name)
+			})
+
+			t.Run("legacy database opened for reading is verified without migrations", func(t *testing.T) {
+				dao, path := openDao(t)
+				require.Nil(t, b.legacy(dao))
+				require.Nil(t, dao.Close())
+
+				for i := 0; i < 2; i++ {
+					dao, err := b.openReadOnly(path)
+					require.Nil(t, err)
+
+					report, err := dao.(VerifiableDao).Verify(ctx)
+					require.Nil(t, err)
+					assert.Equal(t, []*VerifyProblem{{
+						Check:  SchemaCheck,
+						Detail: fmt.Sprintf("schema version=%d is behind the latest version=%d", legacySchemaVersion, latest),
+					}}, report.Problems, "database should not be migrated by attempt=%d", i)
+
+					// operations of the outdated schema might fail, but never crash
+					assert.NotPanics(t, func() {
+						dao.Get(ctx, 1)
+						dao.FindByOauthAccount(ctx, "VK", "t2")
+						dao.QueryUsers(ctx, nil, "", 10)
+						dao.Add(ctx, newProfiles())
+						dao.Update(ctx, newProfiles()[0])
+						dao.Delete(ctx, 1)
+					})
+					require.Nil(t, dao.Close())
+				}
+			})
+
+			t.Run("upgraded database opened for reading is verified", func(t *testing.T) {
+				dao, path := openDao(t)
+				require.Nil(t, dao.Close())
+
+				dao, err := b.openReadOnly(path)
+				require.Nil(t, err)
+				defer dao.Close()
+
+				report, err := dao.(VerifiableDao).Verify(ctx)
+				require.Nil(t, err)
+				assert.True(t, report.OK(), "unexpected problems: %v", report.Problems)
+				assert.NotNil(t, dao.Delete(ctx, 1), "database should not be writable")
+			})
+
+			t.Run("database of newer schema version is rejected", func(t *testing.T) {
+				dao, path := openDao(t)
+				require.Nil(t, b.setVersion(dao, latest+1))
+				require.Nil(t, dao.Close())
+
+				_, err := b.open(path)
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), fmt.Sprintf("schema version=%d is newer than the latest supported version=%d", latest+1, latest))
+			})
+		})
+	}
+}
+
+func getSqliteMigrationVersions(migrations []*sqliteMigration) []int {
+	result := []int{}
+	for _, m := range migrations {
+		result = append(result, m.version)
+	}
+	return result
+}
+
+func execSqliteTx(db *sql.DB, statements string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(statements); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,99 @@
+package logic
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// Backend tags embedded into offset tokens, so that a token issued by one backend is never accepted by another
+const (
+	sqliteBackendTag   = "sqlite"
+	boltBackendTag     = "bolt"
+	kvSqliteBackendTag = "kvsqlite"
+	levelDbBackendTag  = "leveldb"
+	memoryBackendTag   = "memory"
+)
+
+// offsetTokenVersion is a version of offset token layout, it should be bumped whenever layout changes
+const offsetTokenVersion = 2
+
+// offsetTokenMacSize is a size of truncated HMAC appended to the offset token payload
+const offsetTokenMacSize = 8
+
+// offsetTokenKey is used to sign offset tokens; tokens are opaque to the clients and the signature is only meant
+// to detect tokens that were modified or made up by the clients, rather than to keep token contents secret
+var offsetTokenKey = []byte("perfcomp-offset-token")
+
+// encodeOffsetToken creates an opaque offset token that points to the first user of the next page.
+// Token layout before base64 encoding is: version byte, backend tag length byte, backend tag,
+// 4-byte query fingerprint, cursor key of the first user of the next page and truncated HMAC-SHA256 of
+// all the preceding bytes.
+func encodeOffsetToken(backendTag string, query *UserQuery, cursor []byte) string {
+	var buf bytes.Buffer
+	buf.WriteByte(offsetTokenVersion)
+	buf.WriteByte(byte(len(backendTag)))
+	buf.WriteString(backendTag)
+	buf.Write(queryFingerprint(query))
+	buf.Write(cursor)
+	buf.Write(offsetTokenMac(buf.Bytes()))
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// decodeOffsetToken returns cursor key of the first user of the page the given token points to, errors wrap
+// ErrInvalidOffsetToken
+func decodeOffsetToken(backendTag string, query *UserQuery, offsetToken string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.Strict().DecodeString(offsetToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOffsetToken, err)
+	}
+
+	if len(data) < 2+4+offsetTokenMacSize {
+		return nil, fmt.Errorf("%w: unexpected length=%d", ErrInvalidOffsetToken, len(data))
+	}
+
+	payload := data[:len(data)-offsetTokenMacSize]
+	if !hmac.Equal(offsetTokenMac(payload), data[len(payload):]) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidOffsetToken)
+	}
+
+	if payload[0] != offsetTokenVersion {
+		return nil, fmt.Errorf("%w: unsupported version=%d", ErrInvalidOffsetToken, payload[0])
+	}
+
+	tagLen := int(payload[1])
+	if len(payload) < 2+tagLen+4 {
+		return nil, fmt.Errorf("%w: unexpected length=%d", ErrInvalidOffsetToken, len(data))
+	}
+
+	if tag := string(payload[2 : 2+tagLen]); tag != backendTag {
+		return nil, fmt.Errorf("%w: issued by %s backend can not be used with %s backend", ErrInvalidOffsetToken, tag, backendTag)
+	}
+
+	if !bytes.Equal(payload[2+tagLen:2+tagLen+4], queryFingerprint(query)) {
+		return nil, fmt.Errorf("%w: issued for another query", ErrInvalidOffsetToken)
+	}
+
+	cursor := payload[2+tagLen+4:]
+	if _, _, err := splitCursorKey(queryOrder(query), cursor); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOffsetToken, err)
+	}
+
+	return cursor, nil
+}
+
+// checkPageLimit makes sure that every page may have at least one user, so that paging always makes progress
+func checkPageLimit(limit int) error {
+	if limit < 1 {
+		return fmt.Errorf("limit should be positive, actual: %d", limit)
+	}
+	return nil
+}
+
+func offsetTokenMac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, offsetTokenKey)
+	mac.Write(payload)
+	return mac.Sum(nil)[:offsetTokenMacSize]
+}
@@ -0,0 +1,72 @@
+package logic
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetToken(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, id := range []int{0, 1, 255, 65536, 1<<32 - 1} {
+			token := encodeOffsetToken(boltBackendTag, nil, getBytesFromID(id))
+			decoded, err := decodeOffsetToken(boltBackendTag, nil, token)
+			assert.Nil(t, err)
+			assert.Equal(t, getBytesFromID(id), decoded)
+		}
+	})
+
+	t.Run("round trip of sorted query", func(t *testing.T) {
+		p := &UserProfile{ID: 7, Name: "Alice Smith", Created: time.Date(2010, time.March, 1, 0, 0, 0, 0, time.UTC)}
+		for _, query := range []*UserQuery{{Order: OrderByName}, {Order: OrderByCreated, Role: "ADMIN"}} {
+			token := encodeOffsetToken(sqliteBackendTag, query, cursorKey(query.Order, p))
+			decoded, err := decodeOffsetToken(sqliteBackendTag, query, token)
+			assert.Nil(t, err)
+			assert.Equal(t, cursorKey(query.Order, p), decoded)
+		}
+	})
+
+	t.Run("token of another backend", func(t *testing.T) {
+		_, err := decodeOffsetToken(sqliteBackendTag, nil, encodeOffsetToken(boltBackendTag, nil, getBytesFromID(10)))
+		assert.EqualError(t, err, "invalid offset token: issued by bolt backend can not be used with sqlite backend")
+	})
+
+	t.Run("token of another query", func(t *testing.T) {
+		token := encodeOffsetToken(memoryBackendTag, &UserQuery{Role: "ADMIN"}, getBytesFromID(10))
+		_, err := decodeOffsetToken(memoryBackendTag, &UserQuery{Role: "USER"}, token)
+		assert.EqualError(t, err, "invalid offset token: issued for another query")
+		_, err = decodeOffsetToken(memoryBackendTag, nil, token)
+		assert.EqualError(t, err, "invalid offset token: issued for another query")
+	})
+
+	t.Run("tampered token", func(t *testing.T) {
+		data, _ := base64.RawURLEncoding.DecodeString(encodeOffsetToken(memoryBackendTag, nil, getBytesFromID(10)))
+		data[len(data)-offsetTokenMacSize-1]++ // point to the other ID
+		_, err := decodeOffsetToken(memoryBackendTag, nil, base64.RawURLEncoding.EncodeToString(data))
+		assert.EqualError(t, err, "invalid offset token: signature mismatch")
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		payload := append([]byte{offsetTokenVersion + 1, 4, 'b', 'o', 'l', 't'}, queryFingerprint(nil)...)
+		payload = append(payload, 0, 0, 0, 1)
+		token := base64.RawURLEncoding.EncodeToString(append(payload, offsetTokenMac(payload)...))
+		_, err := decodeOffsetToken(boltBackendTag, nil, token)
+		assert.EqualError(t, err, "invalid offset token: unsupported version=3")
+	})
+
+	t.Run("malformed cursor", func(t *testing.T) {
+		token := encodeOffsetToken(boltBackendTag, &UserQuery{Order: OrderByCreated}, getBytesFromID(10))
+		_, err := decodeOffsetToken(boltBackendTag, &UserQuery{Order: OrderByCreated}, token)
+		assert.EqualError(t, err, "invalid offset token: malformed created cursor key")
+	})
+
+	t.Run("malformed tokens", func(t *testing.T) {
+		for _, token := range []string{"00000009", "42", "!!!", "AAAA"} {
+			_, err := decodeOffsetToken(sqliteBackendTag, nil, token)
+			assert.True(t, errors.Is(err, ErrInvalidOffsetToken), "token=%s, error: %v", token, err)
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package logic
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserOrder defines order of users returned by QueryUsers
+type UserOrder int
+
+const (
+	// OrderByID sorts users by ID, this is the default order
+	OrderByID UserOrder = iota
+	// OrderByName sorts users by name and then by ID
+	OrderByName
+	// OrderByCreated sorts users by creation time and then by ID
+	OrderByCreated
+)
+
+func (o UserOrder) String() string {
+	switch o {
+	case OrderByID:
+		return "id"
+	case OrderByName:
+		return "name"
+	case OrderByCreated:
+		return "created"
+	default:
+		return fmt.Sprintf("UserOrder(%d)", int(o))
+	}
+}
+
+// UserQuery specifies users listed by QueryUsers, all the given criteria should be met and
+// zero value of UserQuery (as well as nil query) matches all users
+type UserQuery struct {
+	Role        string    // user should have the given role
+	Provider    string    // user should have an oauth account of the given provider
+	CreatedFrom time.Time // user should be created at or after the given time, unless it is zero
+	CreatedTo   time.Time // user should be created before the given time, unless it is zero
+	NamePrefix  string    // user name should start with the given prefix
+	Order       UserOrder
+}
+
+func (q *UserQuery) String() string {
+	if q == nil {
+		return "{}"
+	}
+	return fmt.Sprintf(
+		"{role: '%s', provider: '%s', createdFrom: '%s', createdTo: '%s', namePrefix: '%s', order: %s}",
+		q.Role,
+		q.Provider,
+		q.CreatedFrom,
+		q.CreatedTo,
+		q.NamePrefix,
+		q.Order,
+	)
+}
+
+// Matches tells whether given profile meets the query criteria
+func (q *UserQuery) Matches(p *UserProfile) bool {
+	if q == nil {
+		return true
+	}
+
+	if len(q.Role) > 0 && !hasRole(p, q.Role) {
+		return false
+	}
+
+	if len(q.Provider) > 0 && !hasProvider(p, q.Provider) {
+		return false
+	}
+
+	if !q.CreatedFrom.IsZero() && p.Created.Before(q.CreatedFrom) {
+		return false
+	}
+
+	if !q.CreatedTo.IsZero() && !p.Created.Before(q.CreatedTo) {
+		return false
+	}
+
+	return strings.HasPrefix(p.Name, q.NamePrefix)
+}
+
+//
+// Private
+//
+
+// queryMatchesAll tells whether the query has no criteria, i.e. it only defines the order of users
+func queryMatchesAll(q *UserQuery) bool {
+	return q == nil || (len(q.Role) == 0 && len(q.Provider) == 0 && q.CreatedFrom.IsZero() && q.CreatedTo.IsZero() && len(q.NamePrefix) == 0)
+}
+
+func queryOrder(q *UserQuery) UserOrder {
+	if q == nil {
+		return OrderByID
+	}
+	return q.Order
+}
+
+// queryFingerprint identifies query criteria, so that an offset token issued for one query is not accepted
+// for another
+func queryFingerprint(q *UserQuery) []byte {
+	var buf bytes.Buffer
+	if q != nil {
+		fmt.Fprintf(&buf, "%q|%q|%q|%d|", q.Role, q.Provider, q.NamePrefix, q.Order)
+		for _, t := range []time.Time{q.CreatedFrom, q.CreatedTo} {
+			if !t.IsZero() {
+				buf.Write(createdKey(t))
+			}
+			buf.WriteByte('|')
+		}
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return sum[:4]
+}
+
+// cursorKey returns a key of the given profile in the given order, keys of different profiles compare
+// with bytes.Compare in exactly the same way as profiles are sorted
+func cursorKey(order UserOrder, p *UserProfile) []byte {
+	switch order {
+	case OrderByName:
+		return stringKey(p.Name, p.ID)
+	case OrderByCreated:
+		return append(createdKey(p.Created), getBytesFromID(p.ID)...)
+	default:
+		return getBytesFromID(p.ID)
+	}
+}
+
+// stringKey creates a key, that consists of string value followed by zero byte and big-endian ID, so that shorter
+// values go before the longer ones that start with the same characters
+func stringKey(value string, id int) []byte {
+	result := make([]byte, 0, len(value)+5)
+	result = append(result, value...)
+	result = append(result, 0)
+	return append(result, getBytesFromID(id)...)
+}
+
+// accountKey creates a key that identifies oauth account, provider names never contain zero bytes
+func accountKey(provider string, token string) []byte {
+	result := make([]byte, 0, len(provider)+len(token)+1)
+	result = append(result, provider...)
+	result = append(result, 0)
+	return append(result, token...)
+}
+
+// createdKey represents time as big-endian nanoseconds with flipped sign bit, so that keys sort chronologically
+func createdKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano())^(1<<63))
+	return key
+}
+
+func timeFromCreatedKey(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)^(1<<63))).UTC()
+}
+
+// splitCursorKey returns sort value and ID encoded in the cursor key of the given order
+func splitCursorKey(order UserOrder, key []byte) (interface{}, int, error) {
+	if len(key) < 4 {
+		return nil, 0, fmt.Errorf("malformed cursor key")
+	}
+	id := int(binary.BigEndian.Uint32(key[len(key)-4:]))
+
+	switch order {
+	case OrderByName:
+		if len(key) < 5 || key[len(key)-5] != 0 {
+			return nil, 0, fmt.Errorf("malformed name cursor key")
+		}
+		return string(key[:len(key)-5]), id, nil
+	case OrderByCreated:
+		if len(key) != 12 {
+			return nil, 0, fmt.Errorf("malformed created cursor key")
+		}
+		return timeFromCreatedKey(key), id, nil
+	default:
+		if len(key) != 4 {
+			return nil, 0, fmt.Errorf("malformed id cursor key")
+		}
+		return id, id, nil
+	}
+}
+
+// prefixUpperBound returns the smallest string that is greater than every string starting with the given prefix,
+// or empty string if there is no such string
+func prefixUpperBound(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func hasRole(p *UserProfile, role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hasProvider(p *UserProfile, provider string) bool {
+	for _, a := range p.Accounts {
+		if a.Provider == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// pageCollector builds a page of users matching the query out of profiles visited in ID order, which is
+// the natural order of key-value backends. Pages sorted by ID are built as profiles are visited, while for the
+// other orders every profile has to be visited and only the first limit+1 matching ones past the cursor are kept
+// in a heap, so that a page costs a full scan, but not a sort of all matching profiles.
+type pageCollector struct {
+	query   *UserQuery
+	order   UserOrder
+	limit   int
+	tag     string
+	cursor  []byte       // cursor key of the first profile of the page, nil for the first page
+	matched *profileHeap // profiles of the page followed by the first profile of the next one, unless sorted by ID
+	page    UserPage
+}
+
+func newPageCollector(backendTag string, query *UserQuery, offsetToken string, limit int) (*pageCollector, error) {
+	if err := checkPageLimit(limit); err != nil {
+		return nil, err
+	}
+
+	result := &pageCollector{
+		query:   query,
+		order:   queryOrder(query),
+		limit:   limit,
+		tag:     backendTag,
+		matched: &profileHeap{},
+	}
+
+	if len(offsetToken) > 0 {
+		var err error
+		if result.cursor, err = decodeOffsetToken(backendTag, query, offsetToken); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// startID returns ID the visiting of profiles in ID order should start from
+func (c *pageCollector) startID() int {
+	if c.order != OrderByID || c.cursor == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(c.cursor))
+}
+
+// add takes the next visited profile and returns true when no more profiles are needed
+func (c *pageCollector) add(p *UserProfile) bool {
+	if !c.query.Matches(p) {
+		return false
+	}
+
+	if c.order != OrderByID {
+		c.keep(p)
+		return false
+	}
+
+	if len(c.page.Profiles) >= c.limit {
+		c.page.OffsetToken = encodeOffsetToken(c.tag, c.query, cursorKey(c.order, p))
+		return true
+	}
+
+	c.page.Profiles = append(c.page.Profiles, p)
+	return false
+}
+
+// result returns the page built out of the visited profiles
+func (c *pageCollector) result() *UserPage {
+	if c.order == OrderByID {
+		return &c.page
+	}
+
+	sort.Sort(sort.Reverse(c.matched))
+	for i, p := range c.matched.profiles {
+		if i == c.limit {
+			c.page.OffsetToken = encodeOffsetToken(c.tag, c.query, c.matched.keys[i])
+			break
+		}
+		c.page.Profiles = append(c.page.Profiles, p)
+	}
+
+	return &c.page
+}
+
+// keep adds matching profile to the heap unless it precedes the cursor or limit+1 profiles preceding it are kept
+func (c *pageCollector) keep(p *UserProfile) {
+	key := cursorKey(c.order, p)
+	if c.cursor != nil && bytes.Compare(key, c.cursor) < 0 {
+		return
+	}
+
+	if c.matched.Len() <= c.limit {
+		heap.Push(c.matched, &keyedProfile{key: key, profile: p})
+		return
+	}
+	if bytes.Compare(key, c.matched.keys[0]) < 0 {
+		c.matched.keys[0], c.matched.profiles[0] = key, p
+		heap.Fix(c.matched, 0)
+	}
+}
+
+// profileHeap is a max-heap of profiles by their cursor keys
+type profileHeap struct {
+	profiles []*UserProfile
+	keys     [][]byte
+}
+
+type keyedProfile struct {
+	key     []byte
+	profile *UserProfile
+}
+
+func (h *profileHeap) Len() int           { return len(h.keys) }
+func (h *profileHeap) Less(i, j int) bool { return bytes.Compare(h.keys[i], h.keys[j]) > 0 }
+func (h *profileHeap) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.profiles[i], h.profiles[j] = h.profiles[j], h.profiles[i]
+}
+
+func (h *profileHeap) Push(x interface{}) {
+	kp := x.(*keyedProfile)
+	h.keys = append(h.keys, kp.key)
+	h.profiles = append(h.profiles, kp.profile)
+}
+
+func (h *profileHeap) Pop() interface{} {
+	last := len(h.keys) - 1
+	result := &keyedProfile{key: h.keys[last], profile: h.profiles[last]}
+	h.keys, h.profiles = h.keys[:last], h.profiles[:last]
+	return result
+}
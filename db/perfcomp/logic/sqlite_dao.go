@@ -3,9 +3,10 @@ package logic
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/avshabanov/go-code/db/sqlutil"
@@ -15,11 +16,18 @@ import (
 type sqliteDao struct {
 	Dao
 
-	db             *sql.DB
-	queryUsers     *sql.Stmt
-	getUser        *sql.Stmt
-	queryRoles     *sql.Stmt
-	queryProviders *sql.Stmt
+	db                 *sql.DB
+	getUser            *sql.Stmt
+	findByOauthAccount *sql.Stmt
+	queryRoles         *sql.Stmt
+	queryProviders     *sql.Stmt
+
+	// queryUsers caches statements prepared for every distinct combination of query criteria
+	queryUsersLock sync.Mutex
+	queryUsers     map[string]*sql.Stmt
+
+	changes       changeNotifier
+	schemaVersion int // behind the latest one only if DB is opened for reading
 }
 
 const schema = `
@@ -72,6 +80,27 @@ INSERT INTO oauth_provider (id, provider_name) VALUES
 	(303, 'Twitter');
 `
 
+// schemaQueryIndexes speed up filtered and sorted queries, legacy databases might already have them
+const schemaQueryIndexes = `
+CREATE INDEX IF NOT EXISTS idx_users_username ON users (username, id);
+CREATE INDEX IF NOT EXISTS idx_users_created ON users (created, id);
+CREATE INDEX IF NOT EXISTS idx_user_role_role ON user_role (role_id, user_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_accounts_provider ON oauth_accounts (provider_id, user_id);
+`
+
+// schemaAccountIndex makes oauth account belong to a single user, legacy databases might already have it
+const schemaAccountIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oauth_accounts_account ON oauth_accounts (provider_id, ext_user_id);
+`
+
+// sqliteMigrations is a registry of sqlite schema migrations, ordered by version
+var sqliteMigrations = []*sqliteMigration{
+	{migration{1, "initial schema"}, execSqlite(schema)},
+	{migration{2, "indexes of filtered queries"}, execSqlite(schemaQueryIndexes)},
+	{migration{3, "unique oauth account index"}, execSqlite(schemaAccountIndex)},
+	{migration{4, "change feed"}, execSqlite(sqliteChangesSchema)},
+}
+
 /*
 const fixture = `
 INSERT INTO users (id, username, created) VALUES (1, 'dave', '2016-05-12');
@@ -109,17 +138,15 @@ INSERT INTO oauth_accounts (user_id, provider_id, ext_user_id, created) VALUES
 `
 */
 
-// NewSqliteDao creates new DAO that uses sqlite
+// NewSqliteDao creates new DAO that uses sqlite with default settings of the driver
 func NewSqliteDao(dbPath string) (Dao, error) {
-	version, versionNumber, sourceID := sqlite3.Version()
-	log.Printf("use sqlite3 dao: version=%s, versionNumber=%d, sourceID=%s", version, versionNumber, sourceID)
+	return NewSqliteDaoWithTuning(dbPath, sqliteTunings[0])
+}
 
+// NewSqliteDaoWithTuning creates new DAO that uses sqlite with the given connection settings
+func NewSqliteDaoWithTuning(dbPath string, tuning *SqliteTuning) (Dao, error) {
 	var err error
-	result := &sqliteDao{}
-
-	if result.db, err = sql.Open("sqlite3", dbPath); err != nil {
-		return nil, err
-	}
+	result := &sqliteDao{db: openSqlite(dbPath, tuning)}
 
 	// begin transaction that potentially might modify the DB schema
 	tx, err := result.db.BeginTx(context.Background(), &sql.TxOptions{
@@ -131,25 +158,20 @@ func NewSqliteDao(dbPath string) (Dao, error) {
 	}
 	defer tx.Rollback()
 
-	r, err := tx.Query("SELECT * FROM users LIMIT 1")
-	if err != nil {
-		log.Printf("Unable to access 'users' table, looks like DB has not been initialized. Proceeding with init")
-		if _, err := tx.Exec(schema); err != nil {
-			return nil, fmt.Errorf("can't create schema: %v", err)
-		}
+	if tuning.ReadOnly {
+		result.schemaVersion, err = readSqliteSchemaVersion(tx, "users", sqliteMigrations)
 	} else {
-		log.Printf("The 'users' table is ready for queries, skip initialization")
-		r.Close()
+		result.schemaVersion, err = migrateSqlite(tx, dbPath, "users", sqliteMigrations)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't migrate schema: %v", err)
 	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, err // unlikely
 	}
 
-	if result.queryUsers, err = result.db.Prepare(
-		"SELECT id, username, created FROM users WHERE id>? ORDER BY id LIMIT ?"); err != nil {
-		return nil, err
-	}
+	result.queryUsers = map[string]*sql.Stmt{}
 
 	if result.queryRoles, err = result.db.Prepare(
 		"SELECT r.rolename FROM roles AS r INNER JOIN user_role AS ur ON r.id=ur.role_id WHERE ur.user_id=?"); err != nil {
@@ -166,6 +188,12 @@ func NewSqliteDao(dbPath string) (Dao, error) {
 		return nil, err
 	}
 
+	if result.findByOauthAccount, err = result.db.Prepare(
+		"SELECT u.id, u.username, u.created FROM users AS u INNER JOIN oauth_accounts AS oa ON oa.user_id=u.id " +
+			"INNER JOIN oauth_provider AS op ON op.id=oa.provider_id WHERE op.provider_name=? AND oa.ext_user_id=?"); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
@@ -173,16 +201,21 @@ func (t *sqliteDao) Close() error {
 	return t.db.Close()
 }
 
-func (t *sqliteDao) Add(profiles []*UserProfile) error {
-	tx, err := t.db.Begin()
+func (t *sqliteDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	tx, err := t.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("unable to start tx: %v", err)
 	}
 
 	for _, p := range profiles {
-		if err := addProfile(tx, p); err != nil {
+		if err := addProfile(ctx, tx, p); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to add profile: %s, %w", p, err)
+		}
+
+		if err := addSqliteChange(ctx, tx, newChange(ChangeAdd, p)); err != nil {
 			tx.Rollback()
-			return fmt.Errorf("unable to add profile: %s, %v", p, err)
+			return err
 		}
 	}
 
@@ -190,44 +223,84 @@ func (t *sqliteDao) Add(profiles []*UserProfile) error {
 		return err // unlikely
 	}
 
+	t.changes.notify()
 	return nil
 }
 
-func (t *sqliteDao) Get(id int) (*UserProfile, error) {
-	tx, err := t.db.Begin()
+func (t *sqliteDao) Update(ctx context.Context, profile *UserProfile) error {
+	tx, err := t.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable to start tx: %v", err)
+		return fmt.Errorf("unable to start tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := updateProfile(ctx, tx, profile); err != nil {
+		return fmt.Errorf("unable to update profile: %s, %w", profile, err)
+	}
+
+	if err := addSqliteChange(ctx, tx, newChange(ChangeUpdate, profile)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
+}
+
+func (t *sqliteDao) Delete(ctx context.Context, id int) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start tx: %v", err)
 	}
 	defer tx.Rollback()
 
-	getUser := tx.Stmt(t.getUser)
-	queryRoles := tx.Stmt(t.queryRoles)
-	queryProviders := tx.Stmt(t.queryProviders)
+	if err := deleteProfile(ctx, tx, id); err != nil {
+		return fmt.Errorf("unable to delete profile {id: %d}: %w", id, err)
+	}
+
+	if err := addSqliteChange(ctx, tx, newDeleteChange(id)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	t.changes.notify()
+	return nil
+}
 
-	rows, err := getUser.Query(id)
+func (t *sqliteDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	profile, err := t.selectProfile(ctx, t.getUser, id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		profile, err := scanUserProfile(rows)
-		if err != nil {
-			return nil, err
-		}
+	if profile == nil {
+		return nil, fmt.Errorf("there is no profile with id=%d: %w", id, ErrNotFound)
+	}
 
-		if err = populateProfile(profile, queryRoles, queryProviders); err != nil {
-			return nil, err
-		}
+	return profile, nil
+}
 
-		return profile, nil
+func (t *sqliteDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	profile, err := t.selectProfile(ctx, t.findByOauthAccount, provider, token)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %v", provider, token, err)
+	}
+
+	if profile == nil {
+		return nil, fmt.Errorf("unable to find user by oauth account {provider: %s, token: %s}: %w", provider, token, ErrNotFound)
 	}
 
-	return nil, fmt.Errorf("there is no profile with id=%d", id)
+	return profile, nil
 }
 
-func (t *sqliteDao) GetIDRange() (from int, to int, err error) {
-	tx, err := t.db.BeginTx(context.Background(), &sql.TxOptions{
+func (t *sqliteDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  true,
 	})
@@ -236,12 +309,12 @@ func (t *sqliteDao) GetIDRange() (from int, to int, err error) {
 	}
 	defer tx.Rollback()
 
-	min, err := sqlutil.SelectSingleInt(tx, "SELECT MIN(id) FROM users")
+	min, err := sqlutil.SelectSingleIntContext(ctx, tx, "SELECT COALESCE(MIN(id), 0) FROM users")
 	if err != nil {
 		return 0, 0, err
 	}
 
-	max, err := sqlutil.SelectSingleInt(tx, "SELECT MAX(id) FROM users")
+	max, err := sqlutil.SelectSingleIntContext(ctx, tx, "SELECT COALESCE(MAX(id), 0) FROM users")
 	if err != nil {
 		return 0, 0, err
 	}
@@ -253,17 +326,32 @@ func (t *sqliteDao) GetIDRange() (from int, to int, err error) {
 	return min, max, nil
 }
 
-func (t *sqliteDao) QueryUsers(offsetToken string, limit int) (*UserPage, error) {
+func (t *sqliteDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
+	if err := checkPageLimit(limit); err != nil {
+		return nil, err
+	}
+
 	var err error
-	var startID int64
+	var cursor []byte
 
 	if len(offsetToken) > 0 {
-		if startID, err = strconv.ParseInt(offsetToken, 10, 32); err != nil {
-			return nil, fmt.Errorf("invalid offset token: %v", err)
+		if cursor, err = decodeOffsetToken(sqliteBackendTag, query, offsetToken); err != nil {
+			return nil, err
 		}
 	}
 
-	tx, err := t.db.BeginTx(context.Background(), &sql.TxOptions{
+	sqlQuery, args, err := getUserQuerySQL(query, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// statement is prepared before tx starts, as a pool of a single connection can not serve both at once
+	queryUsersStmt, err := t.getQueryUsersStmt(ctx, sqlQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelSerializable,
 		ReadOnly:  true,
 	})
@@ -272,7 +360,7 @@ func (t *sqliteDao) QueryUsers(offsetToken string, limit int) (*UserPage, error)
 	}
 	defer tx.Rollback()
 
-	result, err := selectUserPage(t, tx, startID, limit)
+	result, err := selectUserPage(ctx, t, tx, queryUsersStmt, args, query, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -281,16 +369,153 @@ func (t *sqliteDao) QueryUsers(offsetToken string, limit int) (*UserPage, error)
 	return result, nil
 }
 
+// sqliteOrphanQueries select rows of link tables, that refer to missing rows, foreign keys are not enforced by
+// sqlite unless enabled, so nothing prevents such rows
+var sqliteOrphanQueries = []struct {
+	query  string
+	detail string
+}{
+	{"SELECT user_id, role_id FROM user_role WHERE user_id NOT IN (SELECT id FROM users)",
+		"user_role row user_id=%d, role_id=%d refers to missing user"},
+	{"SELECT user_id, role_id FROM user_role WHERE role_id NOT IN (SELECT id FROM roles)",
+		"user_role row user_id=%d, role_id=%d refers to missing role"},
+	{"SELECT user_id, provider_id FROM oauth_accounts WHERE user_id NOT IN (SELECT id FROM users)",
+		"oauth_accounts row user_id=%d, provider_id=%d refers to missing user"},
+	{"SELECT user_id, provider_id FROM oauth_accounts WHERE provider_id NOT IN (SELECT id FROM oauth_provider)",
+		"oauth_accounts row user_id=%d, provider_id=%d refers to missing provider"},
+}
+
+func (t *sqliteDao) Verify(ctx context.Context) (*VerifyReport, error) {
+	tx, err := t.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to start tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	report := &VerifyReport{}
+	if err := verifySqliteIntegrity(ctx, tx, report); err != nil {
+		return nil, err
+	}
+	if !report.verifySchemaVersion(t.schemaVersion, sqliteMigrations[len(sqliteMigrations)-1].version) {
+		return report, nil
+	}
+
+	for _, table := range []string{"users", "roles", "user_role", "oauth_provider", "oauth_accounts", "changes"} {
+		exists, err := hasSqliteTable(tx, table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			report.add(StorageCheck, "table=%s is missing", table)
+		}
+	}
+	if !report.OK() {
+		// the other checks need all the tables to be in place
+		return report, nil
+	}
+
+	if report.Users, err = sqlutil.SelectSingleIntContext(ctx, tx, "SELECT COUNT(*) FROM users"); err != nil {
+		return nil, err
+	}
+
+	for _, q := range sqliteOrphanQueries {
+		if err := verifySqliteRows(ctx, tx, q.query, func(rows *sql.Rows) error {
+			var userID, refID int
+			if err := rows.Scan(&userID, &refID); err != nil {
+				return err
+			}
+			report.add(OrphanCheck, q.detail, userID, refID)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// users refer to roles and providers by IDs, so only names of the referred rows are checked
+	for _, q := range []struct {
+		table  string
+		column string
+		names  []string
+	}{
+		{"roles", "rolename", Roles[:]},
+		{"oauth_provider", "provider_name", OauthProviders[:]},
+	} {
+		if err := verifySqliteRows(ctx, tx, fmt.Sprintf("SELECT id, %s FROM %s", q.column, q.table), func(rows *sql.Rows) error {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				return err
+			}
+			if !containsName(q.names, name) {
+				report.add(NameCheck, "%s row id=%d has unknown name=%s", q.table, id, name)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+func (t *sqliteDao) ReadChanges(ctx context.Context, fromSeq uint64, limit int) ([]*Change, error) {
+	return readSqliteChanges(ctx, t.db, fromSeq, limit)
+}
+
+func (t *sqliteDao) LastChangeSeq(ctx context.Context) (uint64, error) {
+	return getSqliteLastChangeSeq(ctx, t.db)
+}
+
+func (t *sqliteDao) Subscribe(ctx context.Context, fromSeq uint64, fn func(c *Change) error) error {
+	return t.changes.subscribe(ctx, t.ReadChanges, fromSeq, fn)
+}
+
 //
 // Private
 //
 
+// selectProfile runs the given statement, that selects at most one user, and returns complete profile of that
+// user or nil if there is no such user
+func (t *sqliteDao) selectProfile(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (*UserProfile, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	selectUser := tx.StmtContext(ctx, stmt)
+	queryRoles := tx.StmtContext(ctx, t.queryRoles)
+	queryProviders := tx.StmtContext(ctx, t.queryProviders)
+
+	rows, err := selectUser.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		profile, err := scanUserProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = populateProfile(ctx, profile, queryRoles, queryProviders); err != nil {
+			return nil, err
+		}
+
+		return profile, nil
+	}
+
+	return nil, rows.Err()
+}
+
 func populateProfile(
+	ctx context.Context,
 	p *UserProfile,
 	queryRoles *sql.Stmt,
 	queryProviders *sql.Stmt,
 ) error {
-	rows, err := queryRoles.Query(p.ID)
+	rows, err := queryRoles.QueryContext(ctx, p.ID)
 	if err != nil {
 		return err
 	}
@@ -304,16 +529,21 @@ func populateProfile(
 
 		p.Roles = append(p.Roles, role)
 	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-	if rows, err = queryProviders.Query(p.ID); err != nil {
+	accountRows, err := queryProviders.QueryContext(ctx, p.ID)
+	if err != nil {
 		return err
 	}
+	defer accountRows.Close()
 
-	for rows.Next() {
+	for accountRows.Next() {
 		var providerName string
 		var token string
 		var created time.Time
-		if err = rows.Scan(&providerName, &token, &created); err != nil {
+		if err = accountRows.Scan(&providerName, &token, &created); err != nil {
 			return err
 		}
 
@@ -324,7 +554,7 @@ func populateProfile(
 		})
 	}
 
-	return nil
+	return accountRows.Err()
 }
 
 func scanUserProfile(rows *sql.Rows) (*UserProfile, error) {
@@ -342,12 +572,20 @@ func scanUserProfile(rows *sql.Rows) (*UserProfile, error) {
 	}, nil
 }
 
-func selectUserPage(d *sqliteDao, tx *sql.Tx, startID int64, limit int) (*UserPage, error) {
-	queryUsers := tx.Stmt(d.queryUsers)
-	queryRoles := tx.Stmt(d.queryRoles)
-	queryProviders := tx.Stmt(d.queryProviders)
-
-	rows, err := queryUsers.Query(startID, limit+1)
+func selectUserPage(
+	ctx context.Context,
+	d *sqliteDao,
+	tx *sql.Tx,
+	queryUsersStmt *sql.Stmt,
+	args []interface{},
+	query *UserQuery,
+	limit int,
+) (*UserPage, error) {
+	queryUsers := tx.StmtContext(ctx, queryUsersStmt)
+	queryRoles := tx.StmtContext(ctx, d.queryRoles)
+	queryProviders := tx.StmtContext(ctx, d.queryProviders)
+
+	rows, err := queryUsers.QueryContext(ctx, append(args, limit+1)...)
 	if err != nil {
 		return nil, err
 	}
@@ -362,26 +600,21 @@ func selectUserPage(d *sqliteDao, tx *sql.Tx, startID int64, limit int) (*UserPa
 			return nil, err
 		}
 
-		result.Profiles = append(result.Profiles, profile)
-
-		rowsScanned++
 		if rowsScanned >= limit {
-			if rows.Next() {
-				var id int64
-				var username string
-				var created time.Time
-				if err := rows.Scan(&id, &username, &created); err != nil {
-					return nil, err
-				}
-				result.OffsetToken = strconv.FormatInt(id, 10)
-			}
+			result.OffsetToken = encodeOffsetToken(sqliteBackendTag, query, cursorKey(queryOrder(query), profile))
 			break
 		}
+
+		result.Profiles = append(result.Profiles, profile)
+		rowsScanned++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	// now, for each user get corresponding roles and oauth profiles
 	for _, p := range result.Profiles {
-		if err := populateProfile(p, queryRoles, queryProviders); err != nil {
+		if err := populateProfile(ctx, p, queryRoles, queryProviders); err != nil {
 			return nil, err
 		}
 	}
@@ -389,14 +622,199 @@ func selectUserPage(d *sqliteDao, tx *sql.Tx, startID int64, limit int) (*UserPa
 	return result, nil
 }
 
-func addProfile(tx *sql.Tx, p *UserProfile) error {
+// getUserQuerySQL builds SQL query selecting users that match the given query criteria, starting from
+// the given cursor; the resulting query expects limit as the last argument
+func getUserQuerySQL(query *UserQuery, cursor []byte) (string, []interface{}, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	order := queryOrder(query)
+
+	if cursor != nil {
+		value, id, err := splitCursorKey(order, cursor)
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch order {
+		case OrderByName:
+			conditions = append(conditions, "(u.username, u.id)>=(?, ?)")
+			args = append(args, value, id)
+		case OrderByCreated:
+			conditions = append(conditions, "(u.created, u.id)>=(?, ?)")
+			args = append(args, value, id)
+		default:
+			conditions = append(conditions, "u.id>=?")
+			args = append(args, id)
+		}
+	}
+
+	if query != nil {
+		if len(query.Role) > 0 {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM user_role AS ur INNER JOIN roles AS r ON r.id=ur.role_id WHERE ur.user_id=u.id AND r.rolename=?)")
+			args = append(args, query.Role)
+		}
+
+		if len(query.Provider) > 0 {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM oauth_accounts AS oa INNER JOIN oauth_provider AS op ON op.id=oa.provider_id WHERE oa.user_id=u.id AND op.provider_name=?)")
+			args = append(args, query.Provider)
+		}
+
+		// created is stored as text in UTC, which makes lexicographical comparison chronological
+		if !query.CreatedFrom.IsZero() {
+			conditions = append(conditions, "u.created>=?")
+			args = append(args, query.CreatedFrom.UTC())
+		}
+
+		if !query.CreatedTo.IsZero() {
+			conditions = append(conditions, "u.created<?")
+			args = append(args, query.CreatedTo.UTC())
+		}
+
+		// range condition lets sqlite use the index, unlike LIKE which is case-insensitive by default
+		if len(query.NamePrefix) > 0 {
+			conditions = append(conditions, "u.username>=?")
+			args = append(args, query.NamePrefix)
+			if upperBound := prefixUpperBound(query.NamePrefix); len(upperBound) > 0 {
+				conditions = append(conditions, "u.username<?")
+				args = append(args, upperBound)
+			}
+		}
+	}
+
+	var buf strings.Builder
+	buf.WriteString("SELECT u.id, u.username, u.created FROM users AS u")
+	if len(conditions) > 0 {
+		buf.WriteString(" WHERE ")
+		buf.WriteString(strings.Join(conditions, " AND "))
+	}
+
+	switch order {
+	case OrderByName:
+		buf.WriteString(" ORDER BY u.username, u.id")
+	case OrderByCreated:
+		buf.WriteString(" ORDER BY u.created, u.id")
+	default:
+		buf.WriteString(" ORDER BY u.id")
+	}
+	buf.WriteString(" LIMIT ?")
+
+	return buf.String(), args, nil
+}
+
+func (t *sqliteDao) getQueryUsersStmt(ctx context.Context, sqlQuery string) (*sql.Stmt, error) {
+	t.queryUsersLock.Lock()
+	defer t.queryUsersLock.Unlock()
+
+	if stmt, ok := t.queryUsers[sqlQuery]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := t.db.PrepareContext(ctx, sqlQuery)
+	if err != nil {
+		return nil, err
+	}
+	t.queryUsers[sqlQuery] = stmt
+	return stmt, nil
+}
+
+func addProfile(ctx context.Context, tx *sql.Tx, p *UserProfile) error {
+	// user goes first, so that associations of the stored user with the same ID do not fail the insert
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO users (id, username, created) VALUES (?, ?, ?)",
+		p.ID,
+		p.Name,
+		p.Created.UTC()); err != nil {
+		return expectNewProfile(err, p.ID)
+	}
+
+	return addProfileAssociations(ctx, tx, p)
+}
+
+func updateProfile(ctx context.Context, tx *sql.Tx, p *UserProfile) error {
+	res, err := tx.ExecContext(ctx,
+		"UPDATE users SET username=?, created=? WHERE id=?",
+		p.Name,
+		p.Created.UTC(),
+		p.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := expectAffectedRows(res, p.ID); err != nil {
+		return err
+	}
+
+	if err := deleteProfileAssociations(ctx, tx, p.ID); err != nil {
+		return err
+	}
+
+	return addProfileAssociations(ctx, tx, p)
+}
+
+func deleteProfile(ctx context.Context, tx *sql.Tx, id int) error {
+	if err := deleteProfileAssociations(ctx, tx, id); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+
+	return expectAffectedRows(res, id)
+}
+
+func expectAffectedRows(res sql.Result, id int) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("there is no profile with id=%d: %w", id, ErrNotFound)
+	}
+
+	return nil
+}
+
+// expectNewProfile tells apart failed insert of the user with the taken ID
+func expectNewProfile(err error, id int) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return fmt.Errorf("there is a profile with id=%d already: %w", id, ErrAlreadyExists)
+	}
+	return err
+}
+
+// expectFreeAccount tells apart failed insert of the oauth account, that belongs to another user
+func expectFreeAccount(err error, a *OauthAccount) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+		return fmt.Errorf("oauth account %s is already taken: %w", a, ErrAccountTaken)
+	}
+	return err
+}
+
+func deleteProfileAssociations(ctx context.Context, tx *sql.Tx, id int) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_role WHERE user_id=?", id); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM oauth_accounts WHERE user_id=?", id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func addProfileAssociations(ctx context.Context, tx *sql.Tx, p *UserProfile) error {
 	for _, r := range p.Roles {
-		roleID, err := sqlutil.SelectSingleInt(tx, "SELECT id FROM roles WHERE rolename=?", string(r))
+		roleID, err := sqlutil.SelectSingleIntContext(ctx, tx, "SELECT id FROM roles WHERE rolename=?", string(r))
 		if err != nil {
 			return err
 		}
 
-		if _, err := tx.Exec(
+		if _, err := tx.ExecContext(ctx,
 			"INSERT INTO user_role (user_id, role_id) VALUES (?, ?)",
 			p.ID,
 			roleID); err != nil {
@@ -405,28 +823,20 @@ func addProfile(tx *sql.Tx, p *UserProfile) error {
 	}
 
 	for _, a := range p.Accounts {
-		providerID, err := sqlutil.SelectSingleInt(tx, "SELECT id FROM oauth_provider AS op WHERE provider_name=?", a.Provider)
+		providerID, err := sqlutil.SelectSingleIntContext(ctx, tx, "SELECT id FROM oauth_provider AS op WHERE provider_name=?", a.Provider)
 		if err != nil {
 			return err
 		}
 
-		if _, err := tx.Exec(
+		if _, err := tx.ExecContext(ctx,
 			"INSERT INTO oauth_accounts (user_id, provider_id, ext_user_id, created) VALUES (?, ?, ?, ?)",
 			p.ID,
 			providerID,
 			a.Token,
-			a.Created); err != nil {
-			return err
+			a.Created.UTC()); err != nil {
+			return expectFreeAccount(err, a)
 		}
 	}
 
-	if _, err := tx.Exec(
-		"INSERT INTO users (id, username, created) VALUES (?, ?, ?)",
-		p.ID,
-		p.Name,
-		p.Created); err != nil {
-		return err
-	}
-
 	return nil
 }
@@ -0,0 +1,172 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SqliteTuning defines settings of connections to sqlite databases, zero values keep defaults of the driver
+type SqliteTuning struct {
+	Name string
+
+	// JournalMode is a value of PRAGMA journal_mode, e.g. WAL
+	JournalMode string
+
+	// Synchronous is a value of PRAGMA synchronous, e.g. NORMAL
+	Synchronous string
+
+	// MmapSize is a maximum number of bytes of the database file accessed through memory-mapped I/O
+	MmapSize int64
+
+	// CacheSize is a value of PRAGMA cache_size, number of pages if positive and KiB if negative
+	CacheSize int
+
+	// BusyTimeout is a time to wait for a lock held by another connection before failing with SQLITE_BUSY
+	BusyTimeout time.Duration
+
+	// MaxOpenConns limits size of the connection pool, zero means no limit
+	MaxOpenConns int
+
+	// ReadOnly opens the database for reading only, pending migrations are not applied to it then
+	ReadOnly bool
+}
+
+// Names of the predefined tuning profiles
+const (
+	DefaultSqliteTuningName   = "default"
+	DurableSqliteTuningName   = "durable"
+	OptimizedSqliteTuningName = "optimized"
+	BulkSqliteTuningName      = "bulk"
+)
+
+var sqliteTunings = []*SqliteTuning{
+	// rollback journal, full sync and small page cache of the driver
+	{Name: DefaultSqliteTuningName},
+
+	// readers do not block the writer, every commit is still synced
+	{Name: DurableSqliteTuningName, JournalMode: "WAL", Synchronous: "FULL", BusyTimeout: 5 * time.Second},
+
+	// WAL is only synced on checkpoints, which might lose last commits on power failure, but never corrupts DB
+	{
+		Name:        OptimizedSqliteTuningName,
+		JournalMode: "WAL",
+		Synchronous: "NORMAL",
+		MmapSize:    256 << 20,
+		CacheSize:   -64 << 10,
+		BusyTimeout: 5 * time.Second,
+	},
+
+	// for initial loads only, since crash in the middle of the transaction might corrupt DB
+	{
+		Name:         BulkSqliteTuningName,
+		JournalMode:  "MEMORY",
+		Synchronous:  "OFF",
+		CacheSize:    -256 << 10,
+		BusyTimeout:  5 * time.Second,
+		MaxOpenConns: 1,
+	},
+}
+
+// SqliteTuningNames lists names of all the predefined tuning profiles
+var SqliteTuningNames = func() []string {
+	result := []string{}
+	for _, t := range sqliteTunings {
+		result = append(result, t.Name)
+	}
+	return result
+}()
+
+// GetSqliteTuning returns predefined tuning profile with the given name
+func GetSqliteTuning(name string) (*SqliteTuning, error) {
+	for _, t := range sqliteTunings {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown sqlite tuning=%s, expected one of %s", name, SqliteTuningNames)
+}
+
+// String lists all the settings of the profile, so that runs with different settings are never confused
+func (t *SqliteTuning) String() string {
+	settings := append([]string{t.Name}, t.pragmas()...)
+	settings = append(settings, fmt.Sprintf("max_open_conns=%d", t.MaxOpenConns))
+	if t.ReadOnly {
+		settings = append(settings, "mode=ro")
+	}
+	return strings.Join(settings, " ")
+}
+
+//
+// Private
+//
+
+// pragmas returns statements applied to every new connection
+func (t *SqliteTuning) pragmas() []string {
+	result := []string{}
+	// busy timeout goes first, so that switching journal mode waits for the other connections
+	if t.BusyTimeout > 0 {
+		result = append(result, fmt.Sprintf("PRAGMA busy_timeout=%d", t.BusyTimeout.Milliseconds()))
+	}
+	// journal mode is kept in the database file, so that read-only connections can not switch it
+	if len(t.JournalMode) > 0 && !t.ReadOnly {
+		result = append(result, "PRAGMA journal_mode="+t.JournalMode)
+	}
+	if len(t.Synchronous) > 0 {
+		result = append(result, "PRAGMA synchronous="+t.Synchronous)
+	}
+	if t.CacheSize != 0 {
+		result = append(result, fmt.Sprintf("PRAGMA cache_size=%d", t.CacheSize))
+	}
+	if t.MmapSize > 0 {
+		result = append(result, fmt.Sprintf("PRAGMA mmap_size=%d", t.MmapSize))
+	}
+	return result
+}
+
+// openSqlite opens database, that applies tuning to every connection of its pool
+func openSqlite(dbPath string, tuning *SqliteTuning) *sql.DB {
+	version, versionNumber, sourceID := sqlite3.Version()
+	log.Printf("use sqlite3 dao: version=%s, versionNumber=%d, sourceID=%s, tuning=%s", version, versionNumber, sourceID, tuning)
+
+	dsn := dbPath
+	if tuning.ReadOnly {
+		dsn = "file:" + dbPath + "?mode=ro"
+	}
+
+	pragmas := tuning.pragmas()
+	db := sql.OpenDB(&sqliteConnector{
+		dsn: dsn,
+		driver: &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range pragmas {
+				if _, err := conn.Exec(pragma, nil); err != nil {
+					return fmt.Errorf("unable to apply %s: %v", pragma, err)
+				}
+			}
+			return nil
+		}},
+	})
+	db.SetMaxOpenConns(tuning.MaxOpenConns)
+	return db
+}
+
+// sqliteConnector opens connections with the given driver, unlike sql.Open it does not need driver to be
+// registered globally
+type sqliteConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (t *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return t.driver.Open(t.dsn)
+}
+
+func (t *sqliteConnector) Driver() driver.Driver {
+	return t.driver
+}
@@ -0,0 +1,59 @@
+package logic
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteTuning(t *testing.T) {
+	t.Run("pragmas are applied to connections", func(t *testing.T) {
+		tuning, err := GetSqliteTuning(OptimizedSqliteTuningName)
+		require.Nil(t, err)
+
+		db := openSqlite(filepath.Join(t.TempDir(), "sqlite.db"), tuning)
+		defer db.Close()
+
+		var journalMode string
+		require.Nil(t, db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+		assert.Equal(t, "wal", journalMode)
+
+		var synchronous, cacheSize int
+		require.Nil(t, db.QueryRow("PRAGMA synchronous").Scan(&synchronous))
+		assert.Equal(t, 1, synchronous, "synchronous should be NORMAL")
+		require.Nil(t, db.QueryRow("PRAGMA cache_size").Scan(&cacheSize))
+		assert.Equal(t, tuning.CacheSize, cacheSize)
+	})
+
+	t.Run("dao works with every tuning", func(t *testing.T) {
+		for _, name := range SqliteTuningNames {
+			tuning, err := GetSqliteTuning(name)
+			require.Nil(t, err)
+
+			dao, err := NewSqliteDaoWithTuning(filepath.Join(t.TempDir(), name+".db"), tuning)
+			require.Nil(t, err, name)
+			page, err := dao.QueryUsers(context.Background(), &UserQuery{}, "", 10)
+			require.Nil(t, err, name)
+			assert.Empty(t, page.Profiles, name)
+			assert.Nil(t, dao.Close())
+		}
+	})
+
+	t.Run("settings are listed", func(t *testing.T) {
+		tuning, err := GetSqliteTuning(DurableSqliteTuningName)
+		require.Nil(t, err)
+		assert.Equal(
+			t,
+			"durable PRAGMA busy_timeout=5000 PRAGMA journal_mode=WAL PRAGMA synchronous=FULL max_open_conns=0",
+			tuning.String(),
+		)
+	})
+
+	t.Run("unknown tuning", func(t *testing.T) {
+		_, err := GetSqliteTuning("fast")
+		assert.EqualError(t, err, "unknown sqlite tuning=fast, expected one of [default durable optimized bulk]")
+	})
+}
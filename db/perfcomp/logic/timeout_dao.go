@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"context"
+	"time"
+)
+
+type timeoutDao struct {
+	Dao
+
+	dao     Dao
+	timeout time.Duration
+}
+
+// NewTimeoutDao creates DAO that forwards calls to the given one and gives each call the given time to complete
+func NewTimeoutDao(dao Dao, timeout time.Duration) Dao {
+	return &timeoutDao{dao: dao, timeout: timeout}
+}
+
+func (t *timeoutDao) Close() error {
+	return t.dao.Close()
+}
+
+func (t *timeoutDao) Add(ctx context.Context, profiles []*UserProfile) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.Add(ctx, profiles)
+}
+
+func (t *timeoutDao) Update(ctx context.Context, profile *UserProfile) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.Update(ctx, profile)
+}
+
+func (t *timeoutDao) Delete(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.Delete(ctx, id)
+}
+
+func (t *timeoutDao) QueryUsers(ctx context.Context, query *UserQuery, offsetToken string, limit int) (*UserPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.QueryUsers(ctx, query, offsetToken, limit)
+}
+
+func (t *timeoutDao) Get(ctx context.Context, id int) (*UserProfile, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.Get(ctx, id)
+}
+
+func (t *timeoutDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*UserProfile, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.FindByOauthAccount(ctx, provider, token)
+}
+
+func (t *timeoutDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.dao.GetIDRange(ctx)
+}
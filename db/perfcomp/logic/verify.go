@@ -0,0 +1,248 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// VerifiableDao is implemented by DAOs that are able to check integrity of the underlying storage
+type VerifiableDao interface {
+	// Verify checks integrity of the storage and consistency of the stored users, found problems are put into
+	// the report, while error is only returned if the check itself could not be completed
+	Verify(ctx context.Context) (*VerifyReport, error)
+}
+
+// VerifyCheck is a kind of problems found by Verify
+type VerifyCheck string
+
+// Checks made by Verify, in order of their severity
+const (
+	// StorageCheck covers integrity of the database file and presence of its tables and buckets
+	StorageCheck VerifyCheck = "storage"
+
+	// SchemaCheck covers migrations pending for the database, which is opened for reading only by verification
+	SchemaCheck VerifyCheck = "schema"
+
+	// ValueCheck covers user profiles, which could not be decoded or are kept under other IDs
+	ValueCheck VerifyCheck = "values"
+
+	// OrphanCheck covers rows and index entries, which refer to missing users, roles or providers
+	OrphanCheck VerifyCheck = "orphans"
+
+	// IndexCheck covers index entries missing for the stored users
+	IndexCheck VerifyCheck = "indexes"
+
+	// NameCheck covers roles and providers outside of Roles and OauthProviders
+	NameCheck VerifyCheck = "names"
+)
+
+// VerifyChecks lists all the checks in order of their severity
+var VerifyChecks = []VerifyCheck{StorageCheck, SchemaCheck, ValueCheck, OrphanCheck, IndexCheck, NameCheck}
+
+// Repair returns the way to fix problems found by the check
+func (c VerifyCheck) Repair() string {
+	switch c {
+	case StorageCheck:
+		return "database is damaged; restore it from a backup or recreate it with reinit or import mode"
+	case SchemaCheck:
+		return "open the database in any mode but verify, so that the pending migrations are applied, and verify it again"
+	case ValueCheck:
+		return "delete the listed users and add them back from a dump exported before the damage, " +
+			"or recreate the database"
+	case OrphanCheck:
+		return "delete the listed rows or entries, they are not reachable through any user"
+	case IndexCheck:
+		return "run rebuild-indexes mode for bolt, or export the users and import them into a fresh database"
+	case NameCheck:
+		return "fix roles and providers of the listed users with update mode, or add the names to logic.Roles " +
+			"and logic.OauthProviders if they are valid"
+	default:
+		return ""
+	}
+}
+
+// VerifyProblem is an inconsistency found by Verify
+type VerifyProblem struct {
+	Check  VerifyCheck
+	Detail string
+}
+
+// VerifyReport lists problems found by Verify
+type VerifyReport struct {
+	Users    int // number of checked users
+	Problems []*VerifyProblem
+}
+
+// OK tells whether no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Write prints problems grouped by checks along with the ways to repair them, at most maxDetails problems of
+// every check are listed
+func (r *VerifyReport) Write(w io.Writer, maxDetails int) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "verified %d users, found %d problems\n", r.Users, len(r.Problems))
+	for _, check := range VerifyChecks {
+		details := []string{}
+		for _, p := range r.Problems {
+			if p.Check == check {
+				details = append(details, p.Detail)
+			}
+		}
+		if len(details) == 0 {
+			fmt.Fprintf(&b, "[%s] ok\n", check)
+			continue
+		}
+
+		fmt.Fprintf(&b, "[%s] %d problems\n", check, len(details))
+		for i, d := range details {
+			if i == maxDetails {
+				fmt.Fprintf(&b, "  ... and %d more\n", len(details)-maxDetails)
+				break
+			}
+			fmt.Fprintf(&b, "  - %s\n", d)
+		}
+		fmt.Fprintf(&b, "  repair: %s\n", check.Repair())
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+//
+// Private
+//
+
+func (r *VerifyReport) add(check VerifyCheck, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, &VerifyProblem{Check: check, Detail: fmt.Sprintf(format, args...)})
+}
+
+// verifySchemaVersion reports migrations pending for the DB, which were not applied as it is opened for reading,
+// the other checks assume the latest schema and are only made if it tells true
+func (r *VerifyReport) verifySchemaVersion(version int, latest int) bool {
+	if version < latest {
+		r.add(SchemaCheck, "schema version=%d is behind the latest version=%d", version, latest)
+		return false
+	}
+	return true
+}
+
+// verifyProfile checks decoded profile, that is kept under the given ID
+func (r *VerifyReport) verifyProfile(id int, p *UserProfile) {
+	r.Users++
+	if p.ID != id {
+		r.add(ValueCheck, "user id=%d is kept under id=%d", p.ID, id)
+	}
+
+	for _, role := range p.Roles {
+		if !containsName(Roles[:], role) {
+			r.add(NameCheck, "user id=%d has unknown role=%s", p.ID, role)
+		}
+	}
+	for _, a := range p.Accounts {
+		if !containsName(OauthProviders[:], a.Provider) {
+			r.add(NameCheck, "user id=%d has account of unknown provider=%s", p.ID, a.Provider)
+		}
+	}
+}
+
+// accountIndexVerifier compares oauth account index, maintained by key-value DAOs, with accounts of the users
+type accountIndexVerifier struct {
+	report   *VerifyReport
+	expected map[string]int // account keys of the stored users mapped to their IDs
+	users    map[int]bool   // IDs of the stored users mapped to whether they were decoded
+}
+
+func newAccountIndexVerifier(report *VerifyReport) *accountIndexVerifier {
+	return &accountIndexVerifier{report: report, expected: map[string]int{}, users: map[int]bool{}}
+}
+
+// addUser takes user, that is kept under the given ID, profile is nil if it could not be decoded
+func (t *accountIndexVerifier) addUser(id int, p *UserProfile) {
+	t.users[id] = p != nil
+	if p == nil {
+		return
+	}
+	for _, a := range p.Accounts {
+		t.expected[string(accountKey(a.Provider, a.Token))] = id
+	}
+}
+
+// addEntry takes index entry, that refers to the user with the given ID
+func (t *accountIndexVerifier) addEntry(key []byte, id int) {
+	provider, token := splitAccountKey(key)
+	expectedID, ok := t.expected[string(key)]
+	decoded, exists := t.users[id]
+	switch {
+	case ok && expectedID == id:
+		delete(t.expected, string(key))
+	case exists && !decoded:
+		// accounts of the user are unknown, while the user is already reported
+	case !exists:
+		t.report.add(OrphanCheck, "account provider=%s, token=%s refers to missing user id=%d", provider, token, id)
+	case !ok:
+		t.report.add(OrphanCheck, "account provider=%s, token=%s refers to user id=%d, who does not have it", provider, token, id)
+	default:
+		t.report.add(IndexCheck, "account provider=%s, token=%s refers to user id=%d instead of id=%d", provider, token, id, expectedID)
+		delete(t.expected, string(key))
+	}
+}
+
+// finish reports accounts of the users missing in the index
+func (t *accountIndexVerifier) finish() {
+	for key, id := range t.expected {
+		provider, token := splitAccountKey([]byte(key))
+		t.report.add(IndexCheck, "account provider=%s, token=%s of user id=%d is not indexed", provider, token, id)
+	}
+}
+
+func splitAccountKey(key []byte) (provider string, token string) {
+	parts := strings.SplitN(string(key), "\x00", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySqliteIntegrity runs integrity check of sqlite database, which lists damaged pages and indexes
+func verifySqliteIntegrity(ctx context.Context, tx *sql.Tx, report *VerifyReport) error {
+	return verifySqliteRows(ctx, tx, "PRAGMA integrity_check", func(rows *sql.Rows) error {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return err
+		}
+		if message != "ok" {
+			report.add(StorageCheck, "%s", message)
+		}
+		return nil
+	})
+}
+
+// verifySqliteRows passes every row selected by the query to the given function
+func verifySqliteRows(ctx context.Context, tx *sql.Tx, query string, fn func(rows *sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("unable to run %s: %v", query, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
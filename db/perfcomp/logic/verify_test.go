@@ -0,0 +1,174 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2010, time.March, 4, 5, 6, 7, 0, time.UTC)
+	newProfiles := func() []*UserProfile {
+		return []*UserProfile{
+			{ID: 1, Name: "Alice", Created: created, Roles: []string{"ADMIN"},
+				Accounts: []*OauthAccount{{Provider: "Google", Token: "t1", Created: created}}},
+			{ID: 2, Name: "Bob", Created: created, Roles: []string{"READER"},
+				Accounts: []*OauthAccount{{Provider: "VK", Token: "t2", Created: created}}},
+		}
+	}
+	verify := func(t *testing.T, dao Dao) *VerifyReport {
+		report, err := dao.(VerifiableDao).Verify(ctx)
+		require.Nil(t, err)
+		return report
+	}
+	details := func(report *VerifyReport, check VerifyCheck) []string {
+		result := []string{}
+		for _, p := range report.Problems {
+			if p.Check == check {
+				result = append(result, p.Detail)
+			}
+		}
+		return result
+	}
+
+	for _, b := range []struct {
+		*testBackend
+		// damage breaks the database in a way, that is reported by the given problems
+		damage   func(t *testing.T, dao Dao)
+		problems map[VerifyCheck][]string
+	}{
+		{
+			testBackend: testSqlite,
+			damage: func(t *testing.T, dao Dao) {
+				require.Nil(t, execSqliteTx(dao.(*sqliteDao).db, `
+					DELETE FROM users WHERE id=2;
+					INSERT INTO user_role (user_id, role_id) VALUES (1, 200);
+					UPDATE oauth_provider SET provider_name='Myspace' WHERE id=303;`))
+			},
+			problems: map[VerifyCheck][]string{
+				OrphanCheck: {
+					"user_role row user_id=2, role_id=103 refers to missing user",
+					"user_role row user_id=1, role_id=200 refers to missing role",
+					"oauth_accounts row user_id=2, provider_id=300 refers to missing user",
+				},
+				NameCheck: {"oauth_provider row id=303 has unknown name=Myspace"},
+			},
+		},
+		{
+			testBackend: testKvSqlite,
+			damage: func(t *testing.T, dao Dao) {
+				require.Nil(t, execSqliteTx(dao.(*kvSqliteDao).db, `
+					UPDATE kv_users SET v=x'0102' WHERE id=2;
+					INSERT INTO kv_oauth_accounts (provider, token, user_id) VALUES ('VK', 't3', 3);
+					DELETE FROM kv_oauth_accounts WHERE token='t1';`))
+			},
+			problems: map[VerifyCheck][]string{
+				ValueCheck:  {"user id=2 can not be decoded with codec=gob: gob: type mismatch in decoder: want struct type logic.UserProfile; got non-struct"},
+				OrphanCheck: {"account provider=VK, token=t3 refers to missing user id=3"},
+				IndexCheck:  {"account provider=Google, token=t1 of user id=1 is not indexed"},
+			},
+		},
+		{
+			testBackend: testBolt,
+			damage: func(t *testing.T, dao Dao) {
+				p := newProfiles()[1]
+				p.Roles = []string{"GUEST"}
+				require.Nil(t, dao.Update(ctx, p))
+				require.Nil(t, dao.(*boltDao).db.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(bucketIdxName).Put(stringKey("Carol", 3), nil)
+				}))
+			},
+			problems: map[VerifyCheck][]string{
+				IndexCheck: {"index=idx_name has 1 stale and 0 missing entries"},
+				NameCheck:  {"user id=2 has unknown role=GUEST"},
+			},
+		},
+		{
+			testBackend: testLevelDb,
+			damage: func(t *testing.T, dao Dao) {
+				require.Nil(t, dao.Add(ctx, []*UserProfile{{ID: 3, Name: "Carol", Created: created,
+					Accounts: []*OauthAccount{{Provider: "VK", Token: "t3", Created: created}}}}))
+
+				db := dao.(*levelDbDao).db
+				require.Nil(t, db.Put(levelDbUserKey(1), []byte{1, 2}, nil))
+				require.Nil(t, db.Put(levelDbKey(levelDbAccountsPrefix, accountKey("VK", "t3")), getBytesFromID(2), nil))
+				require.Nil(t, db.Put(levelDbKey(levelDbAccountsPrefix, accountKey("VK", "t4")), getBytesFromID(2), nil))
+			},
+			problems: map[VerifyCheck][]string{
+				ValueCheck:  {"user id=1 can not be decoded with codec=gob: gob: type mismatch in decoder: want struct type logic.UserProfile; got non-struct"},
+				OrphanCheck: {"account provider=VK, token=t4 refers to user id=2, who does not have it"},
+				IndexCheck:  {"account provider=VK, token=t3 refers to user id=2 instead of id=3"},
+			},
+		},
+	} {
+		t.Run(b.name, func(t *testing.T) {
+			openDao := func(t *testing.T) Dao {
+				dao, err := b.open(filepath.Join(t.TempDir(), b.name+".db"))
+				require.Nil(t, err)
+				require.Nil(t, dao.Add(ctx, newProfiles()))
+				return dao
+			}
+
+			t.Run("consistent database", func(t *testing.T) {
+				dao := openDao(t)
+				defer dao.Close()
+
+				report := verify(t, dao)
+				assert.True(t, report.OK(), "unexpected problems: %v", report.Problems)
+				assert.Equal(t, 2, report.Users)
+			})
+
+			t.Run("damaged database", func(t *testing.T) {
+				dao := openDao(t)
+				defer dao.Close()
+				b.damage(t, dao)
+
+				report := verify(t, dao)
+				for _, check := range VerifyChecks {
+					assert.ElementsMatch(t, b.problems[check], details(report, check), "check=%s", check)
+				}
+			})
+		})
+	}
+
+	t.Run("missing bolt bucket", func(t *testing.T) {
+		dao, err := NewBoltDao(filepath.Join(t.TempDir(), "bolt.db"))
+		require.Nil(t, err)
+		defer dao.Close()
+		require.Nil(t, dao.(*boltDao).db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket(bucketUsers)
+		}))
+
+		report := verify(t, dao)
+		assert.Equal(t, []string{"bucket=users is missing"}, details(report, StorageCheck))
+	})
+
+	t.Run("report lists problems with repairs", func(t *testing.T) {
+		report := &VerifyReport{Users: 3}
+		report.add(OrphanCheck, "orphan %d", 1)
+		report.add(OrphanCheck, "orphan %d", 2)
+		report.add(NameCheck, "unknown name")
+
+		var buf bytes.Buffer
+		require.Nil(t, report.Write(&buf, 1))
+		assert.Equal(t, "verified 3 users, found 3 problems\n"+
+			"[storage] ok\n"+
+			"[schema] ok\n"+
+			"[values] ok\n"+
+			"[orphans] 2 problems\n"+
+			"  - orphan 1\n"+
+			"  ... and 1 more\n"+
+			"  repair: "+OrphanCheck.Repair()+"\n"+
+			"[indexes] ok\n"+
+			"[names] 1 problems\n"+
+			"  - unknown name\n"+
+			"  repair: "+NameCheck.Repair()+"\n", buf.String())
+	})
+}
@@ -1,91 +1,376 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/avshabanov/go-code/db/perfcomp/grpcserver"
+	"github.com/avshabanov/go-code/db/perfcomp/keydist"
 	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"github.com/avshabanov/go-code/db/perfcomp/server"
+	"github.com/avshabanov/go-code/db/perfcomp/stats"
 	"github.com/avshabanov/go-code/fixture"
+	"github.com/mattn/go-sqlite3"
 )
 
-const sqliteDaoType = "sqlite"
+const (
+	sqliteDaoType = "sqlite"
+	memoryDaoType = "memory"
+)
 
 var (
 	dbPath      = flag.String("db-path", "", "Path to identity service database, e.g. /tmp/perfcomp-sqlite.db")
-	dbType      = flag.String("db-type", sqliteDaoType, "Type of the database to test")
+	dbType      = flag.String("db-type", sqliteDaoType, "Type of the database to test: sqlite, bolt, kvsqlite, leveldb or memory")
 	initSize    = flag.Int("init-size", 10, "Size of initial data sample, applicable to initialization mode only")
 	offsetToken = flag.String("ot", "", "Offset token, applicable to select mode only")
-	mode        = flag.String("mode", "select", "App launch mode, e.g.: select, reinit, parallel-select")
+	mode        = flag.String("mode", "select", "App launch mode, e.g.: select, reinit, parallel-select, filtered-select, random-get, login, update, delete, mixed, rebuild-indexes, verify-indexes, codec, compare, export, import, verify, serve, serve-grpc, http-load, tail")
 	jobs        = flag.Int("jobs", 8, "Number of concurrently executed jobs")
+	opMix       = flag.String("mix", "get=70,query=20,add=5,update=5", "Percentage of get, query, add and update operations, applicable to mixed mode only")
+	opCount     = flag.Int("ops", 10000, "Number of operations performed by each job, applicable to mixed mode only")
+	reportPath  = flag.String("report", "", "Path to machine-readable results file, CSV if path ends with .csv and JSON otherwise")
+	workload    = flag.String("workload", "mixed", "Benchmark mode to run against every backend or the server, applicable to compare and http-load modes only")
+	backends    = flag.String("backends", "sqlite,bolt,kvsqlite,leveldb", "Comma-separated backends to run, the first one is a baseline; applicable to compare mode only")
+	batchSize   = flag.Int("batch-size", 1000, "Number of users added in one transaction, applicable to reinit and import only")
+	commitEvery = flag.Duration("commit-interval", time.Second, "Maximum time users wait for their batch to fill up, applicable to reinit and import only")
+	resume      = flag.Bool("resume", false, "Continue interrupted reinit or import after the largest stored user ID instead of recreating the database")
+	dumpPath    = flag.String("dump", "", "Path to dump file, applicable to export and import modes only")
+	fromSeq     = flag.Uint64("from-seq", 0, "Sequence number of the first printed change, applicable to tail mode only; zero means changes made after the start")
+	dumpFormat  = flag.String("dump-format", logic.JSONDumpFormat, "Format of dump file: json (one user per line) or protobuf (length-prefixed messages)")
+	opTimeout   = flag.Duration("timeout", 0, "Timeout of every DAO operation made by benchmark modes, e.g. 20ms; zero means no timeout")
+	cacheSize   = flag.Int("cache-size", 0, "Number of profiles kept in LRU cache in front of the database by benchmark modes; zero disables the cache")
+	cacheAdmit  = flag.Bool("cache-admission", false, "Admit profiles to the full cache only if they are requested more often than the evicted ones (TinyLFU)")
+	keyDistSpec = flag.String("key-dist", keydist.Uniform, "Distribution of users requested by random-get, login, update and mixed modes: uniform, zipfian[:skew], hotspot[:hotSetFraction[:hotOpFraction]], sequential or latest[:skew]")
+	sqliteTune  = flag.String("sqlite-tuning", logic.DefaultSqliteTuningName, "Connection settings of sqlite: default, durable, optimized or bulk; applicable to sqlite and kvsqlite only")
+	boltNoSync  = flag.Bool("bolt-no-sync", false, "Skip fsync after every commit of bolt")
+	boltNoGrow  = flag.Bool("bolt-no-grow-sync", false, "Skip fsync after bolt database file grows")
+	boltFill    = flag.Float64("bolt-fill-percent", 0, "Fill percent of bolt pages, e.g. 0.9; zero keeps bolt default of 0.5")
+	boltBatch   = flag.Bool("bolt-batch", false, "Share write transactions of concurrent bolt writers by means of db.Batch")
+	boltBatchSz = flag.Int("bolt-max-batch-size", 0, "Maximum number of writers sharing bolt transaction, applicable to bolt-batch only; zero keeps bolt default")
+	boltBatchDl = flag.Duration("bolt-max-batch-delay", 0, "Maximum time bolt writers wait for others to share transaction, applicable to bolt-batch only; zero keeps bolt default")
+	listenAddr  = flag.String("listen", ":8080", "Address the REST or gRPC API is served at, applicable to serve and serve-grpc modes only")
+	serverURL   = flag.String("server-url", "http://localhost:8080", "URL of the server started in serve mode, applicable to http-load mode only")
+	codecName   = flag.String("codec", logic.GobCodecName, "Codec of values stored by key-value backends: gob, json, protobuf or binary; applicable to bolt, kvsqlite and leveldb only")
+
+	// query criteria, applicable to select mode only
+	queryRole        = flag.String("role", "", "Role of selected users, applicable to select mode only")
+	queryProvider    = flag.String("provider", "", "OAuth provider of selected users, applicable to select mode only")
+	queryCreatedFrom = flag.String("created-from", "", "Selected users should be created at or after the given date, e.g. 2010-01-02; applicable to select mode only")
+	queryCreatedTo   = flag.String("created-to", "", "Selected users should be created before the given date, e.g. 2011-01-02; applicable to select mode only")
+	queryNamePrefix  = flag.String("name-prefix", "", "Name prefix of selected users, applicable to select mode only")
+	queryOrder       = flag.String("order", "id", "Order of selected users: id, name or created; applicable to select mode only")
 )
 
+// queryDateLayout is a layout of created-from and created-to flags
+const queryDateLayout = "2006-01-02"
+
 func main() {
 	flag.Parse()
 
-	if len(*dbPath) == 0 {
+	if *mode == "compare" {
+		compareBackends()
+		return
+	}
+
+	if *mode == "codec" {
+		// codecs are measured on their own, without any database
+		started := time.Now()
+		summaries, elapsed := measureCodecs()
+		writeResults("codecs", started, elapsed, summaries, nil)
+		return
+	}
+
+	if *mode == "http-load" {
+		// the server is started separately in serve mode, so the workload measures backend along with HTTP stack
+		client := server.NewClient(*serverURL, &http.Client{
+			Transport: &http.Transport{MaxIdleConnsPerHost: *jobs},
+		})
+		defer client.Close()
+
+		started := time.Now()
+		summaries, elapsed, cacheStats := runMode(*workload, client)
+		writeResults("http", started, elapsed, summaries, cacheStats)
+		return
+	}
+
+	if len(*dbPath) == 0 && *dbType != memoryDaoType {
 		log.Printf("db path is empty")
 		flag.Usage()
 		return
 	}
 
-	if *mode == "reinit" {
+	if loadsUsers(*mode) && !*resume {
 		deleteFileIfExists(*dbPath)
 	}
 
-	var dao logic.Dao
-	var err error
-	switch *dbType {
+	dao, err := newDao(*dbType, *dbPath, opensReadOnly(*mode))
+	if err != nil {
+		log.Fatalf("cannot create dao: %v", err)
+	}
+	defer dao.Close()
+
+	if *dbType == memoryDaoType && !loadsUsers(*mode) {
+		// nothing persists across runs, so the fixture has to be loaded each time
+		log.Printf("initializing memory dao with %d users", *initSize)
+		reinit(dao)
+	}
+
+	started := time.Now()
+	summaries, elapsed, cacheStats := runMode(*mode, dao)
+	writeResults(*dbType, started, elapsed, summaries, cacheStats)
+}
+
+//
+// Private
+//
+
+// writeResults prints summary of the current mode and writes report if requested
+func writeResults(backend string, started time.Time, elapsed time.Duration, summaries []*stats.OpSummary, cacheStats *logic.CacheStats) {
+	fmt.Printf("%s mode done, elapsed=%s\n", *mode, elapsed)
+	if err := stats.WriteSummary(os.Stdout, backend, summaries); err != nil {
+		log.Printf("unable to write summary: %v", err)
+	}
+
+	if len(*reportPath) > 0 {
+		writeReport(*reportPath, newReport(backend, *mode, started, elapsed, summaries, cacheStats))
+	}
+}
+
+// newDao opens DAO of the given type, pending migrations are not applied to databases opened for reading only
+func newDao(daoType string, path string, readOnly bool) (logic.Dao, error) {
+	codec, err := logic.NewCodec(*codecName)
+	if err != nil {
+		return nil, err
+	}
+
+	preset, err := logic.GetSqliteTuning(*sqliteTune)
+	if err != nil {
+		return nil, err
+	}
+	tuning := *preset
+	tuning.ReadOnly = readOnly
+
+	switch daoType {
 	case sqliteDaoType:
-		dao, err = logic.NewSqliteDao(*dbPath)
+		return logic.NewSqliteDaoWithTuning(path, &tuning)
 	case "bolt":
-		dao, err = logic.NewBoltDao(*dbPath)
+		return logic.NewBoltDaoWithOptions(path, codec, &logic.BoltOptions{
+			NoSync:        *boltNoSync,
+			NoGrowSync:    *boltNoGrow,
+			FillPercent:   *boltFill,
+			Batch:         *boltBatch,
+			MaxBatchSize:  *boltBatchSz,
+			MaxBatchDelay: *boltBatchDl,
+			ReadOnly:      readOnly,
+		})
 	case "kvsqlite":
-		dao, err = logic.NewKvSqliteDao(*dbPath)
+		return logic.NewKvSqliteDaoWithTuning(path, codec, &tuning)
+	case "leveldb":
+		return logic.NewLevelDbDaoWithOptions(path, codec, &logic.LevelDbOptions{ReadOnly: readOnly})
+	case memoryDaoType:
+		return logic.NewMemoryDao(), nil
 	default:
-		log.Fatalf("unable to create new DAO of type %s", *dbType)
+		return nil, fmt.Errorf("unknown DAO type %s", daoType)
 	}
+}
 
-	if err != nil {
-		log.Fatalf("cannot create dao: %v", err)
+// runMode runs the given mode and returns per-operation summaries of all DAO calls made by it along with stats of
+// the cache, if it is enabled
+func runMode(m string, dao logic.Dao) ([]*stats.OpSummary, time.Duration, *logic.CacheStats) {
+	// operations that take longer than the timeout fail and are recorded as errors, while maintenance modes
+	// need the backend itself
+	backendDao := dao
+	if *opTimeout > 0 && !loadsUsers(m) {
+		dao = logic.NewTimeoutDao(dao, *opTimeout)
+	}
+
+	// cache hits are recorded as operations as well, so that summaries show the latency seen by the callers
+	var cache logic.CachedDao
+	if *cacheSize > 0 && !loadsUsers(m) {
+		dao = logic.NewCacheDao(dao, &logic.CacheOptions{Size: *cacheSize, Admission: *cacheAdmit})
+		cache = dao.(logic.CachedDao)
 	}
-	defer dao.Close()
 
-	switch *mode {
+	recorder := stats.NewRecorder()
+	started := time.Now()
+	switch m {
 	case "select":
-		selectUsers(dao)
+		selectUsers(stats.NewTimedDao(dao, recorder))
 	case "reinit":
-		reinit(dao)
+		reinit(stats.NewTimedDao(dao, recorder))
 	case "parallel-select":
-		parallelSelectUsers(dao)
+		parallelSelectUsers(dao, recorder)
+	case "filtered-select":
+		filteredSelectUsers(dao, recorder)
 	case "random-get":
-		randomGetUsers(dao)
+		randomGetUsers(dao, recorder)
+	case "login":
+		loginUsers(dao, recorder)
+	case "update":
+		randomUpdateUsers(dao, recorder)
+	case "delete":
+		deleteUsers(dao, recorder)
+	case "mixed":
+		mixedUsers(dao, recorder)
+	case "export":
+		exportUsers(stats.NewTimedDao(dao, recorder))
+	case "import":
+		importUsers(stats.NewTimedDao(dao, recorder))
+	case "verify":
+		verifyDao(backendDao)
+	case "tail":
+		tailChanges(backendDao)
+	case "serve":
+		serveUsers(stats.NewSyncTimedDao(dao, recorder))
+	case "serve-grpc":
+		serveGrpcUsers(stats.NewSyncTimedDao(dao, recorder))
+	case "rebuild-indexes":
+		maintainIndexes(backendDao, true)
+	case "verify-indexes":
+		maintainIndexes(backendDao, false)
 	default:
-		log.Fatalf("unknown mode=%s", *mode)
+		log.Fatalf("unknown mode=%s", m)
+	}
+	elapsed := time.Since(started)
+
+	var cacheStats *logic.CacheStats
+	if cache != nil {
+		cacheStats = cache.CacheStats()
+		log.Printf("cache stats: %s", cacheStats)
 	}
+	return recorder.Summarize(elapsed), elapsed, cacheStats
 }
 
-//
-// Private
-//
+// compareBackends runs the same workload against freshly initialized databases of every given backend
+func compareBackends() {
+	if *workload == "compare" || *workload == "reinit" {
+		log.Fatalf("workload=%s can not be compared", *workload)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "perfcomp-")
+	if err != nil {
+		log.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	results := []*stats.BackendResult{}
+	for _, backend := range strings.Split(*backends, ",") {
+		dao, err := newDao(backend, filepath.Join(tmpDir, backend+".db"), false)
+		if err != nil {
+			log.Fatalf("cannot create dao: %v", err)
+		}
+
+		log.Printf("[%s] initializing with %d users", backend, *initSize)
+		reinit(dao)
+
+		log.Printf("[%s] running %s workload", backend, *workload)
+		started := time.Now()
+		summaries, elapsed, cacheStats := runMode(*workload, dao)
+		if err := dao.Close(); err != nil {
+			log.Printf("[%s] unable to close dao: %v", backend, err)
+		}
+
+		results = append(results, &stats.BackendResult{Backend: backend, Elapsed: elapsed, Operations: summaries})
+		if len(*reportPath) > 0 {
+			// each backend gets its own report, e.g. /tmp/r.json -> /tmp/r-bolt.json
+			ext := filepath.Ext(*reportPath)
+			path := strings.TrimSuffix(*reportPath, ext) + "-" + backend + ext
+			writeReport(path, newReport(backend, *workload, started, elapsed, summaries, cacheStats))
+		}
+	}
+
+	fmt.Printf("%s workload done, initSize=%d, jobs=%d\n", *workload, *initSize, *jobs)
+	if err := stats.WriteComparison(os.Stdout, results); err != nil {
+		log.Printf("unable to write comparison: %v", err)
+	}
+}
+
+func writeReport(path string, report *stats.Report) {
+	if err := report.WriteFile(path); err != nil {
+		log.Fatalf("unable to write report: %v", err)
+	}
+	log.Printf("report written to %s", path)
+}
 
 func deleteFileIfExists(filePath string) {
-	// file exists, try to delete it
-	if err := os.Remove(filePath); err != nil {
+	// file exists, try to delete it; leveldb keeps its data in a directory, so remove it recursively
+	if err := os.RemoveAll(filePath); err != nil {
 		log.Printf("reinit db file=%s, remove operation failed: %v", filePath, err)
 	}
 }
 
+func newReport(
+	backend string,
+	m string,
+	started time.Time,
+	elapsed time.Duration,
+	summaries []*stats.OpSummary,
+	cacheStats *logic.CacheStats,
+) *stats.Report {
+	version, _, sourceID := sqlite3.Version()
+
+	// record remaining flags as run parameters, so that runs with different settings are never confused
+	params := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "db-path", "db-type", "mode", "init-size", "jobs", "report", "workload", "backends":
+			// either reported separately or irrelevant for comparison
+		default:
+			params[f.Name] = f.Value.String()
+		}
+	})
+
+	// profile name alone does not tell which pragmas were applied
+	if backend == sqliteDaoType || backend == "kvsqlite" {
+		if tuning, err := logic.GetSqliteTuning(*sqliteTune); err == nil {
+			params["sqlite-settings"] = tuning.String()
+		}
+	}
+
+	if cacheStats != nil {
+		params["cache-stats"] = cacheStats.String()
+	}
+
+	// defaults of the omitted parameters are recorded as well
+	if keyDist, err := keydist.Parse(*keyDistSpec); err == nil {
+		params["key-dist"] = keyDist.String()
+	}
+
+	return &stats.Report{
+		Backend:       backend,
+		Mode:          m,
+		InitSize:      *initSize,
+		Jobs:          *jobs,
+		GoVersion:     runtime.Version(),
+		SqliteVersion: version + " " + sourceID,
+		Started:       started,
+		Elapsed:       elapsed,
+		Params:        params,
+		Operations:    summaries,
+	}
+}
+
 func iterate(dao logic.Dao, limits []int, iterations int) {
+	ctx := context.Background()
 	offsetToken := ""
 	for n := 0; n < iterations; n++ {
 		limit := n % len(limits)
 
-		page, err := dao.QueryUsers(offsetToken, limit)
+		page, err := dao.QueryUsers(ctx, nil, offsetToken, limit)
 		if err != nil {
 			log.Printf("unexpected error while querying users: %v", err)
 		}
@@ -94,37 +379,60 @@ func iterate(dao logic.Dao, limits []int, iterations int) {
 	}
 }
 
-func randomGetUsers(dao logic.Dao) {
+// jobResult represents outcome of a single benchmark job
+type jobResult struct {
+	id        int
+	recorder  *stats.Recorder
+	timeSpent time.Duration
+}
+
+// newJobDao creates DAO that records latencies into the new job-local recorder
+func newJobDao(dao logic.Dao) (logic.Dao, *stats.Recorder) {
+	recorder := stats.NewRecorder()
+	return stats.NewTimedDao(dao, recorder), recorder
+}
+
+func randomGetUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
 	//const iterations = 10
 	const iterations = 100000
 
-	min, max, err := dao.GetIDRange()
+	keyDist := getKeyDistribution()
+
+	min, max, err := stats.NewTimedDao(dao, recorder).GetIDRange(ctx)
 	if err != nil {
 		fmt.Printf("unable to get id range, err=%v\n", err)
 		return
 	}
 
-	fmt.Printf("got id range: {min: %d, max: %d}\n", min, max)
-
-	//const threads = 1
-	const threads = 10
+	fmt.Printf("got id range: {min: %d, max: %d}, keys: %s\n", min, max, keyDist)
 
+	threads := *jobs
 	jobParams := make(chan int, threads)
-	done := make(chan int, threads)
+	done := make(chan *jobResult, threads)
 
 	// start jobs
 	for i := 0; i < threads; i++ {
 		go func() {
 			id := <-jobParams
 			log.Printf("[job %d] starting", id)
+			dao, jobRecorder := newJobDao(dao)
+			started := time.Now()
 			r := rand.New(rand.NewSource(int64(1000 + id)))
+			keys, err := keyDist.NewGenerator(r, max-min+1)
+			if err != nil {
+				log.Fatalf("[job %d] unable to generate keys: %v", id, err)
+			}
 
 			for j := 0; j < iterations; j++ {
-				userID := min + r.Intn(max-min)
-				u, err := dao.Get(userID)
+				userID := min + keys.Next()
+				u, err := dao.Get(ctx, userID)
 				if err != nil {
-					log.Printf("[job %d] error while querying users: %v", id, err)
-					break
+					// errors are counted by the recorder, so that one failed call does not end the whole job
+					if jobRecorder.Errors(stats.OpGet) == 1 {
+						log.Printf("[job %d] first error while querying users: %v", id, err)
+					}
+					continue
 				}
 
 				if u == nil { // should never happen
@@ -135,7 +443,7 @@ func randomGetUsers(dao logic.Dao) {
 				//log.Printf("[job %d] u = %s", id, u)
 			}
 
-			done <- id
+			done <- &jobResult{id: id, recorder: jobRecorder, timeSpent: time.Since(started)}
 		}()
 	}
 
@@ -144,13 +452,344 @@ func randomGetUsers(dao logic.Dao) {
 		jobParams <- i
 	}
 
-	started := time.Now()
+	// wait for completion
+	for i := 0; i < threads; i++ {
+		result := <-done
+		recorder.Merge(result.recorder)
+		log.Printf("job %d done, timeSpent=%s", result.id, result.timeSpent)
+	}
+}
+
+// getKeyDistribution returns distribution of the requested users given by -key-dist
+func getKeyDistribution() *keydist.Distribution {
+	result, err := keydist.Parse(*keyDistSpec)
+	if err != nil {
+		log.Fatalf("invalid key distribution: %v", err)
+	}
+	return result
+}
+
+// getOauthAccounts pages through all users and returns their oauth accounts
+func getOauthAccounts(dao logic.Dao) ([]*logic.OauthAccount, error) {
+	ctx := context.Background()
+	result := []*logic.OauthAccount{}
+	offsetToken := ""
+	for {
+		page, err := dao.QueryUsers(ctx, nil, offsetToken, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range page.Profiles {
+			result = append(result, p.Accounts...)
+		}
+
+		if len(page.OffsetToken) == 0 {
+			return result, nil
+		}
+		offsetToken = page.OffsetToken
+	}
+}
+
+func loginUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
+	const iterations = 100000
+
+	// accounts are collected upfront, so that collecting them is not measured
+	accounts, err := getOauthAccounts(dao)
+	if err != nil {
+		fmt.Printf("unable to get oauth accounts, err=%v\n", err)
+		return
+	}
+
+	if len(accounts) == 0 {
+		fmt.Println("there are no oauth accounts to log in with")
+		return
+	}
+
+	keyDist := getKeyDistribution()
+	fmt.Printf("got %d oauth accounts, keys: %s\n", len(accounts), keyDist)
+
+	threads := *jobs
+	jobParams := make(chan int, threads)
+	done := make(chan *jobResult, threads)
+
+	// start jobs
+	for i := 0; i < threads; i++ {
+		go func() {
+			id := <-jobParams
+			log.Printf("[job %d] starting", id)
+			dao, jobRecorder := newJobDao(dao)
+			started := time.Now()
+			r := rand.New(rand.NewSource(int64(5000 + id)))
+			keys, err := keyDist.NewGenerator(r, len(accounts))
+			if err != nil {
+				log.Fatalf("[job %d] unable to generate keys: %v", id, err)
+			}
+
+			for j := 0; j < iterations; j++ {
+				a := accounts[keys.Next()]
+				_, err := dao.FindByOauthAccount(ctx, a.Provider, a.Token)
+				if err != nil && jobRecorder.Errors(stats.OpFindByOauthAccount) == 1 {
+					log.Printf("[job %d] first error while finding user by oauth account: %v", id, err)
+				}
+			}
+
+			done <- &jobResult{id: id, recorder: jobRecorder, timeSpent: time.Since(started)}
+		}()
+	}
+
+	// send work units for the jobs
+	for i := 0; i < threads; i++ {
+		jobParams <- i
+	}
+
+	// wait for completion
+	for i := 0; i < threads; i++ {
+		result := <-done
+		recorder.Merge(result.recorder)
+		log.Printf("job %d done, timeSpent=%s", result.id, result.timeSpent)
+	}
+}
+
+func randomUpdateUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
+	const iterations = 1000
+	keyDist := getKeyDistribution()
+
+	min, max, err := stats.NewTimedDao(dao, recorder).GetIDRange(ctx)
+	if err != nil {
+		fmt.Printf("unable to get id range, err=%v\n", err)
+		return
+	}
+
+	fmt.Printf("got id range: {min: %d, max: %d}, keys: %s\n", min, max, keyDist)
+
+	threads := *jobs
+	jobParams := make(chan int, threads)
+	done := make(chan *jobResult, threads)
+
+	// start jobs
+	for i := 0; i < threads; i++ {
+		go func() {
+			id := <-jobParams
+			log.Printf("[job %d] starting", id)
+			dao, jobRecorder := newJobDao(dao)
+			started := time.Now()
+			r := rand.New(rand.NewSource(int64(2000 + id)))
+			keys, err := keyDist.NewGenerator(r, max-min+1)
+			if err != nil {
+				log.Fatalf("[job %d] unable to generate keys: %v", id, err)
+			}
+			from := time.Date(2000, time.January, 01, 0, 0, 0, 0, time.UTC)
+			now := time.Now()
+
+			for j := 0; j < iterations; j++ {
+				p := getRandomUserProfile(r, min+keys.Next(), from, now)
+				err := dao.Update(ctx, p)
+				if err != nil && jobRecorder.Errors(stats.OpUpdate) == 1 {
+					log.Printf("[job %d] first error while updating user: %v", id, err)
+				}
+			}
+
+			done <- &jobResult{id: id, recorder: jobRecorder, timeSpent: time.Since(started)}
+		}()
+	}
+
+	// send work units for the jobs
+	for i := 0; i < threads; i++ {
+		jobParams <- i
+	}
 
 	// wait for completion
 	for i := 0; i < threads; i++ {
-		id := <-done
-		timeSpent := time.Now().Sub(started)
-		log.Printf("job %d done, timeSpent=%s", id, timeSpent)
+		result := <-done
+		recorder.Merge(result.recorder)
+		log.Printf("job %d done, timeSpent=%s", result.id, result.timeSpent)
+	}
+}
+
+func deleteUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
+	min, max, err := stats.NewTimedDao(dao, recorder).GetIDRange(ctx)
+	if err != nil {
+		fmt.Printf("unable to get id range, err=%v\n", err)
+		return
+	}
+
+	fmt.Printf("got id range: {min: %d, max: %d}\n", min, max)
+
+	threads := *jobs
+	jobParams := make(chan int, threads)
+	done := make(chan *jobResult, threads)
+
+	// start jobs, each job deletes its own stripe of IDs so that jobs never collide
+	for i := 0; i < threads; i++ {
+		go func() {
+			id := <-jobParams
+			log.Printf("[job %d] starting", id)
+			dao, jobRecorder := newJobDao(dao)
+			started := time.Now()
+
+			n := 0
+			for userID := min + id; userID <= max; userID += threads {
+				if err := dao.Delete(ctx, userID); err != nil {
+					log.Printf("[job %d] error while deleting user: %v", id, err)
+					break
+				}
+				n++
+			}
+
+			log.Printf("[job %d] deleted %d users", id, n)
+			done <- &jobResult{id: id, recorder: jobRecorder, timeSpent: time.Since(started)}
+		}()
+	}
+
+	// send work units for the jobs
+	for i := 0; i < threads; i++ {
+		jobParams <- i
+	}
+
+	// wait for completion
+	for i := 0; i < threads; i++ {
+		result := <-done
+		recorder.Merge(result.recorder)
+		log.Printf("job %d done, timeSpent=%s", result.id, result.timeSpent)
+	}
+}
+
+// mixedOps defines operations supported in mixed mode
+var mixedOps = []string{stats.OpGet, stats.OpQueryUsers, stats.OpAdd, stats.OpUpdate}
+
+type mixedOpShare struct {
+	op      string
+	percent int
+}
+
+func parseOpMix(mix string) ([]*mixedOpShare, error) {
+	result := []*mixedOpShare{}
+	total := 0
+	for _, part := range strings.Split(mix, ",") {
+		nameValue := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(nameValue) != 2 {
+			return nil, fmt.Errorf("malformed operation share=%q, expected op=percent", part)
+		}
+
+		known := false
+		for _, op := range mixedOps {
+			if op == nameValue[0] {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation=%q, expected one of %s", nameValue[0], mixedOps)
+		}
+
+		percent, err := strconv.Atoi(nameValue[1])
+		if err != nil || percent < 0 {
+			return nil, fmt.Errorf("malformed percentage for operation=%s: %q", nameValue[0], nameValue[1])
+		}
+
+		total += percent
+		result = append(result, &mixedOpShare{op: nameValue[0], percent: percent})
+	}
+
+	if total != 100 {
+		return nil, fmt.Errorf("operation percentages should add up to 100, got %d", total)
+	}
+
+	return result, nil
+}
+
+func pickMixedOp(r *rand.Rand, shares []*mixedOpShare) string {
+	n := r.Intn(100)
+	for _, s := range shares {
+		if n < s.percent {
+			return s.op
+		}
+		n -= s.percent
+	}
+	return shares[len(shares)-1].op // unreachable as percentages add up to 100
+}
+
+func mixedUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
+	shares, err := parseOpMix(*opMix)
+	if err != nil {
+		log.Fatalf("invalid operation mix: %v", err)
+	}
+	keyDist := getKeyDistribution()
+
+	min, max, err := stats.NewTimedDao(dao, recorder).GetIDRange(ctx)
+	if err != nil {
+		fmt.Printf("unable to get id range, err=%v\n", err)
+		return
+	}
+
+	fmt.Printf("got id range: {min: %d, max: %d}, mix: %s, keys: %s\n", min, max, *opMix, keyDist)
+
+	// added users get IDs past the initial range, so that concurrent jobs never collide
+	nextID := int64(max)
+
+	threads := *jobs
+	jobParams := make(chan int, threads)
+	done := make(chan *jobResult, threads)
+
+	// start jobs
+	for i := 0; i < threads; i++ {
+		go func() {
+			id := <-jobParams
+			log.Printf("[job %d] starting", id)
+			dao, jobRecorder := newJobDao(dao)
+			r := rand.New(rand.NewSource(int64(3000 + id)))
+			keys, err := keyDist.NewGenerator(r, max-min+1)
+			if err != nil {
+				log.Fatalf("[job %d] unable to generate keys: %v", id, err)
+			}
+			from := time.Date(2000, time.January, 01, 0, 0, 0, 0, time.UTC)
+			now := time.Now()
+
+			offsetToken := ""
+			started := time.Now()
+			for j := 0; j < *opCount; j++ {
+				op := pickMixedOp(r, shares)
+
+				var err error
+				switch op {
+				case stats.OpGet:
+					_, err = dao.Get(ctx, min+keys.Next())
+				case stats.OpQueryUsers:
+					var page *logic.UserPage
+					if page, err = dao.QueryUsers(ctx, nil, offsetToken, 1+r.Intn(20)); err == nil {
+						offsetToken = page.OffsetToken
+					}
+				case stats.OpAdd:
+					userID := int(atomic.AddInt64(&nextID, 1))
+					err = dao.Add(ctx, []*logic.UserProfile{getRandomUserProfile(r, userID, from, now)})
+				case stats.OpUpdate:
+					err = dao.Update(ctx, getRandomUserProfile(r, min+keys.Next(), from, now))
+				}
+
+				if err != nil && jobRecorder.Errors(op) == 1 {
+					log.Printf("[job %d] first %s error: %v", id, op, err)
+				}
+			}
+
+			done <- &jobResult{id: id, recorder: jobRecorder, timeSpent: time.Since(started)}
+		}()
+	}
+
+	// send work units for the jobs
+	for i := 0; i < threads; i++ {
+		jobParams <- i
+	}
+
+	// wait for completion
+	for i := 0; i < threads; i++ {
+		result := <-done
+		recorder.Merge(result.recorder)
+		log.Printf("job %d done, timeSpent=%s", result.id, result.timeSpent)
 	}
 }
 
@@ -163,11 +802,13 @@ type parallelSelectParams struct {
 type parallelSelectResult struct {
 	id                int
 	totalUsersFetched int
+	recorder          *stats.Recorder
 	timeSpent         time.Duration
 }
 
-func parallelSelectUsers(dao logic.Dao) {
-	const threads = 10
+func parallelSelectUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
+	threads := *jobs
 	jobParams := make(chan *parallelSelectParams, threads)
 	done := make(chan *parallelSelectResult, threads)
 
@@ -176,15 +817,18 @@ func parallelSelectUsers(dao logic.Dao) {
 		go func() {
 			params := <-jobParams
 			log.Printf("[job %d] starting", params.id)
+			dao, jobRecorder := newJobDao(dao)
 
 			offsetToken := ""
 			n := 0
 			started := time.Now()
 			for j := 0; j < params.iterations; j++ {
-				userPage, err := dao.QueryUsers(offsetToken, params.limits[j%len(params.limits)])
+				userPage, err := dao.QueryUsers(ctx, nil, offsetToken, params.limits[j%len(params.limits)])
 				if err != nil {
-					log.Printf("[job %d] error while querying users: %v", params.id, err)
-					break
+					if jobRecorder.Errors(stats.OpQueryUsers) == 1 {
+						log.Printf("[job %d] first error while querying users: %v", params.id, err)
+					}
+					continue
 				}
 				offsetToken = userPage.OffsetToken
 				n += len(userPage.Profiles)
@@ -193,6 +837,7 @@ func parallelSelectUsers(dao logic.Dao) {
 			done <- &parallelSelectResult{
 				id:                params.id,
 				totalUsersFetched: n,
+				recorder:          jobRecorder,
 				timeSpent:         time.Now().Sub(started),
 			}
 		}()
@@ -207,6 +852,7 @@ func parallelSelectUsers(dao logic.Dao) {
 	// wait for completion
 	for i := 0; i < threads; i++ {
 		result := <-done
+		recorder.Merge(result.recorder)
 		log.Printf("job %d done, totalUsersFetched=%d, timeSpent=%s",
 			result.id, result.totalUsersFetched, result.timeSpent)
 	}
@@ -220,7 +866,8 @@ func getParallelSelectParams(id int, r *rand.Rand) *parallelSelectParams {
 	}
 	limits := make([]int, 100)
 	for j := 0; j < len(limits); j++ {
-		limits[j] = r.Intn(10) * (1 + limitIndex)
+		// QueryUsers rejects non-positive limits
+		limits[j] = (1 + r.Intn(10)) * (1 + limitIndex)
 	}
 
 	return &parallelSelectParams{
@@ -230,15 +877,273 @@ func getParallelSelectParams(id int, r *rand.Rand) *parallelSelectParams {
 	}
 }
 
+// maintainIndexes rebuilds or verifies secondary indexes of DAO that maintains them on its own
+func maintainIndexes(dao logic.Dao, rebuild bool) {
+	indexedDao, ok := dao.(logic.IndexedDao)
+	if !ok {
+		log.Fatalf("dao does not maintain secondary indexes on its own")
+	}
+
+	if rebuild {
+		if err := indexedDao.RebuildIndexes(); err != nil {
+			log.Fatalf("unable to rebuild indexes: %v", err)
+		}
+		log.Printf("indexes rebuilt")
+	}
+
+	if err := indexedDao.VerifyIndexes(); err != nil {
+		log.Fatalf("indexes are inconsistent: %v", err)
+	}
+	log.Printf("indexes verified")
+}
+
+// serveUsers serves REST API backed by DAO until the process is interrupted
+func serveUsers(dao logic.Dao) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &http.Server{Addr: *listenAddr, Handler: server.NewHandler(dao)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("unable to shut down server: %v", err)
+		}
+	}()
+
+	log.Printf("serving users at %s, interrupt to stop and print summary", *listenAddr)
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("unable to serve: %v", err)
+	}
+}
+
+// serveGrpcUsers serves UserService gRPC API backed by DAO until the process is interrupted
+func serveGrpcUsers(dao logic.Dao) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatalf("unable to listen at %s: %v", *listenAddr, err)
+	}
+
+	s := grpcserver.NewServer(dao)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+
+	log.Printf("serving gRPC users at %s, interrupt to stop and print summary", *listenAddr)
+	if err := s.Serve(listener); err != nil {
+		log.Fatalf("unable to serve: %v", err)
+	}
+}
+
+// tailChanges prints changes of users as they are committed until the process is interrupted
+func tailChanges(dao logic.Dao) {
+	feed, ok := dao.(logic.ChangeFeedDao)
+	if !ok {
+		log.Fatalf("dao does not support change feed")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	from := *fromSeq
+	if from == 0 {
+		last, err := feed.LastChangeSeq(ctx)
+		if err != nil {
+			log.Fatalf("unable to get last change: %v", err)
+		}
+		from = last + 1
+	}
+
+	log.Printf("tailing changes from seq=%d, interrupt to stop", from)
+	count := 0
+	err := feed.Subscribe(ctx, from, func(c *logic.Change) error {
+		fmt.Println(c)
+		count++
+		return nil
+	})
+	if err != nil && err != context.Canceled {
+		log.Fatalf("unable to tail changes: %v", err)
+	}
+	log.Printf("printed %d changes", count)
+}
+
+// verifyDao checks integrity of the database and prints found problems along with the ways to repair them
+func verifyDao(dao logic.Dao) {
+	verifiableDao, ok := dao.(logic.VerifiableDao)
+	if !ok {
+		log.Fatalf("dao does not support verification")
+	}
+
+	report, err := verifiableDao.Verify(context.Background())
+	if err != nil {
+		log.Fatalf("unable to verify database: %v", err)
+	}
+
+	if err := report.Write(os.Stdout, 20); err != nil {
+		log.Printf("unable to write verification report: %v", err)
+	}
+	if !report.OK() {
+		log.Fatalf("database has %d problems", len(report.Problems))
+	}
+	log.Printf("database verified")
+}
+
+// measureCodecs encodes and decodes the fixture of init-size users with every codec, operations of each codec are
+// reported separately, e.g. encode/json
+func measureCodecs() ([]*stats.OpSummary, time.Duration) {
+	const rounds = 10
+
+	recorder := stats.NewRecorder()
+	profiles := getUserFixture(*initSize, 1)
+	started := time.Now()
+	for _, name := range logic.CodecNames {
+		codec, err := logic.NewCodec(name)
+		if err != nil {
+			log.Fatalf("cannot create codec: %v", err)
+		}
+
+		size := 0
+		for i := 0; i < rounds; i++ {
+			for _, p := range profiles {
+				encodeStarted := time.Now()
+				data, err := codec.Encode(p)
+				recorder.Record("encode/"+name, time.Since(encodeStarted), err)
+				if err != nil {
+					continue
+				}
+				size += len(data)
+
+				decodeStarted := time.Now()
+				_, err = codec.Decode(data)
+				recorder.Record("decode/"+name, time.Since(decodeStarted), err)
+			}
+		}
+
+		if len(profiles) > 0 {
+			log.Printf("codec=%s, average value size=%d bytes", name, size/(rounds*len(profiles)))
+		}
+	}
+	elapsed := time.Since(started)
+
+	return recorder.Summarize(elapsed), elapsed
+}
+
+// loadsUsers tells whether the given mode fills database with users in batches
+func loadsUsers(m string) bool {
+	return m == "reinit" || m == "import"
+}
+
+// opensReadOnly tells whether the given mode inspects database as it is, without applying pending migrations
+func opensReadOnly(m string) bool {
+	return m == "verify"
+}
+
+// newBulkLoadOptions returns options of batched load, that is resumed if requested
+func newBulkLoadOptions(ctx context.Context, dao logic.Dao) *logic.BulkLoadOptions {
+	options := &logic.BulkLoadOptions{
+		BatchSize:        *batchSize,
+		CommitInterval:   *commitEvery,
+		ProgressInterval: 5 * time.Second,
+		Progress: func(p *logic.BulkLoadProgress) {
+			log.Printf("loaded %d users: %s", p.Loaded+p.Skipped, p)
+		},
+	}
+
+	if *resume {
+		// batches are committed in order of IDs, so every user up to the largest stored ID is already there
+		_, lastID, err := dao.GetIDRange(ctx)
+		if err != nil {
+			log.Fatalf("cannot get id range: %v", err)
+		}
+		options.ResumeAfter = lastID
+		log.Printf("resume loading after id=%d", lastID)
+	}
+
+	return options
+}
+
+// reinit streams the fixture of init-size users into DAO in batches, so that neither the whole fixture nor
+// a single transaction has to hold all the users
 func reinit(dao logic.Dao) {
-	// insert fixture
-	if err := dao.Add(getUserFixture(*initSize, 1)); err != nil {
-		log.Fatalf("cannot add user profile: %v", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := newBulkLoadOptions(ctx, dao)
+	options.Progress = func(p *logic.BulkLoadProgress) {
+		log.Printf("loaded %d of %d users: %s", p.Loaded+p.Skipped, *initSize, p)
+	}
+
+	if _, err := logic.BulkLoad(ctx, dao, streamUserFixture(ctx, *initSize, 1), options); err != nil {
+		log.Fatalf("cannot load user fixture: %v", err)
 	}
 }
 
+// exportUsers writes all the users to the dump, so that the same fixture can be imported into other backends
+func exportUsers(dao logic.Dao) {
+	ctx := context.Background()
+	if len(*dumpPath) == 0 {
+		log.Fatalf("dump path is empty")
+	}
+
+	f, err := os.Create(*dumpPath)
+	if err != nil {
+		log.Fatalf("cannot create dump: %v", err)
+	}
+	defer f.Close()
+
+	w, err := logic.NewDumpWriter(f, *dumpFormat)
+	if err != nil {
+		log.Fatalf("cannot write dump: %v", err)
+	}
+
+	count, err := logic.ExportUsers(ctx, dao, w, 1000)
+	if err != nil {
+		log.Fatalf("cannot export users: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("cannot close dump: %v", err)
+	}
+	log.Printf("exported %d users to %s", count, *dumpPath)
+}
+
+// importUsers loads all the users of the dump in batches
+func importUsers(dao logic.Dao) {
+	ctx := context.Background()
+	if len(*dumpPath) == 0 {
+		log.Fatalf("dump path is empty")
+	}
+
+	f, err := os.Open(*dumpPath)
+	if err != nil {
+		log.Fatalf("cannot open dump: %v", err)
+	}
+	defer f.Close()
+
+	r, err := logic.NewDumpReader(f, *dumpFormat)
+	if err != nil {
+		log.Fatalf("cannot read dump: %v", err)
+	}
+
+	progress, err := logic.ImportUsers(ctx, dao, r, newBulkLoadOptions(ctx, dao))
+	if err != nil {
+		log.Fatalf("cannot import users: %v", err)
+	}
+	log.Printf("imported %d users from %s", progress.Loaded, *dumpPath)
+}
+
 func selectUsers(dao logic.Dao) {
-	userPage, err := dao.QueryUsers(*offsetToken, 8)
+	ctx := context.Background()
+	query, err := getUserQuery()
+	if err != nil {
+		log.Fatalf("invalid query: %v", err)
+	}
+
+	userPage, err := dao.QueryUsers(ctx, query, *offsetToken, 8)
 	if err != nil {
 		log.Fatalf("cannot get user profiles: %v", err)
 	}
@@ -256,38 +1161,184 @@ func selectUsers(dao logic.Dao) {
 
 }
 
+// getUserQuery builds query out of the query criteria flags
+func getUserQuery() (*logic.UserQuery, error) {
+	result := &logic.UserQuery{
+		Role:       *queryRole,
+		Provider:   *queryProvider,
+		NamePrefix: *queryNamePrefix,
+	}
+
+	switch *queryOrder {
+	case "id":
+		result.Order = logic.OrderByID
+	case "name":
+		result.Order = logic.OrderByName
+	case "created":
+		result.Order = logic.OrderByCreated
+	default:
+		return nil, fmt.Errorf("unknown order=%s", *queryOrder)
+	}
+
+	var err error
+	if len(*queryCreatedFrom) > 0 {
+		if result.CreatedFrom, err = time.Parse(queryDateLayout, *queryCreatedFrom); err != nil {
+			return nil, fmt.Errorf("malformed created-from date: %v", err)
+		}
+	}
+	if len(*queryCreatedTo) > 0 {
+		if result.CreatedTo, err = time.Parse(queryDateLayout, *queryCreatedTo); err != nil {
+			return nil, fmt.Errorf("malformed created-to date: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// filteredQueryKinds defines kinds of queries measured in filtered-select mode, each kind is reported as
+// a separate operation, e.g. query/role
+var filteredQueryKinds = []string{"all", "role", "provider", "created", "name-prefix", "order-name", "order-created"}
+
+func getFilteredQuery(r *rand.Rand, kind string) *logic.UserQuery {
+	switch kind {
+	case "role":
+		return &logic.UserQuery{Role: fixture.GetRandomStr(r, logic.Roles[:])}
+	case "provider":
+		return &logic.UserQuery{Provider: fixture.GetRandomStr(r, logic.OauthProviders[:])}
+	case "created":
+		// one year long window within the range of fixture creation dates
+		from := time.Date(2000+r.Intn(16), time.Month(1+r.Intn(12)), 1, 0, 0, 0, 0, time.UTC)
+		return &logic.UserQuery{CreatedFrom: from, CreatedTo: from.AddDate(1, 0, 0)}
+	case "name-prefix":
+		return &logic.UserQuery{NamePrefix: fixture.GetRandomStr(r, fixture.PersonFirstNames)[:2]}
+	case "order-name":
+		return &logic.UserQuery{Order: logic.OrderByName}
+	case "order-created":
+		return &logic.UserQuery{Order: logic.OrderByCreated}
+	default:
+		return nil
+	}
+}
+
+func filteredSelectUsers(dao logic.Dao, recorder *stats.Recorder) {
+	ctx := context.Background()
+	const iterations = 700
+
+	threads := *jobs
+	jobParams := make(chan int, threads)
+	done := make(chan *jobResult, threads)
+
+	// start jobs
+	for i := 0; i < threads; i++ {
+		go func() {
+			id := <-jobParams
+			log.Printf("[job %d] starting", id)
+			jobRecorder := stats.NewRecorder()
+			r := rand.New(rand.NewSource(int64(4000 + id)))
+
+			// every kind of query pages through its own results, a new query is started once the last page is reached
+			queries := make([]*logic.UserQuery, len(filteredQueryKinds))
+			offsetTokens := make([]string, len(filteredQueryKinds))
+
+			started := time.Now()
+			for j := 0; j < iterations; j++ {
+				k := j % len(filteredQueryKinds)
+				if len(offsetTokens[k]) == 0 {
+					queries[k] = getFilteredQuery(r, filteredQueryKinds[k])
+				}
+
+				op := stats.OpQueryUsers + "/" + filteredQueryKinds[k]
+				callStarted := time.Now()
+				page, err := dao.QueryUsers(ctx, queries[k], offsetTokens[k], 20)
+				jobRecorder.Record(op, time.Since(callStarted), err)
+				if err != nil {
+					if jobRecorder.Errors(op) == 1 {
+						log.Printf("[job %d] first %s error: %v", id, op, err)
+					}
+					offsetTokens[k] = ""
+					continue
+				}
+
+				offsetTokens[k] = page.OffsetToken
+			}
+
+			done <- &jobResult{id: id, recorder: jobRecorder, timeSpent: time.Since(started)}
+		}()
+	}
+
+	// send work units for the jobs
+	for i := 0; i < threads; i++ {
+		jobParams <- i
+	}
+
+	// wait for completion
+	for i := 0; i < threads; i++ {
+		result := <-done
+		recorder.Merge(result.recorder)
+		log.Printf("job %d done, timeSpent=%s", result.id, result.timeSpent)
+	}
+}
+
 func getUserFixture(count int, startID int) []*logic.UserProfile {
 	result := []*logic.UserProfile{}
-	r := rand.New(rand.NewSource(1))
-	from := time.Date(2000, time.January, 01, 0, 0, 0, 0, time.UTC)
-	now := time.Now()
-
+	next := newUserFixture(startID)
 	for i := 0; i < count; i++ {
-		created := fixture.GetRandomDateBetween(r, from, now)
-		result = append(result, &logic.UserProfile{
-			ID:       startID + i,
-			Name:     fixture.GetRandomStr(r, fixture.PersonFirstNames) + " " + fixture.GetRandomStr(r, fixture.PersonLastNames),
-			Created:  created,
-			Accounts: getRandomOauthAccounts(r, created, now),
-			Roles:    getRandomRoles(r),
-		})
+		result = append(result, next())
 	}
 
 	//log.Printf("Prepared users: %s\n", result)
 	return result
 }
 
-var oauthAccountDistribution = []int{1, 1, 1, 1, 2, 2, 2, 3, 3, 4}
+// streamUserFixture sends the same users as getUserFixture does to the returned channel, which is closed once
+// all the users are sent or the context is done
+func streamUserFixture(ctx context.Context, count int, startID int) <-chan *logic.UserProfile {
+	result := make(chan *logic.UserProfile, 1000)
+	go func() {
+		defer close(result)
 
-var oauthProviders = []string{
-	"VK", "Facebook", "Google", "Twitter",
+		next := newUserFixture(startID)
+		for i := 0; i < count; i++ {
+			select {
+			case result <- next():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return result
+}
+
+// newUserFixture returns generator of the fixture users with sequential IDs
+func newUserFixture(startID int) func() *logic.UserProfile {
+	r := rand.New(rand.NewSource(1))
+	from := time.Date(2000, time.January, 01, 0, 0, 0, 0, time.UTC)
+	now := time.Now()
+	id := startID
+	return func() *logic.UserProfile {
+		id++
+		return getRandomUserProfile(r, id-1, from, now)
+	}
 }
 
+func getRandomUserProfile(r *rand.Rand, id int, from time.Time, to time.Time) *logic.UserProfile {
+	created := fixture.GetRandomDateBetween(r, from, to)
+	return &logic.UserProfile{
+		ID:       id,
+		Name:     fixture.GetRandomStr(r, fixture.PersonFirstNames) + " " + fixture.GetRandomStr(r, fixture.PersonLastNames),
+		Created:  created,
+		Accounts: getRandomOauthAccounts(r, created, to),
+		Roles:    getRandomRoles(r),
+	}
+}
+
+var oauthAccountDistribution = []int{1, 1, 1, 1, 2, 2, 2, 3, 3, 4}
+
 func getRandomOauthAccount(r *rand.Rand, from time.Time, to time.Time) *logic.OauthAccount {
 	tokenBytes := [16]byte{}
 	r.Read(tokenBytes[:])
 	return &logic.OauthAccount{
-		Provider: fixture.GetRandomStr(r, oauthProviders),
+		Provider: fixture.GetRandomStr(r, logic.OauthProviders[:]),
 		Token:    hex.EncodeToString(tokenBytes[:]),
 		Created:  fixture.GetRandomDateBetween(r, from, to),
 	}
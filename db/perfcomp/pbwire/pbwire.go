@@ -0,0 +1,29 @@
+// Package pbwire helps to encode protocol buffers messages by hand on top of protowire, messages of perfcomp are
+// simple enough for that, so that no code generation is needed
+package pbwire
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ConsumeMessage calls consumeField for every field of the message, consumeField returns length of the field
+// value or negative length, if the value is malformed
+func ConsumeMessage(data []byte, consumeField func(num protowire.Number, typ protowire.Type, v []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n, err := consumeField(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package pbwire
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestConsumeMessage(t *testing.T) {
+	var message []byte
+	message = protowire.AppendTag(message, 1, protowire.VarintType)
+	message = protowire.AppendVarint(message, 42)
+	message = protowire.AppendTag(message, 2, protowire.BytesType)
+	message = protowire.AppendString(message, "Alice")
+
+	t.Run("fields", func(t *testing.T) {
+		fields := []protowire.Number{}
+		err := ConsumeMessage(message, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+			fields = append(fields, num)
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []protowire.Number{1, 2}, fields)
+	})
+
+	t.Run("empty message", func(t *testing.T) {
+		assert.Nil(t, ConsumeMessage(nil, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+			t.Fatalf("unexpected field=%d", num)
+			return 0, nil
+		}))
+	})
+
+	t.Run("truncated message", func(t *testing.T) {
+		err := ConsumeMessage(message[:len(message)-1], func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("malformed tag", func(t *testing.T) {
+		err := ConsumeMessage([]byte{0x80}, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+			return protowire.ConsumeFieldValue(num, typ, v), nil
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("field error", func(t *testing.T) {
+		fieldErr := errors.New("unexpected field")
+		err := ConsumeMessage(message, func(num protowire.Number, typ protowire.Type, v []byte) (int, error) {
+			return 0, fieldErr
+		})
+		assert.Equal(t, fieldErr, err)
+	})
+}
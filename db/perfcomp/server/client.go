@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+)
+
+type client struct {
+	logic.Dao
+
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates DAO that forwards calls to the REST API served at the given URL, e.g. http://localhost:8080;
+// finding users by oauth account is not exposed by the API, so it is not supported
+func NewClient(baseURL string, httpClient *http.Client) logic.Dao {
+	return &client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient}
+}
+
+func (t *client) Close() error {
+	t.httpClient.CloseIdleConnections()
+	return nil
+}
+
+func (t *client) Add(ctx context.Context, profiles []*logic.UserProfile) error {
+	body, err := json.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	return t.do(ctx, http.MethodPost, usersPath, body, http.StatusCreated, nil)
+}
+
+func (t *client) Update(ctx context.Context, profile *logic.UserProfile) error {
+	body, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return t.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", usersPath, profile.ID), body, http.StatusNoContent, nil)
+}
+
+func (t *client) Delete(ctx context.Context, id int) error {
+	return t.do(ctx, http.MethodDelete, fmt.Sprintf("%s/%d", usersPath, id), nil, http.StatusNoContent, nil)
+}
+
+func (t *client) QueryUsers(ctx context.Context, query *logic.UserQuery, offsetToken string, limit int) (*logic.UserPage, error) {
+	params := url.Values{}
+	if query != nil {
+		for name, value := range map[string]string{
+			"role":       query.Role,
+			"provider":   query.Provider,
+			"namePrefix": query.NamePrefix,
+		} {
+			if len(value) > 0 {
+				params.Set(name, value)
+			}
+		}
+		if !query.CreatedFrom.IsZero() {
+			params.Set("createdFrom", query.CreatedFrom.Format(time.RFC3339Nano))
+		}
+		if !query.CreatedTo.IsZero() {
+			params.Set("createdTo", query.CreatedTo.Format(time.RFC3339Nano))
+		}
+		switch query.Order {
+		case logic.OrderByName:
+			params.Set("order", "name")
+		case logic.OrderByCreated:
+			params.Set("order", "created")
+		}
+	}
+	if len(offsetToken) > 0 {
+		params.Set("offsetToken", offsetToken)
+	}
+	params.Set("limit", strconv.Itoa(limit))
+
+	var page logic.UserPage
+	if err := t.do(ctx, http.MethodGet, usersPath+"?"+params.Encode(), nil, http.StatusOK, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (t *client) Get(ctx context.Context, id int) (*logic.UserProfile, error) {
+	var p logic.UserProfile
+	if err := t.do(ctx, http.MethodGet, fmt.Sprintf("%s/%d", usersPath, id), nil, http.StatusOK, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (t *client) FindByOauthAccount(ctx context.Context, provider string, token string) (*logic.UserProfile, error) {
+	return nil, errors.New("finding users by oauth account is not supported by REST API")
+}
+
+func (t *client) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	var r IDRange
+	if err := t.do(ctx, http.MethodGet, usersPath+"/id-range", nil, http.StatusOK, &r); err != nil {
+		return 0, 0, err
+	}
+	return r.From, r.To, nil
+}
+
+//
+// Private
+//
+
+// do sends request and decodes JSON response into the given result unless it is nil, responses of the other
+// than expected status are turned into errors, 404 ones wrap logic.ErrNotFound
+func (t *client) do(ctx context.Context, method string, path string, body []byte, status int, result interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, t.baseURL+path, bodyReader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		message, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("%s %s: status=%d, message=%s", method, path, resp.StatusCode, strings.TrimSpace(string(message)))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%v: %w", err, logic.ErrNotFound)
+		}
+		return err
+	}
+
+	if result == nil {
+		// connection is only reused once the body is read to the end
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
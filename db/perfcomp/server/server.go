@@ -0,0 +1,308 @@
+// Package server exposes logic.Dao as a REST API, so that backends can be measured along with JSON encoding and
+// network stack, and provides client of that API
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+)
+
+// Limits of the page size of user queries
+const (
+	DefaultPageLimit = 10
+	MaxPageLimit     = 1000
+)
+
+// IDRange is a body of GET /users/id-range response
+type IDRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// NewHandler creates handler of the REST API backed by the given DAO, users are encoded as JSON objects of
+// logic.UserProfile:
+//
+//	GET    /users?offsetToken=&limit=  page of users, optionally filtered by role, provider, namePrefix,
+//	                                   createdFrom and createdTo (RFC 3339) and ordered by order (id, name, created)
+//	POST   /users                      adds a user or a JSON array of users
+//	GET    /users/id-range             range of IDs of the stored users
+//	GET    /users/{id}                 a single user
+//	PUT    /users/{id}                 updates the user
+//	DELETE /users/{id}                 deletes the user
+func NewHandler(dao logic.Dao) http.Handler {
+	return &handler{dao: dao}
+}
+
+//
+// Private
+//
+
+const usersPath = "/users"
+
+// maxBodySize limits size of request bodies, that is enough for batches of thousands of users
+const maxBodySize = 16 << 20
+
+type handler struct {
+	dao logic.Dao
+}
+
+func (t *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	if r.URL.Path == usersPath {
+		switch r.Method {
+		case http.MethodGet:
+			t.queryUsers(w, r)
+		case http.MethodPost:
+			t.addUsers(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		}
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, usersPath+"/")
+	if name == r.URL.Path || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path=%s", r.URL.Path))
+		return
+	}
+
+	if name == "id-range" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		t.getIDRange(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed user id=%q", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		t.getUser(w, r, id)
+	case http.MethodPut:
+		t.updateUser(w, r, id)
+	case http.MethodDelete:
+		t.deleteUser(w, r, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func (t *handler) queryUsers(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query, err := parseUserQuery(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	limit := DefaultPageLimit
+	if s := params.Get("limit"); len(s) > 0 {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > MaxPageLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit should be within [1, %d], actual: %q", MaxPageLimit, s))
+			return
+		}
+	}
+
+	page, err := t.dao.QueryUsers(r.Context(), query, params.Get("offsetToken"), limit)
+	if err != nil {
+		writeDaoError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (t *handler) addUsers(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", tooLarge.Limit))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unable to read body: %v", err))
+		return
+	}
+
+	// a single user is an object, while batches of users are arrays
+	profiles := []*logic.UserProfile{}
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(body, &profiles)
+	} else {
+		var p logic.UserProfile
+		err = json.Unmarshal(body, &p)
+		profiles = append(profiles, &p)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed users: %v", err))
+		return
+	}
+	for _, p := range profiles {
+		if err := checkProfile(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if err := t.dao.Add(r.Context(), profiles); err != nil {
+		writeDaoError(w, err)
+		return
+	}
+
+	if len(profiles) == 1 {
+		w.Header().Set("Location", fmt.Sprintf("%s/%d", usersPath, profiles[0].ID))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (t *handler) getIDRange(w http.ResponseWriter, r *http.Request) {
+	from, to, err := t.dao.GetIDRange(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &IDRange{From: from, To: to})
+}
+
+func (t *handler) getUser(w http.ResponseWriter, r *http.Request, id int) {
+	p, err := t.dao.Get(r.Context(), id)
+	if err != nil {
+		writeDaoError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (t *handler) updateUser(w http.ResponseWriter, r *http.Request, id int) {
+	var p logic.UserProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed user: %v", err))
+		return
+	}
+	if p.ID != id {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("user id=%d does not match id=%d of the path", p.ID, id))
+		return
+	}
+	if err := checkProfile(&p); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := t.dao.Update(r.Context(), &p); err != nil {
+		writeDaoError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *handler) deleteUser(w http.ResponseWriter, r *http.Request, id int) {
+	if err := t.dao.Delete(r.Context(), id); err != nil {
+		writeDaoError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkProfile rejects roles and providers, that are unknown to DAOs, so that they are not mistaken for failures
+// of the backend
+func checkProfile(p *logic.UserProfile) error {
+	for _, r := range p.Roles {
+		if !contains(logic.Roles[:], r) {
+			return fmt.Errorf("unknown role=%q of user id=%d, expected one of %s", r, p.ID, logic.Roles)
+		}
+	}
+	for _, a := range p.Accounts {
+		if a == nil || !contains(logic.OauthProviders[:], a.Provider) {
+			return fmt.Errorf("unknown provider of oauth account=%s of user id=%d, expected one of %s",
+				a, p.ID, logic.OauthProviders)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func parseUserQuery(params map[string][]string) (*logic.UserQuery, error) {
+	get := func(name string) string {
+		if values := params[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	result := &logic.UserQuery{Role: get("role"), Provider: get("provider"), NamePrefix: get("namePrefix")}
+	for _, p := range []struct {
+		name   string
+		target *time.Time
+	}{{"createdFrom", &result.CreatedFrom}, {"createdTo", &result.CreatedTo}} {
+		if s := get(p.name); len(s) > 0 {
+			created, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, fmt.Errorf("malformed %s=%q, expected RFC 3339 time", p.name, s)
+			}
+			*p.target = created
+		}
+	}
+
+	switch order := get("order"); order {
+	case "", "id":
+		result.Order = logic.OrderByID
+	case "name":
+		result.Order = logic.OrderByName
+	case "created":
+		result.Order = logic.OrderByCreated
+	default:
+		return nil, fmt.Errorf("unknown order=%q, expected id, name or created", order)
+	}
+
+	return result, nil
+}
+
+func writeDaoError(w http.ResponseWriter, err error) {
+	if errors.Is(err, logic.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, logic.ErrInvalidOffsetToken) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, logic.ErrAlreadyExists) || errors.Is(err, logic.ErrAccountTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("unable to write response: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"github.com/avshabanov/go-code/db/perfcomp/logic/daotest"
+	"github.com/avshabanov/go-code/db/perfcomp/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	serve := func(t *testing.T, dao logic.Dao) (logic.Dao, *httptest.Server) {
+		s := httptest.NewServer(NewHandler(dao))
+		t.Cleanup(s.Close)
+		return NewClient(s.URL, s.Client()), s
+	}
+	newClient := func(t *testing.T) (logic.Dao, *httptest.Server) {
+		return serve(t, logic.NewMemoryDao())
+	}
+
+	t.Run("users round trip", func(t *testing.T) {
+		client, _ := newClient(t)
+		profiles := daotest.NewProfiles(1, 2, 3)
+		require.Nil(t, client.Add(ctx, profiles))
+
+		p, err := client.Get(ctx, 2)
+		require.Nil(t, err)
+		daotest.AssertProfilesEqual(t, profiles[1], p)
+
+		profiles[1].Name = "Updated"
+		require.Nil(t, client.Update(ctx, profiles[1]))
+		require.Nil(t, client.Delete(ctx, 3))
+
+		page, err := client.QueryUsers(ctx, nil, "", 1)
+		require.Nil(t, err)
+		require.Len(t, page.Profiles, 1)
+		assert.Equal(t, 1, page.Profiles[0].ID)
+
+		page, err = client.QueryUsers(ctx, nil, page.OffsetToken, 10)
+		require.Nil(t, err)
+		require.Len(t, page.Profiles, 1)
+		daotest.AssertProfilesEqual(t, profiles[1], page.Profiles[0])
+		assert.Empty(t, page.OffsetToken)
+
+		from, to, err := client.GetIDRange(ctx)
+		require.Nil(t, err)
+		assert.Equal(t, 1, from)
+		assert.Equal(t, 2, to)
+	})
+
+	t.Run("filtered query", func(t *testing.T) {
+		client, _ := newClient(t)
+		profiles := daotest.NewProfiles(1, 2, 3)
+		require.Nil(t, client.Add(ctx, profiles))
+
+		page, err := client.QueryUsers(ctx, &logic.UserQuery{
+			Provider:    "Google",
+			CreatedFrom: profiles[1].Created,
+			Order:       logic.OrderByCreated,
+		}, "", 10)
+		require.Nil(t, err)
+		require.Len(t, page.Profiles, 1)
+		assert.Equal(t, 3, page.Profiles[0].ID)
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		client, _ := newClient(t)
+
+		_, err := client.Get(ctx, 1)
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+		err = client.Delete(ctx, 1)
+		assert.True(t, errors.Is(err, logic.ErrNotFound), "unexpected error: %v", err)
+	})
+
+	t.Run("malformed requests", func(t *testing.T) {
+		_, s := newClient(t)
+		for _, r := range []struct {
+			method string
+			path   string
+			body   string
+			status int
+		}{
+			{http.MethodGet, "/users/abc", "", http.StatusBadRequest},
+			{http.MethodGet, "/users?limit=0", "", http.StatusBadRequest},
+			{http.MethodGet, "/users?offsetToken=abc", "", http.StatusBadRequest},
+			{http.MethodGet, "/users?limit=1001", "", http.StatusBadRequest},
+			{http.MethodGet, "/users?order=random", "", http.StatusBadRequest},
+			{http.MethodGet, "/users?createdFrom=2010-01-01", "", http.StatusBadRequest},
+			{http.MethodPost, "/users", "{", http.StatusBadRequest},
+			{http.MethodPost, "/users", `{"ID": 1, "Roles": ["OWNER"]}`, http.StatusBadRequest},
+			{http.MethodPost, "/users", `{"ID": 1, "Accounts": [{"Provider": "MySpace"}]}`, http.StatusBadRequest},
+			{http.MethodPost, "/users", "[" + strings.Repeat(" ", maxBodySize) + "]", http.StatusRequestEntityTooLarge},
+			{http.MethodPut, "/users/1", `{"ID": 1, "Roles": ["OWNER"]}`, http.StatusBadRequest},
+			{http.MethodPut, "/users/2", `{"ID": 1}`, http.StatusBadRequest},
+			{http.MethodPatch, "/users", "", http.StatusMethodNotAllowed},
+			{http.MethodPost, "/users/id-range", "", http.StatusMethodNotAllowed},
+			{http.MethodGet, "/accounts", "", http.StatusNotFound},
+			{http.MethodGet, "/users/1/roles", "", http.StatusNotFound},
+		} {
+			req, err := http.NewRequest(r.method, s.URL+r.path, strings.NewReader(r.body))
+			require.Nil(t, err)
+			resp, err := s.Client().Do(req)
+			require.Nil(t, err)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, r.status, resp.StatusCode, "%s %s", r.method, r.path)
+		}
+	})
+
+	// run with -race to catch unguarded access to the recorder
+	t.Run("parallel requests are recorded", func(t *testing.T) {
+		const callers, calls = 8, 20
+
+		dao := logic.NewMemoryDao()
+		require.Nil(t, dao.Add(ctx, daotest.NewProfiles(1)))
+		recorder := stats.NewRecorder()
+		client, _ := serve(t, stats.NewSyncTimedDao(dao, recorder))
+
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < calls; j++ {
+					_, err := client.Get(ctx, 1)
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		summaries := recorder.Summarize(time.Second)
+		require.Len(t, summaries, 1)
+		assert.Equal(t, int64(callers*calls), summaries[0].Count)
+	})
+
+	t.Run("conflicting users", func(t *testing.T) {
+		client, s := newClient(t)
+		profiles := daotest.NewProfiles(1, 2)
+		require.Nil(t, client.Add(ctx, profiles[:1]))
+
+		taken := *profiles[1]
+		taken.Accounts = profiles[0].Accounts
+		for _, p := range []*logic.UserProfile{profiles[0], &taken} {
+			body, err := json.Marshal(p)
+			require.Nil(t, err)
+			resp, err := s.Client().Post(s.URL+"/users", "application/json", bytes.NewReader(body))
+			require.Nil(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusConflict, resp.StatusCode, "user=%s", p)
+		}
+	})
+
+	t.Run("single user is added with location", func(t *testing.T) {
+		_, s := newClient(t)
+		resp, err := s.Client().Post(s.URL+"/users", "application/json", strings.NewReader(`{"ID": 5, "Name": "Eve"}`))
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "/users/5", resp.Header.Get("Location"))
+	})
+}
@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// BackendResult represents results of a workload run against a particular backend
+type BackendResult struct {
+	Backend    string
+	Elapsed    time.Duration
+	Operations []*OpSummary
+}
+
+// WriteComparison prints a side-by-side table of results obtained for the same workload on different backends,
+// the first result is used as a baseline: speedup of 2.00x means half the baseline mean latency of the operation,
+// wall times of the backends follow in a separate table, where it means half the baseline wall time
+func WriteComparison(w io.Writer, results []*BackendResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	baseline := results[0]
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tbackend\tcount\terrors\tops/sec\tp50\tp99\tp999\tspeedup\t")
+
+	for _, op := range operationNames(results) {
+		baseOp := findOpSummary(baseline.Operations, op)
+		for _, r := range results {
+			s := findOpSummary(r.Operations, op)
+			if s == nil {
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\t-\t-\t\n", op, r.Backend)
+				continue
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n",
+				op, r.Backend, s.Count, s.Errors, s.OpsPerSecond, s.P50, s.P99, s.P999,
+				formatSpeedup(baseOp, s))
+		}
+	}
+
+	// blank line ends the columns of the operations, so that the totals are aligned on their own
+	fmt.Fprintln(tw, "\nbackend\telapsed\tspeedup\t")
+	for _, r := range results {
+		speedup := "-"
+		if r.Elapsed > 0 {
+			speedup = fmt.Sprintf("%.3gx", baseline.Elapsed.Seconds()/r.Elapsed.Seconds())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", r.Backend, r.Elapsed, speedup)
+	}
+
+	return tw.Flush()
+}
+
+//
+// Private
+//
+
+// operationNames returns names of all the operations in order of their first appearance
+func operationNames(results []*BackendResult) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, r := range results {
+		for _, s := range r.Operations {
+			if !seen[s.Op] {
+				seen[s.Op] = true
+				names = append(names, s.Op)
+			}
+		}
+	}
+	return names
+}
+
+func findOpSummary(summaries []*OpSummary, op string) *OpSummary {
+	for _, s := range summaries {
+		if s.Op == op {
+			return s
+		}
+	}
+	return nil
+}
+
+func formatSpeedup(baseline *OpSummary, s *OpSummary) string {
+	if baseline == nil || s.Mean == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.3gx", float64(baseline.Mean)/float64(s.Mean))
+}
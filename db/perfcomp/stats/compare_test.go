@@ -0,0 +1,31 @@
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteComparison(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, WriteComparison(&buf, []*BackendResult{
+		{Backend: "sqlite", Elapsed: 2 * time.Second, Operations: []*OpSummary{{Op: OpGet, Count: 10, Mean: 2 * time.Millisecond}}},
+		{Backend: "bolt", Elapsed: time.Second, Operations: []*OpSummary{{Op: OpGet, Count: 10, Mean: time.Millisecond}}},
+	}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 7)
+	assert.Equal(t, []string{"op", "backend", "count", "errors", "ops/sec", "p50", "p99", "p999", "speedup"},
+		strings.Fields(lines[0]))
+	assert.Equal(t, "2x", strings.Fields(lines[2])[8])
+	assert.Empty(t, strings.TrimSpace(lines[3]))
+
+	// wall time is not mistaken for a latency percentile
+	assert.Equal(t, []string{"backend", "elapsed", "speedup"}, strings.Fields(lines[4]))
+	assert.Equal(t, []string{"sqlite", "2s", "1x"}, strings.Fields(lines[5]))
+	assert.Equal(t, []string{"bolt", "1s", "2x"}, strings.Fields(lines[6]))
+}
@@ -0,0 +1,142 @@
+package stats
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Histogram records durations into log-linear buckets in HdrHistogram fashion: values below subBucketCount
+// nanoseconds are stored exactly and larger values are stored with a relative error below 1/subBucketHalf.
+// Histogram is not safe for concurrent use.
+type Histogram struct {
+	counts []int64
+	total  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+	maxShift       = 64 - subBucketBits
+)
+
+// NewHistogram creates an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]int64, subBucketCount+maxShift*subBucketHalf),
+		min:    math.MaxInt64,
+	}
+}
+
+// Record adds a single duration to the histogram, negative durations are recorded as zero
+func (h *Histogram) Record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+
+	h.counts[bucketIndex(v)]++
+	h.total++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Merge adds all the values recorded in the other histogram to this one
+func (h *Histogram) Merge(other *Histogram) {
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.total += other.total
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Count returns total number of recorded values
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Min returns the smallest recorded value or zero if histogram is empty
+func (h *Histogram) Min() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.min)
+}
+
+// Max returns the largest recorded value
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
+
+// Mean returns an exact average of the recorded values
+func (h *Histogram) Mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / h.total)
+}
+
+// Percentile returns the value below or at which the given percentage (0..100) of recorded values fall
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(p / 100 * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			v := bucketUpperBound(i)
+			if v > h.max {
+				v = h.max // do not report values beyond actually recorded ones
+			}
+			return time.Duration(v)
+		}
+	}
+
+	return time.Duration(h.max) // unreachable
+}
+
+//
+// Private
+//
+
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	top := int(v >> uint(shift)) // always within [subBucketHalf, subBucketCount)
+	return subBucketCount + (shift-1)*subBucketHalf + (top - subBucketHalf)
+}
+
+func bucketUpperBound(index int) int64 {
+	if index < subBucketCount {
+		return int64(index)
+	}
+
+	shift := (index-subBucketCount)/subBucketHalf + 1
+	top := int64((index-subBucketCount)%subBucketHalf + subBucketHalf)
+	return top<<uint(shift) + (1<<uint(shift) - 1)
+}
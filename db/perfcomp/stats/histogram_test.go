@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	t.Run("empty histogram", func(t *testing.T) {
+		h := NewHistogram()
+		assert.Equal(t, int64(0), h.Count())
+		assert.Equal(t, time.Duration(0), h.Min())
+		assert.Equal(t, time.Duration(0), h.Percentile(99))
+	})
+
+	t.Run("percentiles within precision", func(t *testing.T) {
+		h := NewHistogram()
+		for i := 1; i <= 1000; i++ {
+			h.Record(time.Duration(i) * time.Microsecond)
+		}
+
+		assert.Equal(t, int64(1000), h.Count())
+		assert.Equal(t, time.Microsecond, h.Min())
+		assert.Equal(t, 1000*time.Microsecond, h.Max())
+		assert.InEpsilon(t, float64(500*time.Microsecond), float64(h.Percentile(50)), 0.02)
+		assert.InEpsilon(t, float64(900*time.Microsecond), float64(h.Percentile(90)), 0.02)
+		assert.InEpsilon(t, float64(990*time.Microsecond), float64(h.Percentile(99)), 0.02)
+		assert.Equal(t, 1000*time.Microsecond, h.Percentile(100))
+	})
+
+	t.Run("small values are exact", func(t *testing.T) {
+		h := NewHistogram()
+		for i := 0; i < subBucketCount; i++ {
+			h.Record(time.Duration(i))
+		}
+		assert.Equal(t, time.Duration(63), h.Percentile(50))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		a := NewHistogram()
+		b := NewHistogram()
+		a.Record(time.Millisecond)
+		b.Record(time.Second)
+
+		a.Merge(b)
+
+		assert.Equal(t, int64(2), a.Count())
+		assert.Equal(t, time.Millisecond, a.Min())
+		assert.Equal(t, time.Second, a.Max())
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	r1 := NewRecorder()
+	r1.Record(OpGet, time.Millisecond, nil)
+	r1.Record(OpGet, 2*time.Millisecond, errors.New("fail"))
+
+	r2 := NewRecorder()
+	r2.Record(OpAdd, time.Millisecond, nil)
+	r2.Record(OpGet, time.Millisecond, nil)
+
+	r1.Merge(r2)
+	summaries := r1.Summarize(time.Second)
+
+	assert.Equal(t, 2, len(summaries))
+	assert.Equal(t, OpAdd, summaries[0].Op)
+	assert.Equal(t, OpGet, summaries[1].Op)
+	assert.Equal(t, int64(3), summaries[1].Count)
+	assert.Equal(t, int64(1), summaries[1].Errors)
+	assert.Equal(t, 3.0, summaries[1].OpsPerSecond)
+}
@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Recorder accumulates latencies and error counts per operation type.
+// Recorder is not safe for concurrent use, so each job is expected to use its own recorder and merge it into
+// the common one upon completion.
+type Recorder struct {
+	ops map[string]*opStats
+}
+
+type opStats struct {
+	latencies *Histogram
+	errors    int64
+}
+
+// OpSummary represents aggregated statistics of a single operation type, durations are serialized as nanoseconds
+type OpSummary struct {
+	Op           string        `json:"op"`
+	Count        int64         `json:"count"`
+	Errors       int64         `json:"errors"`
+	OpsPerSecond float64       `json:"opsPerSecond"`
+	Min          time.Duration `json:"minNs"`
+	Mean         time.Duration `json:"meanNs"`
+	P50          time.Duration `json:"p50Ns"`
+	P90          time.Duration `json:"p90Ns"`
+	P99          time.Duration `json:"p99Ns"`
+	P999         time.Duration `json:"p999Ns"`
+	Max          time.Duration `json:"maxNs"`
+}
+
+// NewRecorder creates an empty recorder
+func NewRecorder() *Recorder {
+	return &Recorder{ops: map[string]*opStats{}}
+}
+
+// Record registers a single completed operation, failed operations are counted as errors but their latencies
+// are recorded as well
+func (r *Recorder) Record(op string, d time.Duration, err error) {
+	s := r.get(op)
+	s.latencies.Record(d)
+	if err != nil {
+		s.errors++
+	}
+}
+
+// Merge adds statistics accumulated by the other recorder to this one
+func (r *Recorder) Merge(other *Recorder) {
+	for op, o := range other.ops {
+		s := r.get(op)
+		s.latencies.Merge(o.latencies)
+		s.errors += o.errors
+	}
+}
+
+// Errors returns number of failed operations of the given type
+func (r *Recorder) Errors(op string) int64 {
+	if s, ok := r.ops[op]; ok {
+		return s.errors
+	}
+	return 0
+}
+
+// Summarize produces per-operation summaries sorted by operation name, elapsed is a wall time of the workload
+// and used to compute throughput
+func (r *Recorder) Summarize(elapsed time.Duration) []*OpSummary {
+	result := []*OpSummary{}
+	for op, s := range r.ops {
+		h := s.latencies
+		summary := &OpSummary{
+			Op:     op,
+			Count:  h.Count(),
+			Errors: s.errors,
+			Min:    h.Min(),
+			Mean:   h.Mean(),
+			P50:    h.Percentile(50),
+			P90:    h.Percentile(90),
+			P99:    h.Percentile(99),
+			P999:   h.Percentile(99.9),
+			Max:    h.Max(),
+		}
+		if elapsed > 0 {
+			summary.OpsPerSecond = float64(summary.Count) / elapsed.Seconds()
+		}
+		result = append(result, summary)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Op < result[j].Op })
+	return result
+}
+
+// WriteSummary prints a table of the given per-operation summaries obtained for the given backend
+func WriteSummary(w io.Writer, backend string, summaries []*OpSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "backend\top\tcount\terrors\tops/sec\tmin\tmean\tp50\tp90\tp99\tp999\tmax\t")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			backend, s.Op, s.Count, s.Errors, s.OpsPerSecond,
+			s.Min, s.Mean, s.P50, s.P90, s.P99, s.P999, s.Max)
+	}
+	return tw.Flush()
+}
+
+//
+// Private
+//
+
+func (r *Recorder) get(op string) *opStats {
+	s, ok := r.ops[op]
+	if !ok {
+		s = &opStats{latencies: NewHistogram()}
+		r.ops[op] = s
+	}
+	return s
+}
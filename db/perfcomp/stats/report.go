@@ -0,0 +1,122 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report represents machine-readable results of a single benchmark run
+type Report struct {
+	Backend       string            `json:"backend"`
+	Mode          string            `json:"mode"`
+	InitSize      int               `json:"initSize"`
+	Jobs          int               `json:"jobs"`
+	GoVersion     string            `json:"goVersion"`
+	SqliteVersion string            `json:"sqliteVersion"`
+	Started       time.Time         `json:"started"`
+	Elapsed       time.Duration     `json:"elapsedNs"`
+	Params        map[string]string `json:"params,omitempty"`
+	Operations    []*OpSummary      `json:"operations"`
+}
+
+// reportCsvHeader defines columns of CSV report, each row represents single operation of the run
+var reportCsvHeader = []string{
+	"backend", "mode", "initSize", "jobs", "goVersion", "sqliteVersion", "started", "elapsedNs", "params",
+	"op", "count", "errors", "opsPerSecond", "minNs", "meanNs", "p50Ns", "p90Ns", "p99Ns", "p999Ns", "maxNs",
+}
+
+// WriteFile writes report to the given file, CSV format is used for files with .csv extension and JSON otherwise
+func (r *Report) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create report file=%s: %v", path, err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = r.WriteCSV(f)
+	} else {
+		err = r.WriteJSON(f)
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// WriteJSON writes report as a single indented JSON object
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCSV writes report as a CSV table with header and one row per operation
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(reportCsvHeader); err != nil {
+		return err
+	}
+
+	run := []string{
+		r.Backend,
+		r.Mode,
+		strconv.Itoa(r.InitSize),
+		strconv.Itoa(r.Jobs),
+		r.GoVersion,
+		r.SqliteVersion,
+		r.Started.Format(time.RFC3339),
+		strconv.FormatInt(int64(r.Elapsed), 10),
+		r.formatParams(),
+	}
+
+	for _, s := range r.Operations {
+		row := append(append([]string{}, run...),
+			s.Op,
+			strconv.FormatInt(s.Count, 10),
+			strconv.FormatInt(s.Errors, 10),
+			strconv.FormatFloat(s.OpsPerSecond, 'f', 3, 64),
+			strconv.FormatInt(int64(s.Min), 10),
+			strconv.FormatInt(int64(s.Mean), 10),
+			strconv.FormatInt(int64(s.P50), 10),
+			strconv.FormatInt(int64(s.P90), 10),
+			strconv.FormatInt(int64(s.P99), 10),
+			strconv.FormatInt(int64(s.P999), 10),
+			strconv.FormatInt(int64(s.Max), 10),
+		)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+//
+// Private
+//
+
+// formatParams represents params as a sorted list of name=value pairs, so that rows are stable across runs
+func (r *Report) formatParams() string {
+	names := []string{}
+	for name := range r.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, name+"="+r.Params[name])
+	}
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,47 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReport(t *testing.T) {
+	report := &Report{
+		Backend:  "bolt",
+		Mode:     "random-get",
+		InitSize: 100,
+		Jobs:     2,
+		Params:   map[string]string{"ops": "10", "mix": "get=100"},
+		Operations: []*OpSummary{
+			{Op: OpGet, Count: 10, P50: time.Microsecond},
+			{Op: OpGetIDRange, Count: 1},
+		},
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.Nil(t, report.WriteCSV(&buf))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Equal(t, 3, len(lines))
+		assert.Equal(t, strings.Join(reportCsvHeader, ","), lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "bolt,random-get,100,2,"))
+		assert.Contains(t, lines[1], ",mix=get=100;ops=10,get,10,0,")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.Nil(t, report.WriteJSON(&buf))
+
+		var decoded Report
+		assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Equal(t, "bolt", decoded.Backend)
+		assert.Equal(t, 2, len(decoded.Operations))
+		assert.Equal(t, time.Microsecond, decoded.Operations[0].P50)
+	})
+}
@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+)
+
+// Operation names recorded by the timed DAO
+const (
+	OpAdd                = "add"
+	OpUpdate             = "update"
+	OpDelete             = "delete"
+	OpQueryUsers         = "query"
+	OpGet                = "get"
+	OpFindByOauthAccount = "find-account"
+	OpGetIDRange         = "id-range"
+)
+
+type timedDao struct {
+	logic.Dao
+
+	dao      logic.Dao
+	recorder *Recorder
+	lock     *sync.Mutex // guards recorder of DAOs shared by concurrent callers, nil otherwise
+}
+
+// NewTimedDao creates DAO that forwards calls to the given one and records latency of each call,
+// the given recorder should not be shared with the other goroutines
+func NewTimedDao(dao logic.Dao, recorder *Recorder) logic.Dao {
+	return &timedDao{dao: dao, recorder: recorder}
+}
+
+// NewSyncTimedDao creates timed DAO, that might be called by concurrent goroutines, such as handlers of a server,
+// the given recorder should not be used until all the calls are completed
+func NewSyncTimedDao(dao logic.Dao, recorder *Recorder) logic.Dao {
+	return &timedDao{dao: dao, recorder: recorder, lock: &sync.Mutex{}}
+}
+
+func (t *timedDao) Close() error {
+	return t.dao.Close()
+}
+
+func (t *timedDao) Add(ctx context.Context, profiles []*logic.UserProfile) error {
+	started := time.Now()
+	err := t.dao.Add(ctx, profiles)
+	t.record(OpAdd, time.Since(started), err)
+	return err
+}
+
+func (t *timedDao) Update(ctx context.Context, profile *logic.UserProfile) error {
+	started := time.Now()
+	err := t.dao.Update(ctx, profile)
+	t.record(OpUpdate, time.Since(started), err)
+	return err
+}
+
+func (t *timedDao) Delete(ctx context.Context, id int) error {
+	started := time.Now()
+	err := t.dao.Delete(ctx, id)
+	t.record(OpDelete, time.Since(started), err)
+	return err
+}
+
+func (t *timedDao) QueryUsers(ctx context.Context, query *logic.UserQuery, offsetToken string, limit int) (*logic.UserPage, error) {
+	started := time.Now()
+	page, err := t.dao.QueryUsers(ctx, query, offsetToken, limit)
+	t.record(OpQueryUsers, time.Since(started), err)
+	return page, err
+}
+
+func (t *timedDao) Get(ctx context.Context, id int) (*logic.UserProfile, error) {
+	started := time.Now()
+	profile, err := t.dao.Get(ctx, id)
+	t.record(OpGet, time.Since(started), err)
+	return profile, err
+}
+
+func (t *timedDao) FindByOauthAccount(ctx context.Context, provider string, token string) (*logic.UserProfile, error) {
+	started := time.Now()
+	profile, err := t.dao.FindByOauthAccount(ctx, provider, token)
+	t.record(OpFindByOauthAccount, time.Since(started), err)
+	return profile, err
+}
+
+func (t *timedDao) GetIDRange(ctx context.Context) (from int, to int, err error) {
+	started := time.Now()
+	from, to, err = t.dao.GetIDRange(ctx)
+	t.record(OpGetIDRange, time.Since(started), err)
+	return from, to, err
+}
+
+//
+// Private
+//
+
+func (t *timedDao) record(op string, d time.Duration, err error) {
+	if t.lock != nil {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+	}
+	t.recorder.Record(op, d, err)
+}
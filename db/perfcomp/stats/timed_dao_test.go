@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avshabanov/go-code/db/perfcomp/logic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimedDao(t *testing.T) {
+	ctx := context.Background()
+	memoryDao := logic.NewMemoryDao()
+	require.Nil(t, memoryDao.Add(ctx, []*logic.UserProfile{{ID: 1, Name: "Alice", Created: time.Now()}}))
+
+	t.Run("calls are recorded", func(t *testing.T) {
+		recorder := NewRecorder()
+		dao := NewTimedDao(memoryDao, recorder)
+
+		_, err := dao.Get(ctx, 1)
+		assert.Nil(t, err)
+		_, err = dao.Get(ctx, 2)
+		assert.NotNil(t, err)
+
+		summaries := recorder.Summarize(time.Second)
+		require.Equal(t, 1, len(summaries))
+		assert.Equal(t, OpGet, summaries[0].Op)
+		assert.Equal(t, int64(2), summaries[0].Count)
+		assert.Equal(t, int64(1), summaries[0].Errors)
+	})
+
+	// run with -race to catch unguarded access to the recorder
+	t.Run("concurrent calls are recorded", func(t *testing.T) {
+		const callers, calls = 8, 100
+
+		recorder := NewRecorder()
+		dao := NewSyncTimedDao(memoryDao, recorder)
+
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < calls; j++ {
+					_, err := dao.Get(ctx, 1)
+					assert.Nil(t, err)
+					_, err = dao.QueryUsers(ctx, nil, "", 10)
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		summaries := recorder.Summarize(time.Second)
+		require.Equal(t, 2, len(summaries))
+		for _, s := range summaries {
+			assert.Equal(t, int64(callers*calls), s.Count, "op=%s", s.Op)
+			assert.Equal(t, int64(0), s.Errors, "op=%s", s.Op)
+		}
+	})
+}
@@ -1,16 +1,27 @@
 package sqlutil
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 )
 
+// ErrNoResults is returned by SelectSingleValue if the query yields no rows
+var ErrNoResults = errors.New("query yield no results")
+
 // ScannerCallback encapsulates a user knowledge about scan logic that has to be made on the given row set
 type ScannerCallback func(rows *sql.Rows) error
 
 // SelectSingleValue performs a query and expects a single value returned in the result set
 func SelectSingleValue(callback ScannerCallback, stmt *sql.Stmt, args ...interface{}) error {
-	rows, err := stmt.Query(args...)
+	return SelectSingleValueContext(context.Background(), callback, stmt, args...)
+}
+
+// SelectSingleValueContext performs a query, that is cancelled along with the given context, and expects a single
+// value returned in the result set
+func SelectSingleValueContext(ctx context.Context, callback ScannerCallback, stmt *sql.Stmt, args ...interface{}) error {
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return err
 	}
@@ -30,7 +41,7 @@ func SelectSingleValue(callback ScannerCallback, stmt *sql.Stmt, args ...interfa
 	}
 
 	if !obtained {
-		return fmt.Errorf("query yield no results")
+		return ErrNoResults
 	}
 
 	return nil
@@ -38,13 +49,19 @@ func SelectSingleValue(callback ScannerCallback, stmt *sql.Stmt, args ...interfa
 
 // SelectSingleInt performs a query and expects a single integer value in the result set
 func SelectSingleInt(tx *sql.Tx, sqlQuery string, args ...interface{}) (int, error) {
-	stmt, err := tx.Prepare(sqlQuery)
+	return SelectSingleIntContext(context.Background(), tx, sqlQuery, args...)
+}
+
+// SelectSingleIntContext performs a query, that is cancelled along with the given context, and expects a single
+// integer value in the result set
+func SelectSingleIntContext(ctx context.Context, tx *sql.Tx, sqlQuery string, args ...interface{}) (int, error) {
+	stmt, err := tx.PrepareContext(ctx, sqlQuery)
 	if err != nil {
 		return 0, err
 	}
 
 	var result int
-	if err := SelectSingleValue(func(rows *sql.Rows) error {
+	if err := SelectSingleValueContext(ctx, func(rows *sql.Rows) error {
 		return rows.Scan(&result)
 	}, stmt, args...); err != nil {
 		return 0, err